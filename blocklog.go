@@ -0,0 +1,166 @@
+package modd
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/termlog"
+)
+
+const logTimeFmt = "2006-01-02 15:04:05"
+
+// Terminal color codes, which are stripped from log file output
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// logFile is a block's log file. It is opened in append mode on first write,
+// and kept open for the lifetime of the process.
+type logFile struct {
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+	// Set once a write error has been reported, so that a broken log file
+	// doesn't produce a warning for every line of output
+	failed bool
+	sync.Mutex
+}
+
+// All log files, by path. Blocks that log to the same file share a logFile.
+var logFiles = struct {
+	files map[string]*logFile
+	sync.Mutex
+}{files: map[string]*logFile{}}
+
+// getLogFile returns the logFile for a path, creating it if needed
+func getLogFile(path string, maxSize int64) *logFile {
+	logFiles.Lock()
+	defer logFiles.Unlock()
+	f, ok := logFiles.files[path]
+	if !ok {
+		f = &logFile{path: path}
+		logFiles.files[path] = f
+	}
+	f.Lock()
+	f.maxSize = maxSize
+	f.Unlock()
+	return f
+}
+
+func (f *logFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = fi.Size()
+	return nil
+}
+
+// rotate moves the current log file aside to path.1, replacing any previous
+// rotated file, and starts a new one
+func (f *logFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *logFile) write(line string) error {
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+	line = ansiEscape.ReplaceAllString(line, "")
+	entry := fmt.Sprintf("%s %s\n", time.Now().Format(logTimeFmt), line)
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(entry)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.WriteString(entry)
+	f.size += int64(n)
+	return err
+}
+
+// log writes a line to the log file. Write errors are reported to warn, once
+// until a write succeeds again, and never interrupt the command.
+func (f *logFile) log(warn termlog.Logger, format string, args ...interface{}) {
+	f.Lock()
+	defer f.Unlock()
+	err := f.write(fmt.Sprintf(format, args...))
+	if err != nil && !f.failed {
+		warn.Warn("Error writing to log file: %s", err)
+	}
+	f.failed = err != nil
+}
+
+// teeLog is a termlog.TermLog whose streams also write command output to a
+// block's log file
+type teeLog struct {
+	termlog.TermLog
+	file *logFile
+}
+
+func (t *teeLog) Stream(header string) termlog.Stream {
+	return &teeStream{
+		Stream: t.TermLog.Stream(header),
+		header: header,
+		file:   t.file,
+		warn:   t.TermLog,
+	}
+}
+
+// blockLog returns a log for a block's commands, which also writes to the
+// block's log file if it has one
+func blockLog(b conf.Block, log termlog.TermLog) termlog.TermLog {
+	if b.LogFile == "" {
+		return log
+	}
+	return &teeLog{TermLog: log, file: getLogFile(b.LogFile, b.LogMaxSize)}
+}
+
+// teeStream is a termlog.Stream that also writes to a log file. Debug output
+// logged with the *As methods is not written to the file.
+type teeStream struct {
+	termlog.Stream
+	header string
+	file   *logFile
+	warn   termlog.Logger
+}
+
+func (t *teeStream) Header() {
+	t.Stream.Header()
+	t.file.log(t.warn, "%s", t.header)
+}
+
+func (t *teeStream) Say(format string, args ...interface{}) {
+	t.Stream.Say(format, args...)
+	t.file.log(t.warn, format, args...)
+}
+
+func (t *teeStream) Notice(format string, args ...interface{}) {
+	t.Stream.Notice(format, args...)
+	t.file.log(t.warn, format, args...)
+}
+
+func (t *teeStream) Warn(format string, args ...interface{}) {
+	t.Stream.Warn(format, args...)
+	t.file.log(t.warn, format, args...)
+}
+
+func (t *teeStream) Shout(format string, args ...interface{}) {
+	t.Stream.Shout(format, args...)
+	t.file.log(t.warn, format, args...)
+}
@@ -0,0 +1,123 @@
+package modd
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/utils"
+	"github.com/cortesi/termlog"
+)
+
+func TestBlockLog(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		** {
+			log: ./one.log
+			prep: echo ":one: ran"
+		}
+		** {
+			prep: echo ":two: ran"
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:        lt.Log,
+		Config:     cnf,
+		quietUntil: make([]time.Time, len(cnf.Blocks)),
+	}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.trigger(".", nil, dworld)
+	mr.trigger(".", nil, dworld)
+	// Runs with --prep write to the log file too
+	if err := mr.PrepOnly(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := mr.PrepAll(true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Output still goes to the terminal
+	if n := strings.Count(lt.String(), "\n:one: ran\n"); n != 4 {
+		t.Errorf("Expected output on the terminal four times, got:\n%s", lt.String())
+	}
+	data, err := ioutil.ReadFile("one.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := string(data)
+	if strings.Count(log, " :one: ran\n") != 4 || strings.Count(log, " prep: echo") != 4 {
+		t.Errorf("Unexpected log file contents:\n%s", log)
+	}
+	if strings.Contains(log, ":two:") {
+		t.Errorf("Log file contains output from another block:\n%s", log)
+	}
+	if strings.Contains(log, "\x1b[") {
+		t.Errorf("Log file contains color codes:\n%s", log)
+	}
+}
+
+func TestLogFileRotate(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	lt := termlog.NewLogTest()
+	f := &logFile{path: "rotate.log", maxSize: 100}
+	for i := 0; i < 5; i++ {
+		f.log(lt.Log, "%s", strings.Repeat("x", 30))
+	}
+	for _, p := range []string{"rotate.log", "rotate.log.1"} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > 100 {
+			t.Errorf("%s: expected at most 100 bytes, got %d", p, fi.Size())
+		}
+	}
+}
+
+func TestLogFileError(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		** {
+			log: ./nonexistent/dir/one.log
+			prep: echo ":one: ran"; echo ":one: again"
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:        lt.Log,
+		Config:     cnf,
+		quietUntil: make([]time.Time, len(cnf.Blocks)),
+	}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mr.runBlock(0, nil, dworld.DaemonPens[0], true)
+	if err != nil {
+		t.Fatalf("Expected the command to succeed, got: %s", err)
+	}
+	if n := strings.Count(lt.String(), "Error writing to log file"); n != 1 {
+		t.Errorf("Expected a single warning, got %d:\n%s", n, lt.String())
+	}
+	if !strings.Contains(lt.String(), ":one: again") {
+		t.Errorf("Expected command output, got:\n%s", lt.String())
+	}
+}
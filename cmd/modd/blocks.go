@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/cortesi/modd/conf"
+)
+
+// cliBlocks accumulates blocks specified with the --watch, --files-from,
+// --exclude and --exec flags. Flags are processed in command-line order:
+// --watch adds an include pattern to the current block, --files-from adds a
+// file listing paths to watch, --exclude adds an exclude pattern, and --exec
+// adds a prep command. A --watch or --files-from flag following an --exec flag
+// starts a new block.
+type cliBlocks struct {
+	blocks []conf.Block
+	// The --files-from files for each block, in parallel with blocks. They
+	// are read each time Config is called.
+	lists [][]string
+	// All --exec values, in order. Without --watch flags, --exec runs a
+	// command in the built-in shell.
+	execs []string
+	// Set if an --exec or --exclude flag appears before any --watch flag
+	orphaned string
+}
+
+func (c *cliBlocks) current() *conf.Block {
+	if len(c.blocks) == 0 {
+		return nil
+	}
+	return &c.blocks[len(c.blocks)-1]
+}
+
+// target returns the block that --watch and --files-from flags add to,
+// starting a new block if needed
+func (c *cliBlocks) target() *conf.Block {
+	b := c.current()
+	if b == nil || len(b.Preps) > 0 {
+		c.blocks = append(c.blocks, conf.Block{})
+		c.lists = append(c.lists, nil)
+		b = c.current()
+	}
+	return b
+}
+
+// checkPattern checks a pattern given with a command-line flag, so that a
+// malformed pattern is reported against the flag when the command line is
+// parsed, rather than silently never matching
+func checkPattern(flag string, pattern string) error {
+	if err := conf.ValidatePattern(conf.SlashPattern(pattern)); err != nil {
+		return fmt.Errorf("%s: invalid pattern %q: %s", flag, pattern, err)
+	}
+	return nil
+}
+
+func (c *cliBlocks) watch(pattern string) error {
+	if err := checkPattern("--watch", pattern); err != nil {
+		return err
+	}
+	b := c.target()
+	b.Include = append(b.Include, conf.SlashPattern(pattern))
+	return nil
+}
+
+func (c *cliBlocks) filesFrom(path string) error {
+	c.target()
+	i := len(c.lists) - 1
+	c.lists[i] = append(c.lists[i], path)
+	return nil
+}
+
+// listFiles returns all --files-from files
+func (c *cliBlocks) listFiles() []string {
+	var ret []string
+	for _, l := range c.lists {
+		ret = append(ret, l...)
+	}
+	return ret
+}
+
+func (c *cliBlocks) exclude(pattern string) error {
+	if err := checkPattern("--exclude", pattern); err != nil {
+		return err
+	}
+	b := c.current()
+	if b == nil {
+		c.orphaned = "--exclude"
+		return nil
+	}
+	b.Exclude = append(b.Exclude, conf.SlashPattern(pattern))
+	return nil
+}
+
+func (c *cliBlocks) exec(command string) error {
+	c.execs = append(c.execs, command)
+	b := c.current()
+	if b == nil {
+		c.orphaned = "--exec"
+		return nil
+	}
+	b.Preps = append(b.Preps, conf.Prep{Command: command})
+	return nil
+}
+
+// Config returns a config for the accumulated blocks, reading the current
+// contents of any --files-from files
+func (c *cliBlocks) Config() (*conf.Config, error) {
+	if c.orphaned != "" {
+		return nil, fmt.Errorf("%s must follow a --watch flag", c.orphaned)
+	}
+	blocks := make([]conf.Block, len(c.blocks))
+	for i, b := range c.blocks {
+		if len(b.Preps) == 0 {
+			if len(b.Include) > 0 {
+				return nil, fmt.Errorf("--watch %s has no --exec command", b.Include[0])
+			}
+			return nil, fmt.Errorf("--files-from %s has no --exec command", c.lists[i][0])
+		}
+		b.Include = append([]string{}, b.Include...)
+		for _, l := range c.lists[i] {
+			paths, err := conf.LoadFileList(l)
+			if err != nil {
+				return nil, err
+			}
+			b.Include = append(b.Include, paths...)
+		}
+		blocks[i] = b
+	}
+	return &conf.Config{Blocks: blocks}, nil
+}
+
+// cliFlag is a kingpin.Value that feeds a repeatable flag into cliBlocks
+type cliFlag struct {
+	set func(string) error
+}
+
+func (f cliFlag) Set(v string) error {
+	return f.set(v)
+}
+
+func (f cliFlag) String() string {
+	return ""
+}
+
+func (f cliFlag) IsCumulative() bool {
+	return true
+}
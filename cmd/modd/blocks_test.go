@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// parseBlocks parses args with the block flags wired up as main does
+func parseBlocks(args []string) (*cliBlocks, error) {
+	c := &cliBlocks{}
+	app := kingpin.New("modd", "")
+	app.Flag("watch", "").SetValue(cliFlag{c.watch})
+	app.Flag("files-from", "").SetValue(cliFlag{c.filesFrom})
+	app.Flag("exclude", "").SetValue(cliFlag{c.exclude})
+	app.Flag("exec", "").SetValue(cliFlag{c.exec})
+	_, err := app.Parse(args)
+	return c, err
+}
+
+func TestCLIBlocks(t *testing.T) {
+	c, err := parseBlocks([]string{
+		"--watch", "**/*.go", "--exclude", "vendor/**", "--exec", "go test",
+		"--watch", "*.md", "--exec", "echo docs", "--exec", "echo again",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cnf, err := c.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cnf.Blocks) != 2 {
+		t.Fatalf("expected 2 blocks, got %d", len(cnf.Blocks))
+	}
+	b := cnf.Blocks[0]
+	if !reflect.DeepEqual(b.Include, []string{"**/*.go"}) || !reflect.DeepEqual(b.Exclude, []string{"vendor/**"}) {
+		t.Errorf("unexpected patterns %v, %v", b.Include, b.Exclude)
+	}
+	if len(cnf.Blocks[1].Preps) != 2 {
+		t.Errorf("expected 2 preps, got %d", len(cnf.Blocks[1].Preps))
+	}
+
+	errs := map[string][]string{
+		"--exclude must follow a --watch flag": {"--exclude", "*.go", "--watch", "*.go", "--exec", "true"},
+		"has no --exec command":                {"--watch", "*.go"},
+	}
+	for msg, args := range errs {
+		c, err := parseBlocks(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Config(); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%v: expected error containing %q, got %v", args, msg, err)
+		}
+	}
+}
+
+func TestCLIBlocksBadPattern(t *testing.T) {
+	tests := map[string][]string{
+		"--watch":   {"--watch", "[a", "--exec", "true"},
+		"--exclude": {"--watch", "*.go", "--exclude", "src/[a", "--exec", "true"},
+	}
+	for flag, args := range tests {
+		_, err := parseBlocks(args)
+		if err == nil || !strings.Contains(err.Error(), flag) || !strings.Contains(err.Error(), "invalid pattern") {
+			t.Errorf("%v: expected an invalid pattern error naming %s, got %v", args, flag, err)
+		}
+	}
+}
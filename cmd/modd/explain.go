@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cortesi/modd"
+	"github.com/cortesi/termlog"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var explainApp = kingpin.New(
+	"modd explain",
+	"Explain which blocks of the modfile changes to a path trigger.",
+)
+
+var explainFile = explainApp.Flag(
+	"file",
+	fmt.Sprintf("Path to modfile (%s)", modfile),
+).
+	PlaceHolder("PATH").
+	Short('f').
+	Default(modfile).
+	String()
+
+var explainEnv = explainApp.Flag("env", "Use the blocks in the [ENV] section of the modfile, along with the shared ones").
+	PlaceHolder("ENV").
+	String()
+
+var explainPath = explainApp.Arg("path", "Path to explain, which doesn't have to exist").
+	Required().
+	String()
+
+// runExplain runs the explain command with the given arguments
+func runExplain(args []string) {
+	explainApp.HelpFlag.Short('h')
+	_, err := explainApp.Parse(args)
+	explainApp.FatalIfError(err, "")
+	if err := explainPaths(os.Stdout, *explainFile, *explainEnv, *explainPath); err != nil {
+		explainApp.Fatalf("%s", err)
+	}
+}
+
+// explainPaths reads the modfile at path file, using the section for env, and
+// writes an explanation of how each of its blocks matches p to w
+func explainPaths(w io.Writer, file string, env string, p string) error {
+	mr, err := modd.NewModRunnerEnv(file, env, termlog.NewLog(), nil, false)
+	if err != nil {
+		return err
+	}
+	explanations, err := modd.Explain(mr.Config, p)
+	if err != nil {
+		return err
+	}
+	for _, e := range explanations {
+		fmt.Fprintln(w, e)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/cortesi/modd/utils"
+)
+
+func TestExplainPaths(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	err := ioutil.WriteFile("modd.conf", []byte(`
+		**/*.go !**/*_test.go {
+			prep: go build
+		}
+		[docs]
+		*.md {
+			prep: echo docs
+		}
+	`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		env      string
+		path     string
+		expected string
+	}{
+		{"", "main.go", "block 1: match - included by **/*.go\n"},
+		{"", "main_test.go", "block 1: no match - included by **/*.go, but removed by exclude **/*_test.go\n"},
+		{"docs", "README.md", "block 1: no match - no include pattern matches\nblock 2: match - included by *.md\n"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if err := explainPaths(&out, "modd.conf", tt.env, tt.path); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != tt.expected {
+			t.Errorf("%s: expected\n%s\ngot\n%s", tt.path, tt.expected, out.String())
+		}
+	}
+
+	if err := explainPaths(&bytes.Buffer{}, "missing.conf", "", "main.go"); err == nil {
+		t.Error("Expected an error for a missing modfile")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cortesi/modd"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var filterApp = kingpin.New(
+	"modd filter",
+	"Read paths from stdin, one per line, and print those that match the patterns.",
+)
+
+var filterInclude = &patternsFlag{flag: "--include"}
+
+var filterExclude = &patternsFlag{flag: "--exclude"}
+
+func init() {
+	filterApp.Flag("include", "Print paths matching PATTERN, or all paths if omitted (repeatable)").
+		PlaceHolder("PATTERN").
+		SetValue(filterInclude)
+	filterApp.Flag("exclude", "Leave out paths matching PATTERN (repeatable)").
+		PlaceHolder("PATTERN").
+		SetValue(filterExclude)
+}
+
+// runFilter runs the filter command with the given arguments
+func runFilter(args []string) {
+	filterApp.HelpFlag.Short('h')
+	_, err := filterApp.Parse(args)
+	filterApp.FatalIfError(err, "")
+	if err := filterPaths(os.Stdin, os.Stdout, filterInclude.patterns, filterExclude.patterns); err != nil {
+		filterApp.Fatalf("%s", err)
+	}
+}
+
+// filterPaths reads newline-delimited paths from r, and writes those that
+// match includes and don't match excludes to w, in the order they were read.
+// If there are no includes, all paths are included.
+func filterPaths(r io.Reader, w io.Writer, includes []string, excludes []string) error {
+	if len(includes) == 0 {
+		includes = []string{"**"}
+	}
+	paths := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if p := strings.TrimSuffix(scanner.Text(), "\r"); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	matched, err := modd.FilterFiles(paths, includes, excludes)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	for _, p := range matched.Files {
+		fmt.Fprintln(bw, p)
+	}
+	return bw.Flush()
+}
+
+// patternsFlag is a repeatable kingpin.Value that collects patterns,
+// checking each one as it is given
+type patternsFlag struct {
+	flag     string
+	patterns []string
+}
+
+func (f *patternsFlag) Set(v string) error {
+	if err := checkPattern(f.flag, v); err != nil {
+		return err
+	}
+	f.patterns = append(f.patterns, v)
+	return nil
+}
+
+func (f *patternsFlag) String() string {
+	return ""
+}
+
+func (f *patternsFlag) IsCumulative() bool {
+	return true
+}
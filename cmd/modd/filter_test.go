@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+func TestFilterPaths(t *testing.T) {
+	input := "src/b.go\r\na.go\n\nvendor/c.go\ndocs/d.md\n"
+	tests := []struct {
+		includes []string
+		excludes []string
+		expected string
+	}{
+		{nil, nil, "src/b.go\na.go\nvendor/c.go\ndocs/d.md\n"},
+		{[]string{"**/*.go"}, []string{"vendor/**"}, "src/b.go\na.go\n"},
+		{[]string{"*.md"}, nil, ""},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if err := filterPaths(strings.NewReader(input), &out, tt.includes, tt.excludes); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != tt.expected {
+			t.Errorf("%v, %v: expected %q, got %q", tt.includes, tt.excludes, tt.expected, out.String())
+		}
+	}
+}
+
+func TestPatternsFlag(t *testing.T) {
+	inc := &patternsFlag{flag: "--include"}
+	exc := &patternsFlag{flag: "--exclude"}
+	app := kingpin.New("modd filter", "")
+	app.Flag("include", "").SetValue(inc)
+	app.Flag("exclude", "").SetValue(exc)
+
+	if _, err := app.Parse([]string{"--include", "*.go", "--include", "src/**", "--exclude", "vendor/**"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(inc.patterns) != 2 || len(exc.patterns) != 1 {
+		t.Errorf("unexpected patterns %v, %v", inc.patterns, exc.patterns)
+	}
+
+	_, err := app.Parse([]string{"--exclude", "[a"})
+	if err == nil || !strings.Contains(err.Error(), "--exclude") || !strings.Contains(err.Error(), "invalid pattern") {
+		t.Errorf("expected an invalid pattern error naming --exclude, got %v", err)
+	}
+}
@@ -7,7 +7,9 @@ import (
 	"strings"
 
 	"github.com/cortesi/modd"
+	"github.com/cortesi/modd/conf"
 	"github.com/cortesi/modd/notify"
+	"github.com/cortesi/modd/shell"
 	"github.com/cortesi/termlog"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"mvdan.cc/sh/v3/interp"
@@ -20,11 +22,14 @@ var file = kingpin.Flag(
 	"file",
 	fmt.Sprintf("Path to modfile (%s)", modfile),
 ).
-	Default(modfile).
 	PlaceHolder("PATH").
 	Short('f').
 	String()
 
+var env = kingpin.Flag("env", "Use the blocks in the [ENV] section of the modfile, along with the shared ones").
+	PlaceHolder("ENV").
+	String()
+
 var noconf = kingpin.Flag("noconf", "Don't watch our own config file").
 	Short('c').
 	Bool()
@@ -33,6 +38,9 @@ var beep = kingpin.Flag("bell", "Ring terminal bell if any command returns an er
 	Short('b').
 	Bool()
 
+var collapse = kingpin.Flag("collapse", "Collapse repeated identical command failures").
+	Bool()
+
 var ignores = kingpin.Flag("ignores", "List default ignore patterns and exit").
 	Short('i').
 	Bool()
@@ -41,25 +49,144 @@ var doNotify = kingpin.Flag("notify", "Send stderr to system notification if com
 	Short('n').
 	Bool()
 
+var notifyStderr = kingpin.Flag("notify-stderr", "Write the output of failed commands to stderr").
+	Bool()
+
 var prep = kingpin.Flag("prep", "Run prep commands and exit").
 	Short('p').
 	Bool()
 
+var exitStatus = kingpin.Flag("exit-status", "With --prep, run every block and exit with status 1 if any prep failed").
+	Bool()
+
+var parallel = kingpin.Flag("parallel", "Run blocks triggered by the same change concurrently").
+	Bool()
+
+var maxConcurrent = kingpin.Flag("max-concurrent", "With --parallel, run at most N blocks at once (0 for no limit)").
+	PlaceHolder("N").
+	Default("0").
+	Int()
+
+var noShell = kingpin.Flag("no-shell", "Run commands directly, without interpreting them with a shell").
+	Bool()
+
+var listBlocks = kingpin.Flag("list-blocks", "Print a summary of each block in the config, and exit").
+	Bool()
+
+var profileFilter = kingpin.Flag("profile-filter", "Time the file search for each block, slowest first, and exit").
+	Bool()
+
+// The number of times each block's file search is run by --profile-filter
+const profileRuns = 5
+
+var configTest = kingpin.Flag("config-test", "Check the modfile for problems and exit").
+	Bool()
+
 var debug = kingpin.Flag("debug", "Debugging for modd development").
 	Default("false").
 	Bool()
 
-var exec = kingpin.Flag("exec", "Execute a command in the built-in shell").
+var cli = &cliBlocks{}
+
+func init() {
+	kingpin.Flag("watch", "Watch a pattern instead of using a modfile (repeatable)").
+		PlaceHolder("PATTERN").
+		SetValue(cliFlag{cli.watch})
+	kingpin.Flag("files-from", "Watch the paths listed in FILE, one per line, and re-read it when it changes (repeatable)").
+		PlaceHolder("FILE").
+		SetValue(cliFlag{cli.filesFrom})
+	kingpin.Flag("exclude", "Exclude a pattern from the preceding --watch (repeatable)").
+		PlaceHolder("PATTERN").
+		SetValue(cliFlag{cli.exclude})
+	kingpin.Flag("exec", "Command to run on changes to the preceding --watch, or without --watch, execute a command in the built-in shell").
+		PlaceHolder("COMMAND").
+		SetValue(cliFlag{cli.exec})
+}
+
+var outputLimit = kingpin.Flag("output-limit", "Display at most N lines of output from each prep command").
+	PlaceHolder("N").
+	Default("0").
+	Int()
+
+var shutdownTimeout = kingpin.Flag("shutdown-timeout", "Kill shutdown commands that run for longer than DURATION").
+	PlaceHolder("DURATION").
+	Default(modd.DefaultShutdownTimeout.String()).
+	Duration()
+
+var grace = kingpin.Flag("grace", "Ignore changes for DURATION after starting to watch").
+	PlaceHolder("DURATION").
+	Default("0s").
+	Duration()
+
+var maxRuntime = kingpin.Flag("max-runtime", "Shut down after running for DURATION").
+	PlaceHolder("DURATION").
+	Default("0s").
+	Duration()
+
+var triggerFile = kingpin.Flag("trigger-file", "Create and watch FILE, and run all blocks when it changes").
+	PlaceHolder("FILE").
+	String()
+
+var listen = kingpin.Flag("listen", "Listen for HTTP trigger requests on ADDR (localhost unless a host is given)").
+	PlaceHolder("ADDR").
 	String()
 
+// blockPatterns formats a block's patterns as they are after expansion, leaving
+// out the default ignore list.
+func blockPatterns(b conf.Block) string {
+	patterns := append([]string{}, b.Include...)
+	for _, e := range b.UserExcludes(modd.CommonExcludes) {
+		patterns = append(patterns, "!"+e)
+	}
+	return strings.Join(patterns, " ")
+}
+
+// enabledNotifiers returns the notifiers enabled by the --notify, --bell and
+// --notify-stderr flags
+func enabledNotifiers(desktop, bell, stderr bool, log termlog.Logger) []notify.Notifier {
+	ret := []notify.Notifier{}
+	if desktop {
+		n := notify.PlatformNotifier()
+		if n == nil {
+			log.Shout("Could not find a desktop notifier")
+		} else {
+			ret = append(ret, n)
+		}
+	}
+	if bell {
+		ret = append(ret, &notify.BeepNotifier{})
+	}
+	if stderr {
+		ret = append(ret, notify.StderrNotifier{})
+	}
+	return ret
+}
+
 func main() {
 	kingpin.CommandLine.HelpFlag.Short('h')
 	kingpin.Version(modd.Version)
+	// The filter, trigger and explain commands are parsed separately, since
+	// filter and explain have flags of their own that clash with ours
+	if len(os.Args) > 1 && os.Args[1] == "filter" {
+		runFilter(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "trigger" {
+		runTrigger(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "explain" {
+		runExplain(os.Args[2:])
+		return
+	}
 	kingpin.Parse()
 
-	if *exec != "" {
+	if len(cli.blocks) == 0 && len(cli.execs) > 0 {
+		if len(cli.execs) > 1 {
+			kingpin.Fatalf("only one --exec flag is permitted without --watch")
+		}
 		parser := syntax.NewParser()
-		prog, err := parser.Parse(strings.NewReader(*exec), "")
+		prog, err := parser.Parse(strings.NewReader(cli.execs[0]), "")
 		if err != nil {
 			os.Exit(1)
 		}
@@ -96,32 +223,122 @@ func main() {
 		log.Enable("debug")
 	}
 
-	notifiers := []notify.Notifier{}
-	if *doNotify {
-		n := notify.PlatformNotifier()
-		if n == nil {
-			log.Shout("Could not find a desktop notifier")
-		} else {
-			notifiers = append(notifiers, n)
+	notifiers := enabledNotifiers(*doNotify, *beep, *notifyStderr, log)
+
+	if *noShell {
+		shell.Default = "exec"
+	}
+
+	var mr *modd.ModRunner
+	if len(cli.blocks) > 0 {
+		if *file != "" {
+			kingpin.Fatalf("--watch and --files-from can't be used with a modfile")
+		}
+		if *env != "" {
+			kingpin.Fatalf("--env can't be used with --watch or --files-from")
+		}
+		cnf, err := cli.Config()
+		if err != nil {
+			kingpin.Fatalf("%s", err)
+		}
+		mr, err = modd.NewModRunnerFromConfig(cnf, log, notifiers)
+		if err != nil {
+			log.Shout("%s", err)
+			if *configTest || *exitStatus {
+				os.Exit(1)
+			}
+			return
+		}
+		if paths := cli.listFiles(); len(paths) > 0 {
+			mr.Rebuild = cli.Config
+			mr.RebuildPaths = paths
+		}
+	} else {
+		if *file == "" {
+			*file = modfile
+		}
+		var err error
+		mr, err = modd.NewModRunnerEnv(*file, *env, log, notifiers, !(*noconf))
+		if err != nil {
+			log.Shout("%s", err)
+			if *configTest || *exitStatus {
+				os.Exit(1)
+			}
+			return
 		}
 	}
-	if *beep {
-		notifiers = append(notifiers, &notify.BeepNotifier{})
+	if *noShell {
+		if sh := mr.Config.GetVariables()["@shell"]; sh != "" && sh != "exec" {
+			kingpin.Fatalf("--no-shell can't be used with @shell = %s", sh)
+		}
+		if errs := modd.CheckCommands(mr.Config); len(errs) > 0 && !*configTest {
+			for _, err := range errs {
+				log.Shout("%s", err)
+			}
+			os.Exit(1)
+		}
 	}
-
-	mr, err := modd.NewModRunner(*file, log, notifiers, !(*noconf))
-	if err != nil {
-		log.Shout("%s", err)
+	if *listBlocks {
+		for _, s := range modd.Summarize(mr.Config) {
+			fmt.Println(s)
+		}
+		return
+	}
+	if *profileFilter {
+		profiles, err := modd.ProfileFilter(mr.Config, ".", profileRuns)
+		if err != nil {
+			kingpin.Fatalf("%s", err)
+		}
+		for _, p := range profiles {
+			fmt.Println(p)
+		}
+		return
+	}
+	if *configTest {
+		source := *file
+		if source == "" {
+			source = "command line"
+		}
+		errs := modd.CheckConfig(mr.Config)
+		for _, err := range errs {
+			log.Shout("%s: %s", source, err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		for i, b := range mr.Config.Blocks {
+			log.Say("%s: block %d: %s", source, i+1, blockPatterns(b))
+		}
+		log.Notice("%s: ok", source)
 		return
 	}
+	mr.ListenAddr = *listen
+	mr.TriggerFile = *triggerFile
+	mr.Grace = *grace
+	mr.MaxRuntime = *maxRuntime
+	mr.ShutdownTimeout = *shutdownTimeout
+	mr.OutputLimit = *outputLimit
+	mr.Parallel = *parallel
+	mr.MaxConcurrent = *maxConcurrent
+	if *collapse {
+		mr.Collapse = modd.NewCollapser()
+	}
 
-	if *prep {
+	if *exitStatus {
+		if !*prep {
+			kingpin.Fatalf("--exit-status requires --prep")
+		}
+		if err := mr.PrepAll(true); err != nil {
+			log.Shout("%s", err)
+			os.Exit(1)
+		}
+	} else if *prep {
 		err := mr.PrepOnly(true)
 		if err != nil {
 			log.Shout("%s", err)
 		}
 	} else {
-		err = mr.Run()
+		err := mr.Run()
 		if err != nil {
 			log.Shout("%s", err)
 		}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cortesi/modd/notify"
+	"github.com/cortesi/termlog"
+)
+
+func TestEnabledNotifiers(t *testing.T) {
+	lt := termlog.NewLogTest()
+	if ret := enabledNotifiers(false, false, false, lt.Log); len(ret) != 0 {
+		t.Errorf("Expected no notifiers, got %#v", ret)
+	}
+	expected := []notify.Notifier{notify.StderrNotifier{}}
+	if ret := enabledNotifiers(false, false, true, lt.Log); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, ret)
+	}
+	expected = []notify.Notifier{&notify.BeepNotifier{}, notify.StderrNotifier{}}
+	if ret := enabledNotifiers(false, true, true, lt.Log); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, ret)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"github.com/cortesi/modd"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var triggerApp = kingpin.New(
+	"modd trigger",
+	"Touch a trigger file, running all blocks of a modd started with --trigger-file.",
+)
+
+var triggerPath = triggerApp.Arg("file", "Path to the trigger file").
+	Required().
+	String()
+
+// runTrigger runs the trigger command with the given arguments
+func runTrigger(args []string) {
+	triggerApp.HelpFlag.Short('h')
+	_, err := triggerApp.Parse(args)
+	triggerApp.FatalIfError(err, "")
+	if err := modd.TouchTrigger(*triggerPath); err != nil {
+		triggerApp.Fatalf("%s", err)
+	}
+}
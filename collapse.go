@@ -0,0 +1,206 @@
+package modd
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/cortesi/termlog"
+)
+
+// A single call to a log method
+type logEntry struct {
+	method string
+	name   string
+	format string
+	args   []interface{}
+}
+
+// key identifies the output of an entry, for comparing runs
+func (e logEntry) key() string {
+	return fmt.Sprintf("%s %s %s", e.method, e.name, fmt.Sprintf(e.format, e.args...))
+}
+
+// collapsingStream is a termlog.Stream that passes output through as it
+// arrives, except while the output repeats, entry for entry, the output of
+// the command's previous failure. Those entries are held back until the
+// output diverges from the previous failure, or the run finishes, so that an
+// identical failure can be collapsed without having shown any of it.
+type collapsingStream struct {
+	stream termlog.Stream
+	// Set if the command failed on its previous run
+	failed bool
+	// Keys of the previous failure's output
+	prev []string
+	// Keys of this run's output
+	keys []string
+	// Entries held back while they match prev
+	held []logEntry
+	// Set once the output has diverged from prev
+	live bool
+	sync.Mutex
+}
+
+func (c *collapsingStream) add(method string, name string, format string, args []interface{}) {
+	c.Lock()
+	defer c.Unlock()
+	e := logEntry{method, name, format, args}
+	if e.method != "header" {
+		c.keys = append(c.keys, e.key())
+	}
+	if !c.live {
+		n := len(c.keys)
+		if e.method == "header" || (n <= len(c.prev) && c.prev[n-1] == c.keys[n-1]) {
+			c.held = append(c.held, e)
+			return
+		}
+		c.live = true
+		c.release()
+	}
+	c.write(e)
+}
+
+// write sends a single entry to the underlying stream
+func (c *collapsingStream) write(e logEntry) {
+	switch e.method {
+	case "header":
+		c.stream.Header()
+	case "say":
+		c.stream.SayAs(e.name, e.format, e.args...)
+	case "notice":
+		c.stream.NoticeAs(e.name, e.format, e.args...)
+	case "warn":
+		c.stream.WarnAs(e.name, e.format, e.args...)
+	case "shout":
+		c.stream.ShoutAs(e.name, e.format, e.args...)
+	}
+}
+
+// release writes all held entries to the underlying stream. The lock must be
+// held.
+func (c *collapsingStream) release() {
+	for _, e := range c.held {
+		c.write(e)
+	}
+	c.held = nil
+}
+
+// flush writes any held entries to the underlying stream
+func (c *collapsingStream) flush() {
+	c.Lock()
+	defer c.Unlock()
+	c.release()
+}
+
+// repeated checks whether the output so far is identical to the previous
+// failure's
+func (c *collapsingStream) repeated() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.failed && !c.live && len(c.keys) == len(c.prev)
+}
+
+func (c *collapsingStream) Say(format string, args ...interface{}) {
+	c.add("say", "", format, args)
+}
+
+func (c *collapsingStream) Notice(format string, args ...interface{}) {
+	c.add("notice", "", format, args)
+}
+
+func (c *collapsingStream) Warn(format string, args ...interface{}) {
+	c.add("warn", "", format, args)
+}
+
+func (c *collapsingStream) Shout(format string, args ...interface{}) {
+	c.add("shout", "", format, args)
+}
+
+func (c *collapsingStream) SayAs(name string, format string, args ...interface{}) {
+	c.add("say", name, format, args)
+}
+
+func (c *collapsingStream) NoticeAs(name string, format string, args ...interface{}) {
+	c.add("notice", name, format, args)
+}
+
+func (c *collapsingStream) WarnAs(name string, format string, args ...interface{}) {
+	c.add("warn", name, format, args)
+}
+
+func (c *collapsingStream) ShoutAs(name string, format string, args ...interface{}) {
+	c.add("shout", name, format, args)
+}
+
+func (c *collapsingStream) Header() {
+	c.add("header", "", "", nil)
+}
+
+func (c *collapsingStream) Quiet() {
+	c.stream.Quiet()
+}
+
+type failure struct {
+	keys  []string
+	count int
+}
+
+// Collapser tracks command failures, and collapses consecutive identical
+// failures of the same command into a single line of output.
+type Collapser struct {
+	failures map[string]*failure
+	sync.Mutex
+}
+
+// NewCollapser creates a new Collapser
+func NewCollapser() *Collapser {
+	return &Collapser{failures: map[string]*failure{}}
+}
+
+// run runs a command, streaming its output as it arrives, except for output
+// that repeats the command's previous failure. If the command fails in
+// exactly the same way again, that output is replaced with a note; otherwise
+// it is shown once the run diverges or finishes.
+func (c *Collapser) run(command string, log termlog.Stream, f func(termlog.Stream) error) error {
+	c.Lock()
+	cs := &collapsingStream{stream: log}
+	if last, ok := c.failures[command]; ok {
+		cs.failed, cs.prev = true, last.keys
+	}
+	c.Unlock()
+
+	err := f(cs)
+
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := err.(ProcError); !ok {
+		delete(c.failures, command)
+		cs.flush()
+		return err
+	}
+	if last, ok := c.failures[command]; ok && cs.repeated() {
+		last.count++
+		log.Header()
+		log.Shout("(same error, %s time)", ordinal(last.count))
+		return err
+	}
+	c.failures[command] = &failure{keys: cs.keys, count: 1}
+	cs.flush()
+	return err
+}
+
+// ordinal formats a number as an English ordinal, e.g. 2nd, 11th, 23rd.
+func ordinal(n int) string {
+	suffix := "th"
+	switch n % 10 {
+	case 1:
+		suffix = "st"
+	case 2:
+		suffix = "nd"
+	case 3:
+		suffix = "rd"
+	}
+	if n%100 >= 11 && n%100 <= 13 {
+		suffix = "th"
+	}
+	return fmt.Sprintf("%d%s", n, suffix)
+}
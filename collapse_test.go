@@ -0,0 +1,144 @@
+package modd
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/utils"
+	"github.com/cortesi/termlog"
+)
+
+func TestOrdinal(t *testing.T) {
+	tests := map[int]string{
+		1: "1st", 2: "2nd", 3: "3rd", 4: "4th", 11: "11th", 12: "12th",
+		13: "13th", 21: "21st", 22: "22nd", 101: "101st", 111: "111th",
+	}
+	for n, expected := range tests {
+		if got := ordinal(n); got != expected {
+			t.Errorf("%d: expected %q, got %q", n, expected, got)
+		}
+	}
+}
+
+func TestCollapse(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		{
+			prep: echo fail$(echo ure) $(cat msg 2>/dev/null) >&2 && false
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := cnf.Blocks[0]
+	vars := cnf.GetVariables()
+	c := NewCollapser()
+
+	run := func() string {
+		lt := termlog.NewLogTest()
+		err := RunPrepsWith(b, vars, nil, lt.Log, nil, false, PrepOptions{Collapse: c})
+		if _, ok := err.(ProcError); !ok {
+			t.Fatalf("Expected a ProcError, got %v", err)
+		}
+		return lt.String()
+	}
+
+	if out := run(); !strings.Contains(out, "failure") {
+		t.Errorf("Expected full output on first failure:\n%s", out)
+	}
+	for _, n := range []string{"2nd", "3rd"} {
+		out := run()
+		if strings.Contains(out, "failure") {
+			t.Errorf("Expected output to be collapsed:\n%s", out)
+		}
+		if !strings.Contains(out, "(same error, "+n+" time)") {
+			t.Errorf("Expected collapsed notice for %s time:\n%s", n, out)
+		}
+	}
+
+	// A change in output is shown in full
+	if err := ioutil.WriteFile("msg", []byte("changed"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if out := run(); !strings.Contains(out, "failure changed") {
+		t.Errorf("Expected full output after output changed:\n%s", out)
+	}
+	if out := run(); !strings.Contains(out, "(same error, 2nd time)") {
+		t.Errorf("Expected count to restart after output changed:\n%s", out)
+	}
+
+	// Without a collapser, output is always shown
+	lt := termlog.NewLogTest()
+	RunPreps(b, vars, nil, lt.Log, nil, false)
+	if !strings.Contains(lt.String(), "failure") {
+		t.Errorf("Expected full output without collapsing:\n%s", lt.String())
+	}
+}
+
+func TestCollapseStreams(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		{
+			prep: echo ":started"; while [ ! -e go ]; do sleep 0.01; done; echo ":finished" $(cat go); false
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := cnf.Blocks[0]
+	vars := cnf.GetVariables()
+	c := NewCollapser()
+
+	run := func(finish string, live []string) []string {
+		t.Helper()
+		os.Remove("go")
+		lt := termlog.NewLogTest()
+		done := make(chan error, 1)
+		go func() {
+			done <- RunPrepsWith(b, vars, nil, lt.Log, nil, false, PrepOptions{Collapse: c})
+		}()
+		if live != nil {
+			waitEvents(t, lt, live)
+		} else {
+			time.Sleep(200 * time.Millisecond)
+			if ret := events(lt.String()); len(ret) != 0 {
+				t.Errorf("Expected repeated output to be held back, got %#v", ret)
+			}
+		}
+		// The file is renamed into place, so the prep never reads it empty
+		if err := ioutil.WriteFile("go.tmp", []byte(finish), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename("go.tmp", "go"); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; err == nil {
+			t.Fatal("Expected the prep to fail")
+		}
+		return events(lt.String())
+	}
+
+	// Output that doesn't repeat the previous failure is shown as it arrives
+	expected := []string{":started", ":finished one"}
+	if ret := run("one", []string{":started"}); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+	// Output repeating the previous failure is held back until it diverges
+	expected = []string{":started", ":finished two"}
+	if ret := run("two", nil); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+	// An identical failure is collapsed without showing any of its output
+	if ret := run("two", nil); len(ret) != 0 {
+		t.Errorf("Expected the failure to be collapsed, got %#v", ret)
+	}
+}
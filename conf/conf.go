@@ -3,19 +3,272 @@ package conf
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
 	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// DefaultStopWait is how long we wait for a daemon to exit after each stop
+// signal, if no explicit wait is specified.
+const DefaultStopWait = 2 * time.Second
+
+// A StopStep is a signal sent to a daemon to stop it, and the amount of time to
+// wait for the daemon to exit before moving on to the next step.
+type StopStep struct {
+	Signal os.Signal
+	Wait   time.Duration
+}
+
 // A Daemon is a persistent process that is kept running
 type Daemon struct {
 	Command       string
 	RestartSignal os.Signal
+
+	// The sequence of signals used to stop the daemon. If this is nil, the
+	// default sequence is used.
+	StopSequence []StopStep
+}
+
+// splitOption splits a +name=value option into its name and value.
+func splitOption(option string) (string, string) {
+	if i := strings.Index(option, "="); i >= 0 {
+		return option[:i], option[i+1:]
+	}
+	return option, ""
+}
+
+// parseStopSequence parses a comma-separated list of signals, each optionally
+// followed by a wait duration, e.g. "sigterm,5s,sigint,2s,sigkill".
+func parseStopSequence(spec string) ([]StopStep, error) {
+	steps := []StopStep{}
+	// Is the next item allowed to be a wait duration?
+	canWait := false
+	for _, v := range strings.Split(spec, ",") {
+		if sig, ok := daemonSignals[v]; ok {
+			steps = append(steps, StopStep{sig, DefaultStopWait})
+			canWait = true
+			continue
+		}
+		wait, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stop sequence: unknown signal %q", v)
+		}
+		if !canWait {
+			return nil, fmt.Errorf("invalid stop sequence: wait %q must follow a signal", v)
+		}
+		steps[len(steps)-1].Wait = wait
+		canWait = false
+	}
+	return steps, nil
+}
+
+func (b *Block) addDaemon(command string, options []string) error {
+	if b.Daemons == nil {
+		b.Daemons = []Daemon{}
+	}
+	d := Daemon{
+		Command:       command,
+		RestartSignal: syscall.SIGHUP,
+	}
+	for _, v := range options {
+		name, value := splitOption(v)
+		if name == "+stop" {
+			steps, err := parseStopSequence(value)
+			if err != nil {
+				return err
+			}
+			d.StopSequence = steps
+		} else if sig, ok := daemonSignals[strings.TrimPrefix(v, "+")]; ok {
+			d.RestartSignal = sig
+		} else {
+			return fmt.Errorf("unknown option: %s", v)
+		}
+	}
+	b.Daemons = append(b.Daemons, d)
+	return nil
+}
+
+// File event types that can trigger a block
+const (
+	EventAdded   = "added"
+	EventChanged = "changed"
+	EventDeleted = "deleted"
+)
+
+// EventPatterns returns the include and exclude patterns of a block that
+// apply to events of the given type
+func (b *Block) EventPatterns(event string) ([]string, []string) {
+	scoped := func(patterns []string, scopes map[string][]string) []string {
+		ret := []string{}
+		for _, p := range patterns {
+			events, ok := scopes[p]
+			if !ok {
+				ret = append(ret, p)
+				continue
+			}
+			for _, e := range events {
+				if e == event {
+					ret = append(ret, p)
+					break
+				}
+			}
+		}
+		return ret
+	}
+	return scoped(b.Include, b.IncludeEvents), scoped(b.Exclude, b.ExcludeEvents)
+}
+
+// Rewrite returns a copy of the block with each of its include and exclude
+// patterns replaced by f(pattern). Event scopes follow their patterns.
+func (b Block) Rewrite(f func(string) string) Block {
+	rewrite := func(patterns []string, scopes map[string][]string) ([]string, map[string][]string) {
+		ret := make([]string, len(patterns))
+		var retScopes map[string][]string
+		for i, p := range patterns {
+			ret[i] = f(p)
+			if events, ok := scopes[p]; ok {
+				if retScopes == nil {
+					retScopes = map[string][]string{}
+				}
+				retScopes[ret[i]] = events
+			}
+		}
+		return ret, retScopes
+	}
+	b.Include, b.IncludeEvents = rewrite(b.Include, b.IncludeEvents)
+	b.Exclude, b.ExcludeEvents = rewrite(b.Exclude, b.ExcludeEvents)
+	return b
+}
+
+// WatchedIncludes returns the block's include patterns, leaving out those
+// whose base paths are entirely excluded, as checked by FullyExcluded. Nothing
+// under such a base path can trigger the block, so it needn't be watched.
+// Excludes scoped to particular events only exclude some changes, so they are
+// not considered.
+func (b Block) WatchedIncludes() []string {
+	excludes := []string{}
+	for _, e := range b.Exclude {
+		if _, scoped := b.ExcludeEvents[e]; !scoped {
+			excludes = append(excludes, e)
+		}
+	}
+	ret := []string{}
+	for _, p := range b.Include {
+		if !FullyExcluded(BasePath(p), excludes) {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// UserExcludes returns the block's exclude patterns without the common
+// exclusion set added by Config.CommonExcludes. The common set is only removed
+// if the excludes really end with it, so a block that never had it added is
+// returned as it is.
+func (b Block) UserExcludes(common []string) []string {
+	n := len(b.Exclude) - len(common)
+	if b.NoCommonFilter || n < 0 || !reflect.DeepEqual(b.Exclude[n:], common) {
+		return b.Exclude
+	}
+	return b.Exclude[:n]
+}
+
+// CaseFolded returns a copy of the block with its include and exclude patterns
+// rewritten by FoldCase to match without regard to case
+func (b Block) CaseFolded() Block {
+	return b.Rewrite(FoldCase)
 }
 
 // A Prep runs and terminates
 type Prep struct {
 	Command  string
 	Onchange bool // Should prep skip initial run
+
+	// If not empty, the list of changed files is written to the command's
+	// stdin, with each path followed by this delimiter.
+	Stdin string
+
+	// If not empty, the list of changed files is passed to the command in
+	// the MODD_CHANGED environment variable, in this format: "newline",
+	// "space" or "quoted".
+	Changed string
+
+	// If not empty, the prep only runs when changed files match one of these
+	// patterns, and only the matching files are passed to it. Such preps run
+	// before all other preps in the block, and skip the initial run.
+	Match []string
+
+	// If not empty, each line of the command's output is prefixed with this
+	// label
+	Prefix string
+
+	// If set, @mods, @dirmods and stdin list all files currently matching
+	// the block's patterns, rather than only the changed files
+	All bool
+
+	// The number of times the command is run again if it fails, and how long
+	// to wait before each retry
+	Retry      int
+	RetryDelay time.Duration
+
+	// Commands to run after the prep succeeds or fails
+	OnSuccess *FollowUp
+	OnFailure *FollowUp
+}
+
+// A FollowUp is a command that runs after a prep, depending on its exit status
+type FollowUp struct {
+	Command string
+	// If set, a failure of an onsuccess command doesn't abort the rest of the
+	// block. A failed prep always aborts the block, so this can't be set for
+	// onfailure commands.
+	NoFail bool
+}
+
+// The longest a block with a quiesce period holds changes, unless +max is
+// given
+const DefaultQuiesceMax = time.Minute
+
+// Size suffixes for the +maxsize log option
+var sizeSuffixes = map[string]int64{
+	"":  1,
+	"k": 1 << 10,
+	"m": 1 << 20,
+	"g": 1 << 30,
+}
+
+// parseSize parses a size in bytes, with an optional K, M or G suffix
+func parseSize(s string) (int64, error) {
+	i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		i = len(s)
+	}
+	mult, ok := sizeSuffixes[strings.ToLower(s[i:])]
+	if i == 0 || !ok {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return n * mult, nil
+}
+
+// Delimiters for the +stdin prep option
+var stdinDelimiters = map[string]string{
+	"newline": "\n",
+	"nul":     "\x00",
+}
+
+// Formats for the MODD_CHANGED variable set by the +changed prep option
+var changedFormats = map[string]bool{
+	"newline": true,
+	"space":   true,
+	"quoted":  true,
 }
 
 // Block is a match pattern and a set of specifications
@@ -25,8 +278,65 @@ type Block struct {
 	NoCommonFilter bool
 	InDir          string
 
+	// If set, paths that pass through symlinks are also excluded if their
+	// real paths match an exclude pattern, as checked by RealExcluded
+	RealPathExcludes bool
+
+	// If set, the single-star directory levels of the include patterns are
+	// expanded into the existing directories when watching, as done by
+	// ExpandDirs
+	ExpandDirs bool
+
+	// If set, the block's commands run as this user, given as user or
+	// user:group, where each is a name or a numeric id
+	User string
+
+	// The event types that patterns are scoped to, by pattern. Patterns in
+	// Include and Exclude without an entry apply to all events.
+	IncludeEvents map[string][]string
+	ExcludeEvents map[string][]string
+
+	// Changes are ignored for this long after the block runs successfully
+	Cooldown time.Duration
+
+	// Changes are ignored for this long after the block starts, so that it
+	// doesn't react to files touched by tools starting up
+	Grace time.Duration
+
+	// If set, changes are held until none have arrived for this long, and
+	// then run the block once
+	Settle time.Duration
+
+	// If set, changes are held until the sizes of the changed files have
+	// stayed the same for this long, so that files still being written don't
+	// trigger the block
+	Stable time.Duration
+
+	// If set, changes are held until the block's whole file set, as seen by
+	// checking it once every Quiesce period, is the same at two checks in a
+	// row. Changes are never held for longer than QuiesceMax, or
+	// DefaultQuiesceMax if that isn't set.
+	Quiesce    time.Duration
+	QuiesceMax time.Duration
+
+	// If set, the block's prep commands are stopped if they take longer than
+	// this in total, and the block fails
+	Timeout time.Duration
+
+	// If set, command output is also appended to this file. The file is
+	// rotated when it would grow beyond LogMaxSize bytes, if that is set.
+	LogFile    string
+	LogMaxSize int64
+
+	// The types of file event that trigger the block. All events trigger the
+	// block if this is empty.
+	Events []string
+
 	Daemons []Daemon
 	Preps   []Prep
+
+	// Commands run in order when modd exits, after all daemons have stopped
+	Shutdown []string
 }
 
 func (b *Block) addPrep(command string, options []string) error {
@@ -34,22 +344,113 @@ func (b *Block) addPrep(command string, options []string) error {
 		b.Preps = []Prep{}
 	}
 
-	var onchange = false
+	prep := Prep{Command: command}
 	for _, v := range options {
-		switch v {
-		case "+onchange":
-			onchange = true
-		default:
+		name, value := splitOption(v)
+		if v == "+onchange" {
+			prep.Onchange = true
+		} else if v == "+all" {
+			prep.All = true
+		} else if v == "+stdin" {
+			prep.Stdin = stdinDelimiters["newline"]
+		} else if name == "+stdin" {
+			delim, ok := stdinDelimiters[value]
+			if !ok {
+				return fmt.Errorf("invalid stdin delimiter: %q", value)
+			}
+			prep.Stdin = delim
+		} else if v == "+changed" {
+			prep.Changed = "newline"
+		} else if name == "+changed" {
+			if value == "nul" {
+				return fmt.Errorf("invalid changed format: %q: environment variables can't hold NUL characters, use +stdin=nul instead", value)
+			} else if !changedFormats[value] {
+				return fmt.Errorf("invalid changed format: %q", value)
+			}
+			prep.Changed = value
+		} else if v == "+prefix" {
+			prep.Prefix = commandLabel(command)
+		} else if name == "+prefix" {
+			if value == "" {
+				return fmt.Errorf("+prefix= requires a label")
+			}
+			prep.Prefix = value
+		} else if name == "+retry" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid retry count: %q", value)
+			}
+			prep.Retry = n
+		} else if name == "+retrydelay" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return fmt.Errorf("invalid retry delay: %q", value)
+			}
+			prep.RetryDelay = d
+		} else if name == "+match" {
+			value = SlashPattern(value)
+			if err := ValidatePattern(value); err != nil {
+				return fmt.Errorf("invalid match pattern %q: %s", value, err)
+			}
+			prep.Match = append(prep.Match, value)
+		} else {
 			return fmt.Errorf("unknown option: %s", v)
 		}
 	}
 
-	prep := Prep{command, onchange}
-
+	if prep.RetryDelay > 0 && prep.Retry == 0 {
+		return fmt.Errorf("+retrydelay requires +retry")
+	}
+	if prep.All && len(prep.Match) > 0 {
+		return fmt.Errorf("+all can't be used with +match")
+	}
 	b.Preps = append(b.Preps, prep)
 	return nil
 }
 
+// commandLabel derives a short label for a command from the name of the
+// program it runs, so that "./bin/build --fast" becomes "build". Leading
+// comments and blank lines are skipped.
+func commandLabel(command string) string {
+	for _, line := range strings.Split(command, "\n") {
+		fields := strings.Fields(strings.TrimLeft(line, " \t#"))
+		if len(fields) > 0 {
+			return filepath.Base(fields[0])
+		}
+	}
+	return command
+}
+
+// addFollowUp attaches an onsuccess or onfailure command to the most recently
+// declared prep
+func (b *Block) addFollowUp(success bool, command string, options []string) error {
+	directive := "onfailure"
+	if success {
+		directive = "onsuccess"
+	}
+	if len(b.Preps) == 0 {
+		return fmt.Errorf("%s must follow a prep", directive)
+	}
+	f := &FollowUp{Command: command}
+	for _, v := range options {
+		if v == "+nofail" && success {
+			f.NoFail = true
+		} else {
+			return fmt.Errorf("unknown option: %s", v)
+		}
+	}
+	prep := &b.Preps[len(b.Preps)-1]
+	target := &prep.OnFailure
+	if success {
+		target = &prep.OnSuccess
+	}
+	if *target != nil {
+		return fmt.Errorf("%s can only be used once per prep", directive)
+	}
+	*target = f
+	return nil
+}
+
 // Config represents a complete configuration
 type Config struct {
 	Blocks    []Block
@@ -74,6 +475,23 @@ func (c *Config) IncludePatterns() []string {
 	return paths
 }
 
+// WatchedPatterns retrieves the include patterns from all blocks that need
+// watching, leaving out those that WatchedIncludes drops
+func (c *Config) WatchedPatterns() []string {
+	pmap := map[string]bool{}
+	for _, b := range c.Blocks {
+		for _, p := range b.WatchedIncludes() {
+			pmap[p] = true
+		}
+	}
+	paths := make([]string, 0, len(pmap))
+	for k := range pmap {
+		paths = append(paths, k)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
 func (c *Config) addBlock(b Block) {
 	if c.Blocks == nil {
 		c.Blocks = []Block{}
@@ -18,3 +18,118 @@ func TestWatchPaths(t *testing.T) {
 		t.Errorf("Expected %#v, got %#v", expected, got)
 	}
 }
+
+func TestWatchedPatterns(t *testing.T) {
+	cnf, err := Parse("test", `
+		vendor/lib/** src/** !vendor/** {}
+		build/**/*.js src/*.go !*.log !added:build/** {}
+		"gen/**" !gen/** !**/tmp/** {}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{
+		{"src/**"},
+		{"build/**/*.js", "src/*.go"},
+		{},
+	}
+	for i, b := range cnf.Blocks {
+		if got := b.WatchedIncludes(); !reflect.DeepEqual(got, expected[i]) {
+			t.Errorf("Block %d: expected %#v, got %#v", i+1, expected[i], got)
+		}
+	}
+	if got, expected := cnf.WatchedPatterns(), []string{"build/**/*.js", "src/**", "src/*.go"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, got)
+	}
+}
+
+func TestFullyExcluded(t *testing.T) {
+	tests := []struct {
+		base     string
+		excludes []string
+		expected bool
+	}{
+		{"vendor", []string{"vendor/**"}, true},
+		{"vendor/lib", []string{"vendor/**"}, true},
+		{"./vendor/lib", []string{"vendor/**"}, true},
+		{"vendorized", []string{"vendor/**"}, false},
+		{".", []string{"vendor/**"}, false},
+		{"logs", []string{"*.log", "logs/*.log"}, false},
+		{"a/tmp", []string{"**/tmp/**"}, false},
+		{"a/b", []string{"a/*/**"}, false},
+		{"a", []string{"a/**/*.go"}, false},
+		{"/abs/dir", []string{"/abs/**"}, true},
+	}
+	for _, tt := range tests {
+		if got := FullyExcluded(tt.base, tt.excludes); got != tt.expected {
+			t.Errorf("%s %v: expected %v", tt.base, tt.excludes, tt.expected)
+		}
+	}
+}
+
+func TestEventPatterns(t *testing.T) {
+	b := Block{
+		Include:       []string{"**/*.go", "*.tmp"},
+		Exclude:       []string{"vendor/**", "tmp/**"},
+		IncludeEvents: map[string][]string{"*.tmp": {EventDeleted}},
+		ExcludeEvents: map[string][]string{"tmp/**": {EventAdded, EventChanged}},
+	}
+	tests := []struct {
+		event   string
+		include []string
+		exclude []string
+	}{
+		{EventAdded, []string{"**/*.go"}, []string{"vendor/**", "tmp/**"}},
+		{EventChanged, []string{"**/*.go"}, []string{"vendor/**", "tmp/**"}},
+		{EventDeleted, []string{"**/*.go", "*.tmp"}, []string{"vendor/**"}},
+	}
+	for _, tt := range tests {
+		inc, exc := b.EventPatterns(tt.event)
+		if !reflect.DeepEqual(inc, tt.include) || !reflect.DeepEqual(exc, tt.exclude) {
+			t.Errorf("%s: expected %#v %#v, got %#v %#v", tt.event, tt.include, tt.exclude, inc, exc)
+		}
+	}
+}
+
+func TestCaseFolded(t *testing.T) {
+	b := Block{
+		Include:       []string{"src/*.go", "a"},
+		Exclude:       []string{"**/x"},
+		IncludeEvents: map[string][]string{"a": {EventDeleted}},
+	}
+	ret := b.CaseFolded()
+	expected := Block{
+		Include:       []string{"src/*.[gG][oO]", "[aA]"},
+		Exclude:       []string{"**/[xX]"},
+		IncludeEvents: map[string][]string{"[aA]": {EventDeleted}},
+	}
+	if !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+	if b.Include[0] != "src/*.go" {
+		t.Errorf("Original block modified: %#v", b.Include)
+	}
+}
+
+func TestUserExcludes(t *testing.T) {
+	common := []string{"**/.git/**", "**/*~"}
+	tests := []struct {
+		block    Block
+		expected []string
+	}{
+		{Block{Exclude: []string{"a/**", "**/.git/**", "**/*~"}}, []string{"a/**"}},
+		{Block{Exclude: []string{"**/.git/**", "**/*~"}}, []string{}},
+		{Block{Exclude: []string{"a/**"}}, []string{"a/**"}},
+		{Block{Exclude: []string{"a/**", "b/**", "c/**"}}, []string{"a/**", "b/**", "c/**"}},
+		{Block{}, nil},
+		{
+			Block{Exclude: []string{"**/.git/**", "**/*~"}, NoCommonFilter: true},
+			[]string{"**/.git/**", "**/*~"},
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.block.UserExcludes(common); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%#v: expected %#v, got %#v", tt.block.Exclude, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package conf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// The state of an attribute for a path, as set by a .gitattributes line
+type attrState int
+
+const (
+	attrUntouched attrState = iota
+	attrSet
+	attrUnset
+	attrUnspecified
+)
+
+// Macros that git defines itself
+var builtinAttrMacros = map[string][]string{
+	"binary": {"-diff", "-merge", "-text"},
+}
+
+// attrLine splits a .gitattributes line into its pattern and attributes. The
+// pattern may be quoted, as git does for patterns containing spaces.
+func attrLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, `"`) {
+		fields := strings.Fields(line)
+		return fields[0], fields[1:], nil
+	}
+	for i := 1; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '"':
+			pattern, err := strconv.Unquote(line[:i+1])
+			if err != nil {
+				return "", nil, fmt.Errorf("bad quoted pattern %s", line[:i+1])
+			}
+			return pattern, strings.Fields(line[i+1:]), nil
+		}
+	}
+	return "", nil, fmt.Errorf("unterminated quoted pattern %s", line)
+}
+
+// resolveAttr returns the state a list of attributes gives attr, expanding
+// macros. The last attribute that mentions attr wins. Values other than
+// "false" count as set, and "false" counts as unset, which is how tools like
+// linguist read them. The depth limit guards against macros that refer to
+// themselves.
+func resolveAttr(attrs []string, attr string, macros map[string][]string, depth int) attrState {
+	state := attrUntouched
+	for _, a := range attrs {
+		name, s := a, attrSet
+		switch {
+		case strings.HasPrefix(a, "-"):
+			name, s = a[1:], attrUnset
+		case strings.HasPrefix(a, "!"):
+			name, s = a[1:], attrUnspecified
+		case strings.Contains(a, "="):
+			kv := strings.SplitN(a, "=", 2)
+			name = kv[0]
+			if kv[1] == "false" {
+				s = attrUnset
+			}
+		}
+		if name == attr {
+			state = s
+		} else if m, ok := macros[name]; ok && s == attrSet && depth < 10 {
+			if ms := resolveAttr(m, attr, macros, depth+1); ms != attrUntouched {
+				state = ms
+			}
+		}
+	}
+	return state
+}
+
+// gitPattern converts a .gitattributes pattern to a modd pattern. Patterns
+// without a slash match at any depth, and patterns with one are relative to
+// the directory of the .gitattributes file. Patterns that can only match
+// directories, and negated patterns, which git forbids, have no equivalent.
+func gitPattern(p string) (string, bool) {
+	if strings.HasPrefix(p, "!") || strings.HasSuffix(p, "/") {
+		return "", false
+	}
+	// Braces are literal in gitattributes patterns
+	p = strings.NewReplacer("{", `\{`, "}", `\}`).Replace(p)
+	if strings.HasPrefix(p, "/") {
+		return p[1:], true
+	}
+	if !strings.Contains(p, "/") {
+		return "**/" + p, true
+	}
+	return p, true
+}
+
+// LoadGitAttributes reads a .gitattributes file, and returns patterns
+// matching the paths it gives the attribute attr. Lines are resolved in
+// order, so a later line for the same pattern overrides an earlier one, and
+// macros defined with [attr] lines are expanded. Unsetting an attribute for a
+// narrower pattern can't be expressed as an exclude, so it doesn't override a
+// broader pattern that sets it.
+func LoadGitAttributes(path string, attr string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("gitattributes %s: %s", path, err)
+	}
+	macros := map[string][]string{}
+	for k, v := range builtinAttrMacros {
+		macros[k] = v
+	}
+	order := []string{}
+	states := map[string]attrState{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern, attrs, err := attrLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("gitattributes %s:%d: %s", path, i+1, err)
+		}
+		if strings.HasPrefix(pattern, "[attr]") {
+			macros[strings.TrimPrefix(pattern, "[attr]")] = attrs
+			continue
+		}
+		s := resolveAttr(attrs, attr, macros, 0)
+		if s == attrUntouched {
+			continue
+		}
+		p, ok := gitPattern(pattern)
+		if !ok {
+			continue
+		}
+		if _, seen := states[p]; !seen {
+			order = append(order, p)
+		}
+		states[p] = s
+	}
+	ret := []string{}
+	for _, p := range order {
+		if states[p] == attrSet {
+			ret = append(ret, p)
+		}
+	}
+	return ret, nil
+}
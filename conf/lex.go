@@ -20,6 +20,9 @@ const quotes = `'"`
 // Characters we don't allow in bare strings
 const bareStringDisallowed = "{}#\n" + whitespace + quotes
 
+// Characters we don't allow in option values
+const optionValueDisallowed = ":" + bareStringDisallowed
+
 // itemType identifies the type of lex items.
 type itemType int
 
@@ -27,15 +30,28 @@ const (
 	itemBareString itemType = iota
 	itemColon
 	itemComment
+	itemCooldown
 	itemDaemon
 	itemError // error occurred; value is text of error
 	itemEOF
+	itemEvents
+	itemGrace
 	itemInDir
 	itemLeftParen
+	itemLog
+	itemOnFailure
+	itemOnSuccess
 	itemQuotedString
 	itemPrep
+	itemQuiesce
 	itemRightParen
+	itemSection
+	itemSettle
+	itemShutdown
 	itemSpace
+	itemStable
+	itemTimeout
+	itemUser
 	itemVarName
 	itemEquals
 )
@@ -48,6 +64,8 @@ func (i itemType) String() string {
 		return "comment"
 	case itemColon:
 		return "colon"
+	case itemCooldown:
+		return "cooldown"
 	case itemDaemon:
 		return "daemon"
 	case itemError:
@@ -56,18 +74,42 @@ func (i itemType) String() string {
 		return "="
 	case itemEOF:
 		return "eof"
+	case itemEvents:
+		return "events"
+	case itemGrace:
+		return "grace"
 	case itemInDir:
 		return "indir"
 	case itemLeftParen:
 		return "lparen"
+	case itemLog:
+		return "log"
+	case itemOnFailure:
+		return "onfailure"
+	case itemOnSuccess:
+		return "onsuccess"
 	case itemPrep:
 		return "prep"
+	case itemQuiesce:
+		return "quiesce"
 	case itemQuotedString:
 		return "quotedstring"
 	case itemRightParen:
 		return "rparen"
+	case itemSection:
+		return "section"
+	case itemSettle:
+		return "settle"
+	case itemShutdown:
+		return "shutdown"
 	case itemSpace:
 		return "space"
+	case itemStable:
+		return "stable"
+	case itemTimeout:
+		return "timeout"
+	case itemUser:
+		return "user"
 	case itemVarName:
 		return "var"
 	default:
@@ -288,6 +330,15 @@ func (l *lexer) acceptBareString() {
 	)
 }
 
+// acceptOptionValue accepts the value of a +option=value command option
+func (l *lexer) acceptOptionValue() {
+	l.acceptFunc(
+		func(r rune) bool {
+			return !any(r, optionValueDisallowed) && r != eof
+		},
+	)
+}
+
 // acceptWord accepts a lowercase word
 func (l *lexer) acceptWord() {
 	l.acceptFunc(
@@ -297,6 +348,48 @@ func (l *lexer) acceptWord() {
 	)
 }
 
+// assignmentFollows checks whether the next significant rune is an =, without
+// consuming any input.
+func (l *lexer) assignmentFollows() bool {
+	pos := l.pos
+	defer func() { l.pos = pos }()
+	l.acceptRun(whitespace)
+	return l.peek() == '='
+}
+
+// acceptSection checks whether the '[' just read starts a section header - a
+// word in brackets, alone on its line apart from spaces and a comment, and
+// ended by a newline - and accepts the header if it does. Anything else, like
+// the glob in "[abc]*.go", is left to be read as a pattern.
+func (l *lexer) acceptSection() bool {
+	pos := l.pos
+	line := strings.LastIndexByte(l.input[:pos-1], '\n') + 1
+	if strings.TrimLeft(l.input[line:pos-1], spaces) != "" {
+		return false
+	}
+	l.acceptRun(wordRunes + "-")
+	if l.pos == pos || !l.accept("]") {
+		l.pos = pos
+		return false
+	}
+	end := l.pos
+	l.acceptRun(spaces)
+	switch l.peek() {
+	case '\n':
+	case '#':
+		l.acceptLine(false)
+		if !strings.HasSuffix(l.input[:l.pos], "\n") {
+			l.pos = pos
+			return false
+		}
+	default:
+		l.pos = pos
+		return false
+	}
+	l.pos = end
+	return true
+}
+
 // acceptQuotedString accepts a quoted string
 func (l *lexer) acceptQuotedString(quote rune) error {
 Loop:
@@ -369,6 +462,11 @@ func lexVariables(l *lexer) stateFn {
 		n := l.eatSpaceAndComments()
 		if n == '@' {
 			l.acceptWord()
+			if !l.assignmentFollows() {
+				// A reference to a pattern variable at the start of a block
+				l.pos = l.start
+				return lexPatterns
+			}
 			l.emit(itemVarName)
 			n = l.maybeSpace()
 			if n == '=' {
@@ -392,6 +490,8 @@ func lexVariables(l *lexer) stateFn {
 				l.errorf("= must be followed by a string")
 				return nil
 			}
+		} else if n == '[' && l.acceptSection() {
+			l.emit(itemSection)
 		} else {
 			l.backup()
 			return lexPatterns
@@ -423,15 +523,51 @@ func lexInside(l *lexer) stateFn {
 		} else if !any(n, bareStringDisallowed) {
 			l.acceptWord()
 			switch l.current() {
+			case "cooldown":
+				l.emit(itemCooldown)
+				return lexOptions
 			case "daemon":
 				l.emit(itemDaemon)
 				return lexOptions
+			case "events":
+				l.emit(itemEvents)
+				return lexOptions
+			case "grace":
+				l.emit(itemGrace)
+				return lexOptions
 			case "indir":
 				l.emit(itemInDir)
 				return lexOptions
+			case "log":
+				l.emit(itemLog)
+				return lexOptions
+			case "onfailure":
+				l.emit(itemOnFailure)
+				return lexOptions
+			case "onsuccess":
+				l.emit(itemOnSuccess)
+				return lexOptions
 			case "prep":
 				l.emit(itemPrep)
 				return lexOptions
+			case "quiesce":
+				l.emit(itemQuiesce)
+				return lexOptions
+			case "settle":
+				l.emit(itemSettle)
+				return lexOptions
+			case "shutdown":
+				l.emit(itemShutdown)
+				return lexOptions
+			case "stable":
+				l.emit(itemStable)
+				return lexOptions
+			case "timeout":
+				l.emit(itemTimeout)
+				return lexOptions
+			case "user":
+				l.emit(itemUser)
+				return lexOptions
 			default:
 				l.errorf("unknown directive: %s", l.current())
 				return nil
@@ -454,6 +590,9 @@ func lexOptions(l *lexer) stateFn {
 			return lexCommand
 		} else if n == '+' {
 			l.acceptWord()
+			if l.accept("=") {
+				l.acceptOptionValue()
+			}
 			l.emit(itemBareString)
 		} else {
 			l.errorf("invalid command option")
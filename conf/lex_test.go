@@ -136,6 +136,18 @@ var lexTests = []struct {
 			{itemRightParen, "}"},
 		},
 	},
+	{
+		"one {\ndaemon +optone=1s,two +opttwo: foo\n}", []itm{
+			{itemBareString, "one"},
+			{itemLeftParen, "{"},
+			{itemDaemon, "daemon"},
+			{itemBareString, "+optone=1s,two"},
+			{itemBareString, "+opttwo"},
+			{itemColon, ":"},
+			{itemBareString, "foo\n"},
+			{itemRightParen, "}"},
+		},
+	},
 	{
 		"one { daemon: command\nprep: command\n}", []itm{
 			{itemBareString, "one"},
@@ -234,6 +246,17 @@ var lexTests = []struct {
 			{itemQuotedString, "'foo\nvoing'"},
 		},
 	},
+	{
+		"@a = b\n@a !@c {}", []itm{
+			{itemVarName, "@a"},
+			{itemEquals, "="},
+			{itemBareString, "b\n"},
+			{itemBareString, "@a"},
+			{itemBareString, "!@c"},
+			{itemLeftParen, "{"},
+			{itemRightParen, "}"},
+		},
+	},
 	{
 		"one {\ndaemon: foo\n}\n@b=foo", []itm{
 			{itemBareString, "one"},
@@ -263,6 +286,47 @@ var lexTests = []struct {
 			{itemBareString, "b"},
 		},
 	},
+	{
+		"[dev] # comment\n@a = b\n[prod-2]\n", []itm{
+			{itemSection, "[dev]"},
+			{itemComment, "# comment\n"},
+			{itemVarName, "@a"},
+			{itemEquals, "="},
+			{itemBareString, "b\n"},
+			{itemSection, "[prod-2]"},
+		},
+	},
+	{
+		"[abc]*.go {\n}\n", []itm{
+			{itemBareString, "[abc]*.go"},
+			{itemLeftParen, "{"},
+			{itemRightParen, "}"},
+		},
+	},
+	{
+		"[abc]", []itm{
+			{itemBareString, "[abc]"},
+		},
+	},
+	{
+		"@a = 'x' [dev]\n", []itm{
+			{itemVarName, "@a"},
+			{itemEquals, "="},
+			{itemQuotedString, "'x'"},
+			{itemBareString, "[dev]"},
+		},
+	},
+	{
+		"[dev] **", []itm{
+			{itemBareString, "[dev]"},
+			{itemBareString, "**"},
+		},
+	},
+	{
+		"[a-z]/**", []itm{
+			{itemBareString, "[a-z]/**"},
+		},
+	},
 }
 
 func TestLex(t *testing.T) {
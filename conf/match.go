@@ -0,0 +1,73 @@
+package conf
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/cortesi/moddwatch/filter"
+)
+
+// extSuffix returns the suffix that an extension pattern like "**/*.go"
+// matches, or false if the pattern is anything else. Such a pattern matches
+// exactly the paths ending with the suffix, since the suffix holds no
+// separator and "**/*" matches any path up to it.
+func extSuffix(pattern string) (string, bool) {
+	if !strings.HasPrefix(pattern, "**/*.") {
+		return "", false
+	}
+	suffix := pattern[len("**/*"):]
+	if strings.ContainsAny(suffix, `*?[]{}\/`) {
+		return "", false
+	}
+	return suffix, true
+}
+
+// matchPatterns checks whether a path matches any of the patterns, like
+// filter.MatchAny. Extension patterns are matched with a suffix check rather
+// than a glob match, which is much faster for the common case of watching
+// files of a few types across a large tree. Patterns are tried in order, so
+// malformed patterns are reported exactly as they are by filter.MatchAny.
+func matchPatterns(p string, patterns []string) (bool, error) {
+	for i, pattern := range patterns {
+		if suffix, ok := extSuffix(pattern); ok {
+			if strings.HasSuffix(filepath.ToSlash(p), suffix) {
+				return true, nil
+			}
+			continue
+		}
+		if match, err := filter.MatchAny(p, patterns[i:i+1]); err != nil || match {
+			return match, err
+		}
+	}
+	return false, nil
+}
+
+// MatchAny checks whether a path matches any of the patterns. A path with a
+// trailing separator names a directory, and matches patterns for the
+// directory itself as well as patterns for its contents, so "a/b/" matches
+// both "a/b" and "a/b/**".
+func MatchAny(p string, patterns []string) (bool, error) {
+	dir := strings.TrimRight(p, "/")
+	if dir == p || dir == "" {
+		return matchPatterns(p, patterns)
+	}
+	if match, err := matchPatterns(dir, patterns); err != nil || match {
+		return match, err
+	}
+	return matchPatterns(dir+"/", patterns)
+}
+
+// MatchFile checks whether a path matches any of the includes and none of the
+// excludes, as MatchAny matches them. It is the one test of whether a path
+// belongs to a set of patterns, shared by the searches behind @mods and the
+// filtering of the watcher's changes, so that the two always agree.
+func MatchFile(p string, includes []string, excludes []string) (bool, error) {
+	if included, err := MatchAny(p, includes); err != nil || !included {
+		return false, err
+	}
+	excluded, err := MatchAny(p, excludes)
+	if err != nil {
+		return false, err
+	}
+	return !excluded, nil
+}
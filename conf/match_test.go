@@ -0,0 +1,83 @@
+package conf
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cortesi/moddwatch/filter"
+)
+
+func TestExtSuffix(t *testing.T) {
+	tests := map[string]string{
+		"**/*.go":      ".go",
+		"**/*.tar.gz":  ".tar.gz",
+		"**/*.":        ".",
+		"**/*.g?":      "",
+		"**/*.{go,js}": "",
+		"**/*.go/x":    "",
+		"src/**/*.go":  "",
+		"**/a.go":      "",
+		"*.go":         "",
+	}
+	for pattern, expected := range tests {
+		suffix, ok := extSuffix(pattern)
+		if ok != (expected != "") || suffix != expected {
+			t.Errorf("%q: expected %q, got %q, %v", pattern, expected, suffix, ok)
+		}
+	}
+}
+
+func TestMatchPatternsParity(t *testing.T) {
+	paths := []string{
+		"a.go", "src/a.go", "src/deep/er/a.go", ".go", "src/.go", "a.gox",
+		"a.go/b.txt", "a.go/", "/abs/a.go", "a.tar.gz", "a.gz", "go", "ago",
+		"x/y.templ", "é.go", "a b.go", "src/a.GO", "",
+	}
+	patterns := [][]string{
+		{"**/*.go"},
+		{"**/*.go", "**/*.templ"},
+		{"**/*.tar.gz"},
+		{"**/*."},
+		{"src/*.txt", "**/*.go"},
+		{"**/*.go", "[a"},
+		{"[a", "**/*.go"},
+	}
+	for _, patts := range patterns {
+		for _, p := range paths {
+			fast, ferr := matchPatterns(p, patts)
+			slow, serr := filter.MatchAny(p, patts)
+			if fast != slow || (ferr == nil) != (serr == nil) {
+				t.Errorf("%q against %v: suffix match gave %v, %v, glob gave %v, %v", p, patts, fast, ferr, slow, serr)
+			}
+		}
+	}
+}
+
+// benchPaths makes a large tree of paths with a mix of file types
+func benchPaths() []string {
+	exts := []string{".go", ".js", ".md", ".templ", ".txt"}
+	ret := []string{}
+	for i := 0; i < 20000; i++ {
+		ret = append(ret, fmt.Sprintf("src/pkg%d/sub%d/file%d%s", i%50, i%7, i, exts[i%len(exts)]))
+	}
+	return ret
+}
+
+func BenchmarkMatchExtensions(b *testing.B) {
+	paths := benchPaths()
+	patterns := []string{"**/*.go", "**/*.templ"}
+	b.Run("suffix", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, p := range paths {
+				matchPatterns(p, patterns)
+			}
+		}
+	})
+	b.Run("glob", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, p := range paths {
+				filter.MatchAny(p, patterns)
+			}
+		}
+	})
+}
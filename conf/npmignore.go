@@ -0,0 +1,77 @@
+package conf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The files npm reads to decide what to leave out of a package, in order of
+// precedence. Only the first one that exists is used.
+var npmIgnoreFiles = []string{".npmignore", ".gitignore"}
+
+// ignorePatterns converts a gitignore-style pattern to modd exclude patterns.
+// Patterns without a slash match at any depth, and patterns with one are
+// relative to the directory of the ignore file. A pattern matching a
+// directory also excludes everything inside it, and a trailing slash matches
+// only directories.
+func ignorePatterns(p string) []string {
+	dirOnly := strings.HasSuffix(p, "/")
+	p = strings.TrimRight(p, "/")
+	if p == "" {
+		return nil
+	}
+	// Braces are literal in gitignore patterns
+	p = strings.NewReplacer("{", `\{`, "}", `\}`).Replace(p)
+	if strings.HasPrefix(p, "/") {
+		p = p[1:]
+	} else if !strings.Contains(p, "/") {
+		p = "**/" + p
+	}
+	if dirOnly {
+		return []string{p + "/**"}
+	}
+	return []string{p, p + "/**"}
+}
+
+// LoadIgnoreFile reads a gitignore-style file, and returns exclude patterns
+// for the paths it ignores. Blank lines and comments are skipped, and a
+// leading backslash escapes a # or !. Negated patterns, which re-include
+// paths, can't be expressed as excludes and are skipped.
+func LoadIgnoreFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ignore file %s: %s", path, err)
+	}
+	ret := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if !strings.HasSuffix(line, `\ `) {
+			line = strings.TrimRight(line, " \t")
+		}
+		switch {
+		case line == "", strings.HasPrefix(line, "#"), strings.HasPrefix(line, "!"):
+			continue
+		case strings.HasPrefix(line, `\#`), strings.HasPrefix(line, `\!`):
+			line = line[1:]
+		}
+		ret = append(ret, ignorePatterns(line)...)
+	}
+	return ret, nil
+}
+
+// LoadNpmIgnore returns exclude patterns for the paths npm would leave out
+// of a package in dir. As npm does, it reads .npmignore if there is one, and
+// falls back to .gitignore otherwise. If neither exists, nothing is excluded.
+func LoadNpmIgnore(dir string) ([]string, error) {
+	for _, name := range npmIgnoreFiles {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		return LoadIgnoreFile(path)
+	}
+	return []string{}, nil
+}
@@ -8,20 +8,59 @@ package conf
 
 import (
 	"fmt"
+	"os"
+	"os/user"
 	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 )
 
 const confVarName = "@confdir"
 
+// The pattern option used to load patterns from a file
+const fromOption = "+from="
+
+// The pattern option that excludes paths with an attribute set in the
+// .gitattributes file next to the config file
+const gitAttributesOption = "+gitattributes="
+
+// The pattern option that excludes the paths npm would leave out of a package,
+// as given by the .npmignore or .gitignore file next to the config file
+const npmIgnoreOption = "+npmignore"
+
+// The pattern option that excludes everything inside hidden directories, and
+// the exclude pattern it adds. Hidden files outside hidden directories still
+// match.
+const (
+	noHiddenOption   = "+nohidden"
+	hiddenDirPattern = "**/.*/**"
+)
+
+// The pattern option that also matches excludes against the real paths of
+// files reached through symlinks
+const realPathOption = "+realpath"
+
+// The pattern option that watches each directory matched by a single-star
+// level of an include pattern on its own
+const expandOption = "+expand"
+
 type parser struct {
 	name   string
 	text   string
 	lex    *lexer
 	config *Config
 
+	// The environment whose section is used, the config that collects the
+	// shared blocks and the chosen section, and the sections seen so far.
+	// Other sections are parsed into a scratch config with only the
+	// variables declared before the first section, and then dropped.
+	env        string
+	shared     *Config
+	sections   []string
+	sharedVars map[string]string
+
 	peekItem *item
 }
 
@@ -33,6 +72,116 @@ func unquote(s string) string {
 	return s
 }
 
+func isEnvNameRune(r byte, first bool) bool {
+	return r == '_' ||
+		('a' <= r && r <= 'z') ||
+		('A' <= r && r <= 'Z') ||
+		(!first && '0' <= r && r <= '9')
+}
+
+// expandEnv expands $NAME and ${NAME} references to environment variables in
+// a pattern. A literal $ can be written as $$. It is an error to refer to an
+// environment variable that is not defined.
+func expandEnv(s string) (string, error) {
+	var ret strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			ret.WriteByte(s[i])
+			continue
+		}
+		var name string
+		switch {
+		case s[i+1] == '$':
+			ret.WriteByte('$')
+			i++
+			continue
+		case s[i+1] == '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated variable reference in %q", s)
+			}
+			name = s[i+2 : i+end]
+			i += end
+		case isEnvNameRune(s[i+1], true):
+			end := i + 2
+			for end < len(s) && isEnvNameRune(s[end], false) {
+				end++
+			}
+			name = s[i+1 : end]
+			i = end - 1
+		default:
+			ret.WriteByte(s[i])
+			continue
+		}
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("undefined environment variable %q in pattern %q", name, s)
+		}
+		ret.WriteString(val)
+	}
+	return ret.String(), nil
+}
+
+// isUserNameRune reports whether r can be part of a user name in a ~user
+// reference
+func isUserNameRune(r byte) bool {
+	return isEnvNameRune(r, false) || r == '-' || r == '.'
+}
+
+// expandHome expands a leading ~ or ~user in a pattern to the home directory.
+// A ~ anywhere else in the pattern is left as it is, as is a leading ~ that is
+// not followed by a user name and a slash.
+func expandHome(s string) (string, error) {
+	if !strings.HasPrefix(s, "~") {
+		return s, nil
+	}
+	end := strings.IndexByte(s, '/')
+	if end < 0 {
+		end = len(s)
+	}
+	name := s[1:end]
+	for i := 0; i < len(name); i++ {
+		if !isUserNameRune(name[i]) {
+			return s, nil
+		}
+	}
+	var home string
+	if name == "" {
+		dir, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("can't expand ~ in pattern %q: %s", s, err)
+		}
+		home = dir
+	} else {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", fmt.Errorf("unknown user %q in pattern %q", name, s)
+		}
+		home = u.HomeDir
+	}
+	return filepath.ToSlash(home) + s[end:], nil
+}
+
+// expandPatterns expands a leading ~ and environment variables in a list of
+// patterns, and checks the resulting patterns for syntax errors.
+func (p *parser) expandPatterns(patterns []string) []string {
+	for i, v := range patterns {
+		expanded, err := expandHome(v)
+		if err != nil {
+			p.errorf("%s", err)
+		}
+		expanded, err = expandEnv(expanded)
+		if err != nil {
+			p.errorf("%s", err)
+		}
+		if err := ValidatePattern(expanded); err != nil {
+			p.errorf("invalid pattern %q: %s", expanded, err)
+		}
+		patterns[i] = expanded
+	}
+	return patterns
+}
+
 // next returns the next token.
 func (p *parser) next() item {
 	if p.peekItem != nil {
@@ -95,41 +244,228 @@ func (p *parser) collectValues(types ...itemType) []string {
 	return ret
 }
 
-// Collects an arbitrary number of patterns, and returns a (watch, exclude,
-// NoCommonFilter) tuple.
-func (p *parser) collectPatterns() ([]string, []string, bool) {
-	noCommonFilter := false
+// loadPatternFile loads a pattern file referenced with +from. Relative paths
+// are resolved against the directory containing the config file.
+func (p *parser) loadPatternFile(path string) *PatternFile {
+	if path == "" {
+		p.errorf("%s requires a file path", fromOption)
+	}
+	if dir, ok := p.config.variables[confVarName]; ok && !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	pf, err := LoadPatternFile(path)
+	if err != nil {
+		p.errorf("%s", err)
+	}
+	return pf
+}
+
+// loadGitAttributes returns exclude patterns for the paths given attr by the
+// .gitattributes file in the directory containing the config file
+func (p *parser) loadGitAttributes(attr string) []string {
+	if attr == "" {
+		p.errorf("%s requires an attribute name", gitAttributesOption)
+	}
+	path := ".gitattributes"
+	if dir, ok := p.config.variables[confVarName]; ok {
+		path = filepath.Join(dir, path)
+	}
+	patterns, err := LoadGitAttributes(path, attr)
+	if err != nil {
+		p.errorf("%s", err)
+	}
+	return patterns
+}
+
+// loadNpmIgnore returns exclude patterns for the paths ignored by the
+// .npmignore or .gitignore file in the directory containing the config file
+func (p *parser) loadNpmIgnore() []string {
+	dir := "."
+	if d, ok := p.config.variables[confVarName]; ok {
+		dir = d
+	}
+	patterns, err := LoadNpmIgnore(dir)
+	if err != nil {
+		p.errorf("%s", err)
+	}
+	return patterns
+}
+
+// expandPatternVar expands a reference to a pattern variable into the list of
+// patterns it contains. Variables can refer to other variables. The seen list
+// holds the variables being expanded, and is used to detect cycles.
+func (p *parser) expandPatternVar(name string, seen []string) []string {
+	for i, v := range seen {
+		if v == name {
+			cycle := append(seen[i:], name)
+			p.errorf("circular pattern variable reference: %s", strings.Join(cycle, " -> "))
+		}
+	}
+	val, ok := p.config.variables[name]
+	if !ok {
+		if name == vendoredKeyword {
+			return VendoredPatterns
+		}
+		p.errorf("undefined pattern variable: %s", name)
+	}
+	seen = append(seen, name)
+	patterns := []string{}
+	for _, f := range strings.Fields(val) {
+		if f[0] == '@' {
+			patterns = append(patterns, p.expandPatternVar(f, seen)...)
+		} else if f[0] == '!' {
+			p.errorf("pattern variable %s: negated patterns are not allowed", name)
+		} else {
+			patterns = append(patterns, f)
+		}
+	}
+	return patterns
+}
+
+// splitEventScope splits an event scope like "deleted:" or "added,changed:"
+// from the start of a pattern. If the pattern doesn't start with a list of
+// event types followed by a colon, the events are nil and the pattern is
+// returned unchanged.
+func splitEventScope(pattern string) ([]string, string) {
+	i := strings.Index(pattern, ":")
+	if i < 0 {
+		return nil, pattern
+	}
+	events := strings.Split(pattern[:i], ",")
+	for _, e := range events {
+		switch e {
+		case EventAdded, EventChanged, EventDeleted:
+		default:
+			return nil, pattern
+		}
+	}
+	return events, pattern[i+1:]
+}
+
+// patternFlags holds the qualifiers of a single pattern: the event types it is
+// scoped to, which are nil if it applies to all events, and whether it
+// matches without regard to case
+type patternFlags struct {
+	events []string
+	fold   bool
+}
+
+// applyFlags folds the case of patterns that have the case flag, and returns
+// the event scopes of the patterns that have one
+func applyFlags(patterns []string, flags []patternFlags) map[string][]string {
+	var scopes map[string][]string
+	for i, f := range flags {
+		if f.fold {
+			patterns[i] = FoldCase(patterns[i])
+		}
+		if f.events == nil {
+			continue
+		}
+		if scopes == nil {
+			scopes = map[string][]string{}
+		}
+		scopes[patterns[i]] = f.events
+	}
+	return scopes
+}
+
+// splitAlternatives expands leading brace groups in include patterns with
+// expandAlternatives, giving each expanded pattern the qualifiers of the
+// pattern it came from
+func splitAlternatives(patterns []string, flags []patternFlags) ([]string, []patternFlags) {
+	retPatterns := []string{}
+	retFlags := []patternFlags{}
+	for i, pat := range patterns {
+		for _, e := range expandAlternatives(pat) {
+			retPatterns = append(retPatterns, e)
+			retFlags = append(retFlags, flags[i])
+		}
+	}
+	return retPatterns, retFlags
+}
+
+// Collects an arbitrary number of patterns into a block, along with their
+// event scopes and the +noignore and +nohidden options. Patterns are expanded with
+// expandPatterns, include patterns have their leading brace groups split into
+// separate patterns, and then patterns have their case folded if they have the
+// case flag.
+func (p *parser) collectPatterns(block *Block) {
 	watch := []string{}
 	exclude := []string{}
+	// Qualifiers for each pattern in watch and exclude
+	watchFlags := []patternFlags{}
+	excludeFlags := []patternFlags{}
+	add := func(negated bool, flags patternFlags, patterns ...string) {
+		for _, pat := range patterns {
+			pat = TrimSeparators(SlashPattern(pat))
+			if negated {
+				exclude = append(exclude, pat)
+				excludeFlags = append(excludeFlags, flags)
+			} else {
+				watch = append(watch, pat)
+				watchFlags = append(watchFlags, flags)
+			}
+		}
+	}
 
 	vals := p.collect(itemBareString, itemQuotedString)
 	for _, v := range vals {
-		switch v.typ {
-		case itemBareString:
-			if v.val[0] == '!' {
-				exclude = append(exclude, v.val[1:])
-			} else {
-				if v.val == "+noignore" {
-					noCommonFilter = true
-				} else {
-					watch = append(watch, v.val)
-				}
-			}
-		case itemQuotedString:
-			if v.val[0] == '!' {
-				exclude = append(exclude, unquote(v.val[1:]))
-			} else {
-				watch = append(watch, unquote(v.val))
-			}
+		val := v.val
+		negated := strings.HasPrefix(val, "!")
+		if negated {
+			val = val[1:]
+		}
+		if v.typ == itemQuotedString {
+			val = unquote(val)
+		}
+		var flags patternFlags
+		flags.events, val = splitEventScope(val)
+		if strings.HasPrefix(val, caseFlag) {
+			flags.fold = true
+			val = strings.TrimPrefix(val, caseFlag)
+		}
+		qualified := flags.events != nil || flags.fold
+		if qualified && val == "" {
+			p.errorf("pattern %q has no pattern after its qualifiers", v.val)
+		}
+		switch {
+		case v.typ == itemQuotedString, val == "":
+			add(negated, flags, val)
+		case val[0] == '@':
+			add(negated, flags, p.expandPatternVar(val, nil)...)
+		case negated:
+			add(negated, flags, val)
+		case qualified && val[0] == '+':
+			p.errorf("pattern qualifiers can't be used with %s", val)
+		case val == "+noignore":
+			block.NoCommonFilter = true
+		case val == noHiddenOption:
+			add(true, patternFlags{}, hiddenDirPattern)
+		case val == realPathOption:
+			block.RealPathExcludes = true
+		case val == expandOption:
+			block.ExpandDirs = true
+		case strings.HasPrefix(val, fromOption):
+			pf := p.loadPatternFile(strings.TrimPrefix(val, fromOption))
+			add(false, patternFlags{}, pf.Includes...)
+			add(true, patternFlags{}, pf.Excludes...)
+		case val == npmIgnoreOption:
+			add(true, patternFlags{}, p.loadNpmIgnore()...)
+		case strings.HasPrefix(val, gitAttributesOption):
+			add(true, patternFlags{}, p.loadGitAttributes(strings.TrimPrefix(val, gitAttributesOption))...)
+		default:
+			add(negated, flags, val)
 		}
 	}
-	if len(watch) == 0 {
-		watch = nil
+	if len(watch) > 0 {
+		watch, watchFlags = splitAlternatives(p.expandPatterns(watch), watchFlags)
+		block.Include = watch
+		block.IncludeEvents = applyFlags(block.Include, watchFlags)
 	}
-	if len(exclude) == 0 {
-		exclude = nil
+	if len(exclude) > 0 {
+		block.Exclude = p.expandPatterns(exclude)
+		block.ExcludeEvents = applyFlags(block.Exclude, excludeFlags)
 	}
-	return watch, exclude, noCommonFilter
 }
 
 // errorf formats the error and terminates processing.
@@ -163,6 +499,7 @@ func (p *parser) parse() (err error) {
 	defer p.recover(&err)
 	p.lex = lex(p.name, p.text)
 	p.config = &Config{}
+	p.shared = p.config
 
 	// Store path to conf in variable if not empty
 	if p.name != "" {
@@ -171,6 +508,10 @@ func (p *parser) parse() (err error) {
 
 	for {
 		for {
+			if p.peek().typ == itemSection {
+				p.parseSection()
+				continue
+			}
 			var k, v string
 			k, v, err = p.parseVariable()
 			if err != nil {
@@ -189,9 +530,52 @@ func (p *parser) parse() (err error) {
 		}
 		p.config.addBlock(*p.parseBlock())
 	}
+	p.config = p.shared
+	if p.env != "" && !p.hasSection(p.env) {
+		if len(p.sections) == 0 {
+			return fmt.Errorf("%s: unknown environment %q: no environments are defined", p.name, p.env)
+		}
+		return fmt.Errorf(
+			"%s: unknown environment %q: expected one of %s",
+			p.name, p.env, strings.Join(p.sections, ", "),
+		)
+	}
 	return err
 }
 
+func (p *parser) hasSection(name string) bool {
+	for _, s := range p.sections {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSection starts an environment section. Blocks and variables in the
+// section of the chosen environment are added to the shared ones declared
+// before the first section. Any other section is parsed against a copy of the
+// shared variables, so that it is still checked for errors, and then dropped.
+func (p *parser) parseSection() {
+	name := strings.Trim(p.next().val, "[]")
+	if p.hasSection(name) {
+		p.errorf("section [%s] is defined more than once", name)
+	}
+	if len(p.sections) == 0 {
+		p.sharedVars = p.shared.GetVariables()
+	}
+	p.sections = append(p.sections, name)
+	if name == p.env {
+		p.config = p.shared
+		return
+	}
+	vars := map[string]string{}
+	for k, v := range p.sharedVars {
+		vars[k] = v
+	}
+	p.config = &Config{variables: vars}
+}
+
 func (p *parser) parseVariable() (string, string, error) {
 	if p.peek().typ != itemVarName {
 		return "", "", nil
@@ -223,9 +607,68 @@ func prepValue(itm item) string {
 	return strings.TrimSpace(val)
 }
 
+// parseDuration parses the value of a block option that takes a duration
+func (p *parser) parseDuration(name string) time.Duration {
+	options := p.collectValues(itemBareString)
+	if len(options) > 0 {
+		p.errorf("%s takes no options", name)
+	}
+	p.mustNext(itemColon)
+	val := prepValue(p.mustNext(itemBareString, itemQuotedString))
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		p.errorf("invalid %s: %s", name, err)
+	}
+	return d
+}
+
+// parseQuiesce parses the check interval of a quiesce directive, and the
+// maximum hold time given with its +max option
+func (p *parser) parseQuiesce() (time.Duration, time.Duration) {
+	var max time.Duration
+	for _, v := range p.collectValues(itemBareString) {
+		name, value := splitOption(v)
+		if name != "+max" {
+			p.errorf("unknown option: %s", v)
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			p.errorf("invalid quiesce maximum: %q", value)
+		}
+		max = d
+	}
+	p.mustNext(itemColon)
+	val := prepValue(p.mustNext(itemBareString, itemQuotedString))
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		p.errorf("invalid quiesce: %s", err)
+	}
+	return d, max
+}
+
+func (p *parser) parseEvents() []string {
+	options := p.collectValues(itemBareString)
+	if len(options) > 0 {
+		p.errorf("events takes no options")
+	}
+	p.mustNext(itemColon)
+	events := strings.Fields(prepValue(p.mustNext(itemBareString, itemQuotedString)))
+	if len(events) == 0 {
+		p.errorf("events requires at least one event type")
+	}
+	for _, e := range events {
+		switch e {
+		case EventAdded, EventChanged, EventDeleted:
+		default:
+			p.errorf("unknown event type: %s", e)
+		}
+	}
+	return events
+}
+
 func (p *parser) parseBlock() *Block {
 	block := &Block{}
-	block.Include, block.Exclude, block.NoCommonFilter = p.collectPatterns()
+	p.collectPatterns(block)
 	nxt := p.next()
 	if nxt.typ != itemLeftParen {
 		p.errorf("expected block open parentheses, got %q", nxt.val)
@@ -253,6 +696,81 @@ Loop:
 				p.errorf("%s", err)
 			}
 			block.InDir = dir
+		case itemUser:
+			options := p.collectValues(itemBareString)
+			if len(options) > 0 {
+				p.errorf("user takes no options")
+			}
+			p.mustNext(itemColon)
+			spec := prepValue(p.mustNext(itemBareString, itemQuotedString))
+			if block.User != "" {
+				p.errorf("user can only be used once per block")
+			}
+			if spec == "" || strings.HasPrefix(spec, ":") || strings.HasSuffix(spec, ":") {
+				p.errorf("invalid user: %q", spec)
+			}
+			block.User = spec
+		case itemLog:
+			options := p.collectValues(itemBareString)
+			p.mustNext(itemColon)
+			path := prepValue(p.mustNext(itemBareString, itemQuotedString))
+			if block.LogFile != "" {
+				p.errorf("log can only be used once per block")
+			}
+			for _, v := range options {
+				name, value := splitOption(v)
+				if name != "+maxsize" {
+					p.errorf("unknown option: %s", v)
+				}
+				size, err := parseSize(value)
+				if err != nil {
+					p.errorf("%s", err)
+				}
+				block.LogMaxSize = size
+			}
+			path = strings.Replace(
+				path, confVarName, p.config.variables[confVarName], -1,
+			)
+			path, err := filepath.Abs(path)
+			if err != nil {
+				p.errorf("%s", err)
+			}
+			block.LogFile = path
+		case itemCooldown:
+			if block.Cooldown != 0 {
+				p.errorf("cooldown can only be used once per block")
+			}
+			block.Cooldown = p.parseDuration("cooldown")
+		case itemGrace:
+			if block.Grace != 0 {
+				p.errorf("grace can only be used once per block")
+			}
+			block.Grace = p.parseDuration("grace")
+		case itemSettle:
+			if block.Settle != 0 {
+				p.errorf("settle can only be used once per block")
+			}
+			block.Settle = p.parseDuration("settle")
+		case itemStable:
+			if block.Stable != 0 {
+				p.errorf("stable can only be used once per block")
+			}
+			block.Stable = p.parseDuration("stable")
+		case itemQuiesce:
+			if block.Quiesce != 0 {
+				p.errorf("quiesce can only be used once per block")
+			}
+			block.Quiesce, block.QuiesceMax = p.parseQuiesce()
+		case itemTimeout:
+			if block.Timeout != 0 {
+				p.errorf("timeout can only be used once per block")
+			}
+			block.Timeout = p.parseDuration("timeout")
+		case itemEvents:
+			if block.Events != nil {
+				p.errorf("events can only be used once per block")
+			}
+			block.Events = p.parseEvents()
 		case itemDaemon:
 			options := p.collectValues(itemBareString)
 			p.mustNext(itemColon)
@@ -273,6 +791,27 @@ Loop:
 			if err != nil {
 				p.errorf("%s", err)
 			}
+		case itemShutdown:
+			options := p.collectValues(itemBareString)
+			if len(options) > 0 {
+				p.errorf("shutdown takes no options")
+			}
+			p.mustNext(itemColon)
+			block.Shutdown = append(
+				block.Shutdown,
+				prepValue(p.mustNext(itemBareString, itemQuotedString)),
+			)
+		case itemOnSuccess, itemOnFailure:
+			options := p.collectValues(itemBareString)
+			p.mustNext(itemColon)
+			err := block.addFollowUp(
+				nxt.typ == itemOnSuccess,
+				prepValue(p.mustNext(itemBareString, itemQuotedString)),
+				options,
+			)
+			if err != nil {
+				p.errorf("%s", err)
+			}
 		case itemRightParen:
 			break Loop
 		default:
@@ -282,9 +821,17 @@ Loop:
 	return block
 }
 
-// Parse parses a string, and returns a completed Config
+// Parse parses a string, and returns a completed Config. Only the blocks
+// declared before any environment section are included.
 func Parse(name string, text string) (*Config, error) {
-	p := &parser{name: name, text: text}
+	return ParseEnv(name, text, "")
+}
+
+// ParseEnv parses a string like Parse, and also includes the blocks of the
+// section for the environment env, after the shared ones. It is an error if
+// env is not empty and the config has no section for it.
+func ParseEnv(name string, text string, env string) (*Config, error) {
+	p := &parser{name: name, text: text, env: env}
 	err := p.parse()
 	if err != nil {
 		return nil, err
@@ -3,7 +3,10 @@
 package conf
 
 import (
+	"os"
+	"os/user"
 	"syscall"
+	"testing"
 )
 
 var parsePosixTests = []struct {
@@ -14,20 +17,66 @@ var parsePosixTests = []struct {
 	{
 		"",
 		"{\ndaemon +sigusr1: c\n}",
-		&Config{Blocks: []Block{{Daemons: []Daemon{{"c", syscall.SIGUSR1}}}}},
+		&Config{Blocks: []Block{{Daemons: []Daemon{{Command: "c", RestartSignal: syscall.SIGUSR1}}}}},
 	},
 	{
 		"",
 		"{\ndaemon +sigusr2: c\n}",
-		&Config{Blocks: []Block{{Daemons: []Daemon{{"c", syscall.SIGUSR2}}}}},
+		&Config{Blocks: []Block{{Daemons: []Daemon{{Command: "c", RestartSignal: syscall.SIGUSR2}}}}},
 	},
 	{
 		"",
 		"{\ndaemon +sigwinch: c\n}",
-		&Config{Blocks: []Block{{Daemons: []Daemon{{"c", syscall.SIGWINCH}}}}},
+		&Config{Blocks: []Block{{Daemons: []Daemon{{Command: "c", RestartSignal: syscall.SIGWINCH}}}}},
 	},
 }
 
 func init() {
 	parseTests = append(parseTests, parsePosixTests...)
 }
+
+func TestExpandHome(t *testing.T) {
+	home := os.Getenv("HOME")
+	defer os.Setenv("HOME", home)
+	os.Setenv("HOME", "/home/modd")
+
+	u, err := user.Current()
+	if err != nil {
+		t.Skip("no current user")
+	}
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"~/.config/**", "/home/modd/.config/**"},
+		{"~", "/home/modd"},
+		{"~" + u.Username + "/src/**", u.HomeDir + "/src/**"},
+		{"foo/~/bar", "foo/~/bar"},
+		{"src/~*.bak", "src/~*.bak"},
+		{"~*.bak", "~*.bak"},
+	}
+	for _, tt := range tests {
+		ret, err := expandHome(tt.input)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tt.input, err)
+		}
+		if ret != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.input, tt.expected, ret)
+		}
+	}
+
+	_, err = expandHome("~nosuchmodduser/**")
+	expectedErr := `unknown user "nosuchmodduser" in pattern "~nosuchmodduser/**"`
+	if err == nil || err.Error() != expectedErr {
+		t.Errorf("Expected error %q, got %v", expectedErr, err)
+	}
+
+	cnf, err := Parse("test", "~/src/** !~/src/*.tmp {}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := cnf.Blocks[0]
+	if b.Include[0] != "/home/modd/src/**" || b.Exclude[0] != "/home/modd/src/*.tmp" {
+		t.Errorf("Unexpected patterns: %v %v", b.Include, b.Exclude)
+	}
+}
@@ -1,9 +1,12 @@
 package conf
 
 import (
+	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 )
@@ -68,6 +71,33 @@ var parseTests = []struct {
 			},
 		},
 	},
+	{
+		"",
+		`**/*.go deleted:*.tmp !added,changed:tmp/** "deleted:a b" C:/foo {}`,
+		&Config{
+			Blocks: []Block{
+				{
+					Include:       []string{"**/*.go", "*.tmp", "a b", "C:/foo"},
+					Exclude:       []string{"tmp/**"},
+					IncludeEvents: map[string][]string{"*.tmp": {"deleted"}, "a b": {"deleted"}},
+					ExcludeEvents: map[string][]string{"tmp/**": {"added", "changed"}},
+				},
+			},
+		},
+	},
+	{
+		"",
+		`(?i)*.md !deleted:(?i)docs/X* {}`,
+		&Config{
+			Blocks: []Block{
+				{
+					Include:       []string{"*.[mM][dD]"},
+					Exclude:       []string{"docs/[Xx]*"},
+					ExcludeEvents: map[string][]string{"docs/[Xx]*": {"deleted"}},
+				},
+			},
+		},
+	},
 	{
 		"",
 		`!"foo" {}`,
@@ -100,6 +130,55 @@ var parseTests = []struct {
 			},
 		},
 	},
+	{
+		"",
+		`** +nohidden {}`,
+		&Config{
+			Blocks: []Block{
+				{
+					Include: []string{"**"},
+					Exclude: []string{"**/.*/**"},
+				},
+			},
+		},
+	},
+	{
+		"",
+		`src/** !vendor/** +realpath {}`,
+		&Config{
+			Blocks: []Block{
+				{
+					Include:          []string{"src/**"},
+					Exclude:          []string{"vendor/**"},
+					RealPathExcludes: true,
+				},
+			},
+		},
+	},
+	{
+		"",
+		`plugins/*/main.go +expand {}`,
+		&Config{
+			Blocks: []Block{
+				{
+					Include:    []string{"plugins/*/main.go"},
+					ExpandDirs: true,
+				},
+			},
+		},
+	},
+	{
+		"",
+		`src/ "docs//" !build/ / {}`,
+		&Config{
+			Blocks: []Block{
+				{
+					Include: []string{"src", "docs", "/"},
+					Exclude: []string{"build"},
+				},
+			},
+		},
+	},
 	{
 		"",
 		"'foo bar' voing {}",
@@ -118,7 +197,7 @@ var parseTests = []struct {
 			Blocks: []Block{
 				{
 					Include: []string{"foo"},
-					Daemons: []Daemon{{"command", syscall.SIGHUP}},
+					Daemons: []Daemon{{Command: "command", RestartSignal: syscall.SIGHUP}},
 				},
 			},
 		},
@@ -128,29 +207,49 @@ var parseTests = []struct {
 		"{\ndaemon +sighup: c\n}",
 		&Config{
 			Blocks: []Block{
-				{Daemons: []Daemon{{"c", syscall.SIGHUP}}},
+				{Daemons: []Daemon{{Command: "c", RestartSignal: syscall.SIGHUP}}},
 			},
 		},
 	},
 	{
 		"",
 		"{\ndaemon +sigterm: c\n}",
-		&Config{Blocks: []Block{{Daemons: []Daemon{{"c", syscall.SIGTERM}}}}},
+		&Config{Blocks: []Block{{Daemons: []Daemon{{Command: "c", RestartSignal: syscall.SIGTERM}}}}},
 	},
 	{
 		"",
 		"{\ndaemon +sigint: c\n}",
-		&Config{Blocks: []Block{{Daemons: []Daemon{{"c", syscall.SIGINT}}}}},
+		&Config{Blocks: []Block{{Daemons: []Daemon{{Command: "c", RestartSignal: syscall.SIGINT}}}}},
 	},
 	{
 		"",
 		"{\ndaemon +sigkill: c\n}",
-		&Config{Blocks: []Block{{Daemons: []Daemon{{"c", syscall.SIGKILL}}}}},
+		&Config{Blocks: []Block{{Daemons: []Daemon{{Command: "c", RestartSignal: syscall.SIGKILL}}}}},
 	},
 	{
 		"",
 		"{\ndaemon +sigquit: c\n}",
-		&Config{Blocks: []Block{{Daemons: []Daemon{{"c", syscall.SIGQUIT}}}}},
+		&Config{Blocks: []Block{{Daemons: []Daemon{{Command: "c", RestartSignal: syscall.SIGQUIT}}}}},
+	},
+	{
+		"",
+		"{\ndaemon +stop=sigint,5s,sigkill: c\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Daemons: []Daemon{
+						{
+							Command:       "c",
+							RestartSignal: syscall.SIGHUP,
+							StopSequence: []StopStep{
+								{syscall.SIGINT, 5 * time.Second},
+								{syscall.SIGKILL, DefaultStopWait},
+							},
+						},
+					},
+				},
+			},
+		},
 	},
 	{
 		"",
@@ -176,6 +275,112 @@ var parseTests = []struct {
 			},
 		},
 	},
+	{
+		"",
+		"foo {\nprep +changed: one\nprep +changed=quoted: two\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Include: []string{"foo"},
+					Preps: []Prep{
+						{Command: "one", Changed: "newline"},
+						{Command: "two", Changed: "quoted"},
+					},
+				},
+			},
+		},
+	},
+	{
+		"",
+		"foo {\nprep +stdin: one\nprep +stdin=nul +onchange: two\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Include: []string{"foo"},
+					Preps: []Prep{
+						{Command: "one", Stdin: "\n"},
+						{Command: "two", Onchange: true, Stdin: "\x00"},
+					},
+				},
+			},
+		},
+	},
+	{
+		"",
+		"foo {\nprep +prefix: ./bin/build --fast\nprep +prefix=lint: golint ./...\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Include: []string{"foo"},
+					Preps: []Prep{
+						{Command: "./bin/build --fast", Prefix: "build"},
+						{Command: "golint ./...", Prefix: "lint"},
+					},
+				},
+			},
+		},
+	},
+	{
+		"",
+		"foo {\nprep +match=*.sql +match=db/**: migrate\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Include: []string{"foo"},
+					Preps: []Prep{
+						{Command: "migrate", Match: []string{"*.sql", "db/**"}},
+					},
+				},
+			},
+		},
+	},
+	{
+		"",
+		"foo {\nprep +retry=2 +retrydelay=1s: make test\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Include: []string{"foo"},
+					Preps: []Prep{
+						{Command: "make test", Retry: 2, RetryDelay: time.Second},
+					},
+				},
+			},
+		},
+	},
+	{
+		"",
+		"foo {\nprep +all +stdin: gofmt -l\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Include: []string{"foo"},
+					Preps: []Prep{
+						{Command: "gofmt -l", All: true, Stdin: "\n"},
+					},
+				},
+			},
+		},
+	},
+	{
+		"",
+		"foo {\nprep: one\nonsuccess +nofail: yay\nonfailure: boo\nprep: two\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Include: []string{"foo"},
+					Preps: []Prep{
+						{
+							Command:   "one",
+							OnSuccess: &FollowUp{Command: "yay", NoFail: true},
+							OnFailure: &FollowUp{Command: "boo"},
+						},
+						{Command: "two"},
+					},
+				},
+			},
+		},
+	},
 	{
 		"",
 		"foo {\nprep: 'command\n-one\n-two'}",
@@ -207,7 +412,7 @@ var parseTests = []struct {
 			Blocks: []Block{
 				{
 					Include: []string{"foo", "bar"},
-					Preps:   []Prep{{"command", false}},
+					Preps:   []Prep{{Command: "command"}},
 				},
 			},
 		},
@@ -278,6 +483,151 @@ var parseTests = []struct {
 			},
 		},
 	},
+	{
+		"",
+		"{ cooldown: 1.5s\n }",
+		&Config{
+			Blocks: []Block{
+				{Cooldown: 1500 * time.Millisecond},
+			},
+		},
+	},
+	{
+		"",
+		"{ log +maxsize=10M: /var/log/modd.log\n }",
+		&Config{
+			Blocks: []Block{
+				{LogFile: "/var/log/modd.log", LogMaxSize: 10 << 20},
+			},
+		},
+	},
+	{
+		"",
+		"{ settle: 200ms\n }",
+		&Config{
+			Blocks: []Block{
+				{Settle: 200 * time.Millisecond},
+			},
+		},
+	},
+	{
+		"",
+		"{\nshutdown: docker stop db\nshutdown: 'rm -rf ./tmp'\n}",
+		&Config{
+			Blocks: []Block{
+				{Shutdown: []string{"docker stop db", "rm -rf ./tmp"}},
+			},
+		},
+	},
+	{
+		"",
+		"{ stable: 1s\n }",
+		&Config{
+			Blocks: []Block{
+				{Stable: time.Second},
+			},
+		},
+	},
+	{
+		"",
+		"{ grace: 3s\n }",
+		&Config{
+			Blocks: []Block{
+				{Grace: 3 * time.Second},
+			},
+		},
+	},
+	{
+		"",
+		"{ user: nobody\n }",
+		&Config{
+			Blocks: []Block{
+				{User: "nobody"},
+			},
+		},
+	},
+	{
+		"",
+		"{ user: 1000:staff\n }",
+		&Config{
+			Blocks: []Block{
+				{User: "1000:staff"},
+			},
+		},
+	},
+	{
+		"",
+		"{ quiesce: 500ms\n }",
+		&Config{
+			Blocks: []Block{
+				{Quiesce: 500 * time.Millisecond},
+			},
+		},
+	},
+	{
+		"",
+		"{ quiesce +max=5m: 1s\n }",
+		&Config{
+			Blocks: []Block{
+				{Quiesce: time.Second, QuiesceMax: 5 * time.Minute},
+			},
+		},
+	},
+	{
+		"",
+		"{ timeout: 2m\n }",
+		&Config{
+			Blocks: []Block{
+				{Timeout: 2 * time.Minute},
+			},
+		},
+	},
+	{
+		"",
+		"** !@vendored {}",
+		&Config{
+			Blocks: []Block{
+				{Include: []string{"**"}, Exclude: VendoredPatterns},
+			},
+		},
+	},
+	{
+		"",
+		"@vendored = 'a/** b/**'\n** !@vendored !c {}",
+		&Config{
+			Blocks: []Block{
+				{Include: []string{"**"}, Exclude: []string{"a/**", "b/**", "c"}},
+			},
+			variables: map[string]string{
+				"@vendored": "a/** b/**",
+			},
+		},
+	},
+	{
+		"",
+		"@go = **/*.go\n@src = @go **/*.templ\n@src !@go 'x' !'@go' {}",
+		&Config{
+			Blocks: []Block{
+				{
+					Include: []string{"**/*.go", "**/*.templ", "x"},
+					Exclude: []string{"**/*.go", "@go"},
+				},
+			},
+			variables: map[string]string{
+				"@go":  "**/*.go",
+				"@src": "@go **/*.templ",
+			},
+		},
+	},
+	{
+		"",
+		"{ events: added deleted\n }",
+		&Config{
+			Blocks: []Block{
+				{Events: []string{EventAdded, EventDeleted}},
+			},
+		},
+	},
 	{
 		"./path/to/modd.conf",
 		"",
@@ -330,11 +680,137 @@ var parseErrorTests = []struct {
 	{"foo { daemon *: foo }", "test:1: invalid syntax"},
 	{"foo { daemon +invalid: foo }", "test:1: unknown option: +invalid"},
 	{"foo { prep +invalid: foo }", "test:1: unknown option: +invalid"},
-	{"@foo bar {}", "test:1: Expected ="},
+	{"foo { prep +stdin=tab: foo }", "test:1: invalid stdin delimiter: \"tab\""},
+	{"foo { prep +changed=tab: foo }", "test:1: invalid changed format: \"tab\""},
+	{
+		"foo { prep +changed=nul: foo }",
+		"test:1: invalid changed format: \"nul\": environment variables can't hold NUL characters, use +stdin=nul instead",
+	},
+	{"foo { prep +prefix=: foo }", "test:1: +prefix= requires a label"},
+	{"foo { onsuccess: foo }", "test:1: onsuccess must follow a prep"},
+	{"foo {\nprep: foo\nonfailure: bar\nonfailure: baz\n}", "test:4: onfailure can only be used once per prep"},
+	{"foo {\nprep: foo\nonfailure +nofail: bar\n}", "test:3: unknown option: +nofail"},
+	{"foo { prep +retry=x: foo }", `test:1: invalid retry count: "x"`},
+	{"foo { prep +retry=-1: foo }", `test:1: invalid retry count: "-1"`},
+	{"foo { prep +retry=1 +retrydelay=soon: foo }", `test:1: invalid retry delay: "soon"`},
+	{"foo { prep +retrydelay=1s: foo }", "test:1: +retrydelay requires +retry"},
+	{"foo { prep +all +match=*.go: foo }", "test:1: +all can't be used with +match"},
+	{"foo { prep +match=[a: foo }", "test:1: invalid match pattern \"[a\": unterminated character class"},
+	{"foo { daemon +stop=sigfoo: foo }", "test:1: invalid stop sequence: unknown signal \"sigfoo\""},
+	{"foo { daemon +stop=5s: foo }", "test:1: invalid stop sequence: wait \"5s\" must follow a signal"},
+	{"foo { daemon +stop=sigterm,1s,2s: foo }", "test:1: invalid stop sequence: wait \"2s\" must follow a signal"},
+	{"@foo bar {}", "test:1: undefined pattern variable: @foo"},
+	{"@a = @b\n@b = x @a\n@a {}", "test:3: circular pattern variable reference: @a -> @b -> @a"},
+	{"@a = @a\n!@a {}", "test:2: circular pattern variable reference: @a -> @a"},
+	{"@a = x !y\n@a {}", "test:2: pattern variable @a: negated patterns are not allowed"},
 	{"@foo =", "test:1: unterminated variable assignment"},
 	{"@foo=bar\n@foo=bar {}", "test:2: variable @foo shadows previous declaration"},
 	{"{indir +foo: bar\n}", "test:1: indir takes no options"},
 	{"{indir: bar\nindir: voing\n}", "test:2: indir can only be used once per block"},
+	{"foo\n!'[a' {}", "test:2: invalid pattern \"[a\": unterminated character class"},
+	{"{cooldown +foo: 1s\n}", "test:1: cooldown takes no options"},
+	{"{cooldown: never\n}", "test:1: invalid cooldown: time: invalid duration \"never\""},
+	{"{cooldown: 1s\ncooldown: 2s\n}", "test:2: cooldown can only be used once per block"},
+	{"{log +maxsize=10x: /tmp/a.log\n}", "test:1: invalid size: \"10x\""},
+	{"{log +rotate: /tmp/a.log\n}", "test:1: unknown option: +rotate"},
+	{"{log: /tmp/a.log\nlog: /tmp/b.log\n}", "test:2: log can only be used once per block"},
+	{"{user +foo: nobody\n}", "test:1: user takes no options"},
+	{"{user: :staff\n}", "test:1: invalid user: \":staff\""},
+	{"{user: nobody:\n}", "test:1: invalid user: \"nobody:\""},
+	{"{user: a\nuser: b\n}", "test:2: user can only be used once per block"},
+	{"{grace: soon\n}", "test:1: invalid grace: time: invalid duration \"soon\""},
+	{"{grace: 1s\ngrace: 2s\n}", "test:2: grace can only be used once per block"},
+	{"{settle: soon\n}", "test:1: invalid settle: time: invalid duration \"soon\""},
+	{"{settle: 1s\nsettle: 2s\n}", "test:2: settle can only be used once per block"},
+	{"{stable: soon\n}", "test:1: invalid stable: time: invalid duration \"soon\""},
+	{"{stable: 1s\nstable: 2s\n}", "test:2: stable can only be used once per block"},
+	{"{quiesce: soon\n}", "test:1: invalid quiesce: time: invalid duration \"soon\""},
+	{"{quiesce +max=never: 1s\n}", "test:1: invalid quiesce maximum: \"never\""},
+	{"{quiesce +min=1s: 1s\n}", "test:1: unknown option: +min=1s"},
+	{"{quiesce: 1s\nquiesce: 2s\n}", "test:2: quiesce can only be used once per block"},
+	{"{timeout: later\n}", "test:1: invalid timeout: time: invalid duration \"later\""},
+	{"{timeout: 1s\ntimeout: 2s\n}", "test:2: timeout can only be used once per block"},
+	{"{events: added removed\n}", "test:1: unknown event type: removed"},
+	{"{events +foo: added\n}", "test:1: events takes no options"},
+	{"{shutdown +foo: true\n}", "test:1: shutdown takes no options"},
+	{"deleted: {}", "test:1: pattern \"deleted:\" has no pattern after its qualifiers"},
+	{"(?i) {}", "test:1: pattern \"(?i)\" has no pattern after its qualifiers"},
+	{"deleted:+noignore {}", "test:1: pattern qualifiers can't be used with +noignore"},
+	{"(?i)+noignore {}", "test:1: pattern qualifiers can't be used with +noignore"},
+	{"deleted:+nohidden {}", "test:1: pattern qualifiers can't be used with +nohidden"},
+	{"{events: added\nevents: deleted\n}", "test:2: events can only be used once per block"},
+}
+
+func TestParseEnv(t *testing.T) {
+	input := `
+		@root = src
+		src/** {
+			prep: shared @root
+		}
+		[dev]
+		@port = 8080
+		src/**.go {
+			daemon: serve -p @port
+		}
+		[prod]
+		@port = 80
+		src/** {
+			prep: build @root
+		}
+	`
+	commands := func(cnf *Config) []string {
+		ret := []string{}
+		for _, b := range cnf.Blocks {
+			for _, p := range b.Preps {
+				ret = append(ret, p.Command)
+			}
+			for _, d := range b.Daemons {
+				ret = append(ret, d.Command)
+			}
+		}
+		return ret
+	}
+	tests := []struct {
+		env      string
+		expected []string
+		err      string
+	}{
+		{"", []string{"shared @root"}, ""},
+		{"dev", []string{"shared @root", "serve -p @port"}, ""},
+		{"prod", []string{"shared @root", "build @root"}, ""},
+		{"staging", nil, `test: unknown environment "staging": expected one of dev, prod`},
+	}
+	for _, tt := range tests {
+		cnf, err := ParseEnv("test", input, tt.env)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: expected error %q, got %v", tt.env, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", tt.env, err)
+		}
+		if diff := cmp.Diff(tt.expected, commands(cnf)); diff != "" {
+			t.Errorf("%s: %s", tt.env, diff)
+		}
+		if tt.env != "" && cnf.GetVariables()["@port"] == "" {
+			t.Errorf("%s: expected the section's variables to be defined", tt.env)
+		}
+	}
+
+	_, err := ParseEnv("test", "** {\nprep: a\n}\n", "dev")
+	if err == nil || err.Error() != `test: unknown environment "dev": no environments are defined` {
+		t.Errorf("Expected an error for a config without sections, got %v", err)
+	}
+	_, err = ParseEnv("test", "[dev]\n** {\nprep: a\n}\n[dev]\n", "dev")
+	if err == nil || !strings.Contains(err.Error(), "section [dev] is defined more than once") {
+		t.Errorf("Expected an error for a repeated section, got %v", err)
+	}
+	_, err = ParseEnv("test", "[dev]\n** {\nprep: a\n}\n[prod]\n** {\nbogus: a\n}\n", "dev")
+	if err == nil {
+		t.Error("Expected errors in other sections to be reported")
+	}
 }
 
 func TestErrorsParse(t *testing.T) {
@@ -348,3 +824,56 @@ func TestErrorsParse(t *testing.T) {
 		}
 	}
 }
+
+var expandEnvTests = []struct {
+	input    string
+	expected string
+	err      bool
+}{
+	{"foo/**", "foo/**", false},
+	{"$MODD_TEST_DIR/**", "build/dir/**", false},
+	{"${MODD_TEST_DIR}/**", "build/dir/**", false},
+	{"a${MODD_TEST_EMPTY}b", "ab", false},
+	{"$MODD_TEST_DIR$MODD_TEST_DIR", "build/dirbuild/dir", false},
+	{"$$MODD_TEST_DIR", "$MODD_TEST_DIR", false},
+	{"foo$", "foo$", false},
+	{"foo$.txt", "foo$.txt", false},
+	{"$MODD_TEST_UNDEFINED/**", "", true},
+	{"${MODD_TEST_DIR", "", true},
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("MODD_TEST_DIR", "build/dir")
+	os.Setenv("MODD_TEST_EMPTY", "")
+	defer os.Unsetenv("MODD_TEST_DIR")
+	defer os.Unsetenv("MODD_TEST_EMPTY")
+	os.Unsetenv("MODD_TEST_UNDEFINED")
+
+	for _, tt := range expandEnvTests {
+		ret, err := expandEnv(tt.input)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: unexpected error status: %v", tt.input, err)
+		}
+		if ret != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.input, tt.expected, ret)
+		}
+	}
+
+	cnf, err := Parse("test", "$MODD_TEST_DIR/** !$MODD_TEST_DIR/*.tmp {}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Block{
+		Include: []string{"build/dir/**"},
+		Exclude: []string{"build/dir/*.tmp"},
+	}
+	if diff := cmp.Diff(cnf.Blocks[0], expected); diff != "" {
+		t.Error(diff)
+	}
+
+	_, err = Parse("test", "$MODD_TEST_UNDEFINED/** {}")
+	expectedErr := `test:1: undefined environment variable "MODD_TEST_UNDEFINED" in pattern "$MODD_TEST_UNDEFINED/**"`
+	if err == nil || err.Error() != expectedErr {
+		t.Errorf("Expected error %q, got %v", expectedErr, err)
+	}
+}
@@ -0,0 +1,116 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PatternFile is a set of include and exclude patterns loaded from a
+// structured file, referenced from a block with +from=path.
+type PatternFile struct {
+	Includes []string `json:"includes" yaml:"includes"`
+	Excludes []string `json:"excludes" yaml:"excludes"`
+}
+
+// A patternDecoder decodes a pattern file in a specific format. Decoders must
+// reject unknown fields, so that typos don't silently drop patterns.
+type patternDecoder interface {
+	Decode(data []byte, pf *PatternFile) error
+}
+
+type jsonDecoder struct{}
+
+func (jsonDecoder) Decode(data []byte, pf *PatternFile) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(pf)
+}
+
+type yamlDecoder struct{}
+
+func (yamlDecoder) Decode(data []byte, pf *PatternFile) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	return dec.Decode(pf)
+}
+
+// Decoders for pattern files, keyed by file extension
+var patternDecoders = map[string]patternDecoder{
+	".json": jsonDecoder{},
+	".yaml": yamlDecoder{},
+	".yml":  yamlDecoder{},
+}
+
+// LoadPatternFile reads a pattern file. The format is determined by the file
+// extension, which must be one of .json, .yaml or .yml.
+func LoadPatternFile(path string) (*PatternFile, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	dec, ok := patternDecoders[ext]
+	if !ok {
+		return nil, fmt.Errorf("pattern file %s: unsupported format %q", path, ext)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("pattern file %s: %s", path, err)
+	}
+	pf := &PatternFile{}
+	if err := dec.Decode(data, pf); err != nil {
+		return nil, fmt.Errorf("pattern file %s: %s", path, err)
+	}
+	for _, p := range append(pf.Includes, pf.Excludes...) {
+		if p == "" {
+			return nil, fmt.Errorf("pattern file %s: empty pattern", path)
+		}
+	}
+	return pf, nil
+}
+
+// escapePattern escapes the characters in a path that have a special meaning
+// in patterns, so that the pattern matches only the path itself
+func escapePattern(p string) string {
+	var b strings.Builder
+	for _, r := range p {
+		if strings.ContainsRune(`*?[]{}\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// LoadFileList reads a list of exact paths, one per line, and returns a
+// pattern for each that matches only that path. Blank lines are ignored.
+// Paths are cleaned, and absolute paths within the current directory are made
+// relative, to match the form of the paths modd receives from the watcher.
+func LoadFileList(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("file list %s: %s", path, err)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	ret := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		p := strings.TrimSpace(line)
+		if p == "" {
+			continue
+		}
+		p = filepath.Clean(p)
+		if filepath.IsAbs(p) {
+			if rel, err := filepath.Rel(cwd, p); err == nil && !strings.HasPrefix(rel, "..") {
+				p = rel
+			}
+		}
+		ret = append(ret, escapePattern(filepath.ToSlash(p)))
+	}
+	return ret, nil
+}
@@ -0,0 +1,261 @@
+package conf
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/cortesi/modd/utils"
+	"github.com/cortesi/moddwatch/filter"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLoadPatternFile(t *testing.T) {
+	expected := &PatternFile{
+		Includes: []string{"src/**/*.go", "cmd/**"},
+		Excludes: []string{"**/*_test.go"},
+	}
+	for _, path := range []string{"testdata/patterns.json", "testdata/patterns.yaml"} {
+		pf, err := LoadPatternFile(path)
+		if err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		if diff := cmp.Diff(pf, expected); diff != "" {
+			t.Errorf("%s: %s", path, diff)
+		}
+	}
+}
+
+var loadPatternFileErrorTests = []struct {
+	path string
+	err  string
+}{
+	{"testdata/badfield.json", `unknown field "include"`},
+	{"testdata/malformed.yml", "yaml:"},
+	{"testdata/patterns.toml", `unsupported format ".toml"`},
+	{"testdata/nonexistent.json", "no such file"},
+}
+
+func TestLoadPatternFileErrors(t *testing.T) {
+	for _, tt := range loadPatternFileErrorTests {
+		_, err := LoadPatternFile(tt.path)
+		if err == nil {
+			t.Errorf("%s: expected error", tt.path)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), "pattern file "+tt.path+": ") {
+			t.Errorf("%s: error does not name the file: %s", tt.path, err)
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: expected error containing %q, got %q", tt.path, tt.err, err)
+		}
+	}
+}
+
+func TestParsePatternFile(t *testing.T) {
+	expected := Block{
+		Include: []string{"docs/**", "src/**/*.go", "cmd/**"},
+		Exclude: []string{"**/*_test.go", "**/*.tmp"},
+	}
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"", "docs/** +from=testdata/patterns.json !**/*.tmp {}"},
+		{"testdata/modd.conf", "docs/** +from=patterns.yaml !**/*.tmp {}"},
+	}
+	for _, tt := range tests {
+		cnf, err := Parse(tt.name, tt.input)
+		if err != nil {
+			t.Fatalf("%q: %s", tt.input, err)
+		}
+		if diff := cmp.Diff(cnf.Blocks[0], expected); diff != "" {
+			t.Errorf("%q: %s", tt.input, diff)
+		}
+	}
+
+	_, err := Parse("test", "+from= {}")
+	if err == nil || err.Error() != "test:1: +from= requires a file path" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestLoadFileList(t *testing.T) {
+	ret, err := LoadFileList("testdata/files.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"src/main.go", "lib/util.go", `weird\[1\].txt`}
+	if diff := cmp.Diff(ret, expected); diff != "" {
+		t.Error(diff)
+	}
+	for _, p := range ret {
+		if err := ValidatePattern(p); err != nil {
+			t.Errorf("%q: %s", p, err)
+		}
+	}
+
+	_, err = LoadFileList("testdata/nonexistent.txt")
+	if err == nil || !strings.Contains(err.Error(), "no such file") {
+		t.Errorf("Expected a missing file error, got %v", err)
+	}
+}
+
+func TestLoadGitAttributes(t *testing.T) {
+	tests := []struct {
+		attr     string
+		expected []string
+	}{
+		{
+			"linguist-generated",
+			[]string{
+				"**/*.pb.go",
+				"api/schema.json",
+				"docs/**/*.html",
+				"**/name with spaces.go",
+				`**/\{braces\}.go`,
+			},
+		},
+		{"diff", []string{}},
+		{"eol", []string{"**/*.sh"}},
+		{"nonexistent", []string{}},
+	}
+	for _, tt := range tests {
+		ret, err := LoadGitAttributes("testdata/gitattributes", tt.attr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(tt.expected, ret); diff != "" {
+			t.Errorf("%s: %s", tt.attr, diff)
+		}
+	}
+}
+
+func TestGitAttributesMatching(t *testing.T) {
+	excludes, err := LoadGitAttributes("testdata/gitattributes", "linguist-generated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []string{
+		"foo.pb.go", "a/b/foo.pb.go", "foo.go", "api/schema.json",
+		"a/api/schema.json", "docs/x/index.html", "readme.txt",
+	}
+	ret, err := filter.Files(files, []string{"**"}, excludes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"foo.go", "a/api/schema.json", "readme.txt"}
+	if diff := cmp.Diff(expected, ret); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestParseGitAttributes(t *testing.T) {
+	cnf, err := Parse("testdata/attrs/modd.conf", "** +gitattributes=linguist-generated {\nprep: true\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cnf.Blocks[0].Exclude) != 2 || cnf.Blocks[0].Exclude[0] != "**/*.pb.go" {
+		t.Errorf("Unexpected excludes: %#v", cnf.Blocks[0].Exclude)
+	}
+	_, err = Parse("testdata/attrs/modd.conf", "** +gitattributes= {\nprep: true\n}")
+	if err == nil || !strings.Contains(err.Error(), "+gitattributes= requires an attribute name") {
+		t.Errorf("Expected an error for a missing attribute, got %v", err)
+	}
+	_, err = Parse("modd.conf", "** +gitattributes=linguist-generated {\nprep: true\n}")
+	if err == nil || !strings.Contains(err.Error(), "gitattributes .gitattributes:") {
+		t.Errorf("Expected an error for a missing file, got %v", err)
+	}
+}
+
+func writeFile(t *testing.T, path string, data string) {
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadIgnoreFile(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	writeFile(t, "ignore", strings.Join([]string{
+		"# comment",
+		"",
+		"*.log",
+		"/coverage",
+		"tmp/",
+		"docs/*.md  ",
+		"!keep.log",
+		`\#notes`,
+		"{x}.js",
+	}, "\n"))
+	ret, err := LoadIgnoreFile("ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"**/*.log", "**/*.log/**",
+		"coverage", "coverage/**",
+		"**/tmp/**",
+		"docs/*.md", "docs/*.md/**",
+		"**/#notes", "**/#notes/**",
+		`**/\{x\}.js`, `**/\{x\}.js/**`,
+	}
+	if diff := cmp.Diff(expected, ret); diff != "" {
+		t.Error(diff)
+	}
+
+	files := []string{
+		"a.log", "src/b.log", "coverage/index.html", "src/coverage",
+		"tmp/x", "src/tmp/y", "tmp.js", "docs/a.md", "docs/x/a.md",
+	}
+	ret, err = filter.Files(files, []string{"**"}, ret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"src/coverage", "tmp.js", "docs/x/a.md"}
+	if diff := cmp.Diff(expected, ret); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestLoadNpmIgnore(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	ret, err := LoadNpmIgnore(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ret) != 0 {
+		t.Errorf("Expected no excludes without ignore files, got %#v", ret)
+	}
+
+	writeFile(t, ".gitignore", "dist/\n")
+	ret, err = LoadNpmIgnore(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"**/dist/**"}, ret); diff != "" {
+		t.Errorf(".gitignore fallback: %s", diff)
+	}
+
+	// .npmignore takes precedence, and .gitignore is then not read at all
+	writeFile(t, ".npmignore", "test/\n")
+	ret, err = LoadNpmIgnore(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"**/test/**"}, ret); diff != "" {
+		t.Errorf(".npmignore: %s", diff)
+	}
+}
+
+func TestParseNpmIgnore(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	writeFile(t, ".gitignore", "node_modules/\n")
+	cnf, err := Parse("modd.conf", "** +npmignore {\nprep: true\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cnf.Blocks[0].Exclude) != 1 || cnf.Blocks[0].Exclude[0] != "**/node_modules/**" {
+		t.Errorf("Unexpected excludes: %#v", cnf.Blocks[0].Exclude)
+	}
+}
@@ -0,0 +1,380 @@
+package conf
+
+import (
+	"fmt"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The pattern variable that expands to VendoredPatterns unless it is declared
+const vendoredKeyword = "@vendored"
+
+// VendoredPatterns is the set of patterns that the !@vendored exclude keyword
+// expands to: dependency, VCS, and build output directories. The expansion
+// can be overridden by declaring an @vendored pattern variable.
+var VendoredPatterns = []string{
+	"**/node_modules/**",
+	"**/vendor/**",
+	"**/.git/**",
+	"**/target/**",
+	"**/__pycache__/**",
+	"**/dist/**",
+	"**/build/**",
+}
+
+// TrimSeparators removes trailing separators from a pattern, so that a
+// pattern written as a directory, like "a/b/", matches the directory path the
+// watcher reports. The root pattern "/" is left alone.
+func TrimSeparators(pattern string) string {
+	if trimmed := strings.TrimRight(pattern, "/"); trimmed != "" {
+		return trimmed
+	}
+	return pattern
+}
+
+// Whether backslashes in patterns are path separators rather than escapes
+var backslashSeparators = runtime.GOOS == "windows"
+
+// SlashPattern converts backslashes in a pattern to forward slashes on
+// Windows, so that patterns can be written with native separators, like
+// "src\**\*.go". Special characters can then be matched literally with a
+// character class, like "[*]". Elsewhere a backslash escapes the character
+// after it, and the pattern is returned unchanged.
+func SlashPattern(pattern string) string {
+	if !backslashSeparators {
+		return pattern
+	}
+	return strings.Replace(pattern, `\`, "/", -1)
+}
+
+// ValidatePattern checks a file pattern for syntax errors. Pattern matching
+// itself only detects malformed patterns lazily, when a path reaches the bad
+// part of the pattern, so a broken pattern would otherwise silently never
+// match.
+func ValidatePattern(pattern string) error {
+	braces := 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+			if i == len(pattern) {
+				return fmt.Errorf("trailing backslash")
+			}
+		case '[':
+			end := classEnd(pattern[i+1:])
+			if end < 0 {
+				return fmt.Errorf("unterminated character class")
+			} else if end == 0 {
+				return fmt.Errorf("empty character class")
+			}
+			i += end + 1
+		case '{':
+			braces++
+		case '}':
+			if braces == 0 {
+				return fmt.Errorf("unbalanced }")
+			}
+			braces--
+		}
+	}
+	if braces > 0 {
+		return fmt.Errorf("unterminated {")
+	}
+	return nil
+}
+
+// classEnd returns the offset of the ] terminating a character class, given
+// the text following the opening [. It returns -1 if the class is
+// unterminated.
+func classEnd(s string) int {
+	start := 0
+	if strings.HasPrefix(s, "^") {
+		start = 1
+	}
+	for i := start; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case ']':
+			if i == start {
+				return 0
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+// The prefix that makes a pattern match without regard to case
+const caseFlag = "(?i)"
+
+// otherCase returns the opposite case of a letter, or 0 if r is not a letter
+// with two cases. Folding goes one rune at a time, using Go's
+// language-independent Unicode mappings: the upper case of a letter if it has
+// one, and its lower case otherwise. Letters whose case changes the number of
+// runes, like ß, have no opposite case, and no language-specific rules
+// apply, so Turkish İ pairs with i and ı with I, as unicode.ToLower and
+// unicode.ToUpper map them.
+func otherCase(r rune) rune {
+	if u := unicode.ToUpper(r); u != r {
+		return u
+	}
+	if l := unicode.ToLower(r); l != r {
+		return l
+	}
+	return 0
+}
+
+// foldClass adds the opposite case of every letter and letter range to the
+// body of a character class
+func foldClass(body string) string {
+	extra := []rune{}
+	runes := []rune(body)
+	i := 0
+	if len(runes) > 0 && runes[0] == '^' {
+		i = 1
+	}
+	for ; i < len(runes); i++ {
+		if runes[i] == '\\' {
+			i++
+			if i < len(runes) {
+				if o := otherCase(runes[i]); o != 0 {
+					extra = append(extra, o)
+				}
+			}
+			continue
+		}
+		if i+2 < len(runes) && runes[i+1] == '-' {
+			lo, hi := otherCase(runes[i]), otherCase(runes[i+2])
+			if lo != 0 && hi != 0 && unicode.IsUpper(runes[i]) == unicode.IsUpper(runes[i+2]) {
+				extra = append(extra, lo, '-', hi)
+			}
+			i += 2
+			continue
+		}
+		if o := otherCase(runes[i]); o != 0 {
+			extra = append(extra, o)
+		}
+	}
+	return body + string(extra)
+}
+
+// FoldCase rewrites a pattern to match without regard to case, by replacing
+// each letter with a character class matching both of its cases. Leading
+// directories that contain no special characters are left as they are, so
+// that the directories watched for the pattern don't change.
+func FoldCase(pattern string) string {
+	var b strings.Builder
+	rest := pattern
+	for {
+		i := strings.Index(rest, "/")
+		if i < 0 || strings.ContainsAny(rest[:i], patternSpecial) {
+			break
+		}
+		b.WriteString(rest[:i+1])
+		rest = rest[i+1:]
+	}
+	for i := 0; i < len(rest); {
+		r, size := utf8.DecodeRuneInString(rest[i:])
+		switch {
+		case r == '\\' && i+size < len(rest):
+			next, nsize := utf8.DecodeRuneInString(rest[i+size:])
+			if o := otherCase(next); o != 0 {
+				fmt.Fprintf(&b, "[%c%c]", next, o)
+			} else {
+				b.WriteString(rest[i : i+size+nsize])
+			}
+			size += nsize
+		case r == '[' && classEnd(rest[i+1:]) > 0:
+			end := classEnd(rest[i+1:])
+			b.WriteString("[" + foldClass(rest[i+1:i+1+end]) + "]")
+			size = end + 2
+		case otherCase(r) != 0:
+			fmt.Fprintf(&b, "[%c%c]", r, otherCase(r))
+		default:
+			b.WriteString(rest[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// braceEnd returns the offset of the } closing a brace group and the offsets
+// of its top-level commas, given the text following the opening {. It returns
+// -1 if the group is unterminated.
+func braceEnd(s string) (int, []int) {
+	depth := 0
+	commas := []int{}
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '[':
+			if end := classEnd(s[i+1:]); end > 0 {
+				i += end + 1
+			}
+		case '{':
+			depth++
+		case '}':
+			if depth == 0 {
+				return i, commas
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				commas = append(commas, i)
+			}
+		}
+	}
+	return -1, nil
+}
+
+// expandAlternatives expands brace groups that come before any other
+// wildcard into separate patterns, so that "{src,test}/**/*.go" becomes
+// "src/**/*.go" and "test/**/*.go". The expanded patterns match the same
+// paths, but have literal leading directories, so only those directories
+// have to be watched rather than everything under the common parent. Brace
+// groups after a wildcard are left as they are.
+func expandAlternatives(pattern string) []string {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '*', '?', '[':
+			return []string{pattern}
+		case '{':
+			end, commas := braceEnd(pattern[i+1:])
+			if end < 0 {
+				return []string{pattern}
+			}
+			prefix, body, suffix := pattern[:i], pattern[i+1:i+1+end], pattern[i+2+end:]
+			ret := []string{}
+			seen := map[string]bool{}
+			start := 0
+			for _, c := range append(commas, end) {
+				for _, e := range expandAlternatives(prefix + body[start:c] + suffix) {
+					if !seen[e] {
+						seen[e] = true
+						ret = append(ret, e)
+					}
+				}
+				start = c + 1
+			}
+			return ret
+		}
+	}
+	return []string{pattern}
+}
+
+// NormalizePattern cleans redundant components from a pattern, so that, for
+// example, "./src//*.go" becomes "src/*.go". Normalization is only used to
+// compare patterns - patterns are matched as written.
+func NormalizePattern(pattern string) string {
+	if pattern == "" {
+		return pattern
+	}
+	return path.Clean(pattern)
+}
+
+// normalizeSet normalizes a list of patterns, and returns them sorted with
+// duplicates removed.
+func normalizeSet(patterns []string) []string {
+	seen := map[string]bool{}
+	ret := []string{}
+	for _, p := range patterns {
+		p = NormalizePattern(p)
+		if !seen[p] {
+			seen[p] = true
+			ret = append(ret, p)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// PatternsEqual checks whether two sets of include and exclude patterns are
+// equivalent. Each list is normalized with NormalizePattern, de-duplicated and
+// sorted before comparison, so the order of patterns and repeated patterns
+// don't matter.
+func PatternsEqual(aInc, aEx, bInc, bEx []string) bool {
+	return stringsEqual(normalizeSet(aInc), normalizeSet(bInc)) &&
+		stringsEqual(normalizeSet(aEx), normalizeSet(bEx))
+}
+
+// Characters with a special meaning in patterns
+const patternSpecial = `*?[]{}\`
+
+// subsumes reports whether every path matching q also matches p, for the
+// cases described in MinimizePatterns
+func subsumes(p, q string) bool {
+	if p == q {
+		return false
+	}
+	if p == "**" {
+		return true
+	}
+	if dir := strings.TrimSuffix(p, "/**"); dir != p && dir != "" {
+		if !strings.ContainsAny(dir, patternSpecial) && strings.HasPrefix(q, dir+"/") {
+			return true
+		}
+	}
+	if name := strings.TrimPrefix(p, "**/"); name != p {
+		if name == "" || strings.Contains(name, "/") || strings.Contains(name, "**") {
+			return false
+		}
+		prefix := ""
+		if i := strings.LastIndex(q, "/"); i >= 0 {
+			prefix, q = q[:i], q[i+1:]
+		}
+		// Braces and classes in the prefix could hide the last slash
+		return q == name && !strings.ContainsAny(prefix, "[]{}")
+	}
+	return false
+}
+
+// MinimizePatterns removes include patterns that are subsumed by other
+// patterns in the list, so that the remaining patterns match exactly the same
+// paths. The analysis is conservative, and only detects these cases:
+//
+//   - Exact duplicates, of which the first is kept
+//   - "**", which subsumes all other patterns
+//   - "dir/**", where dir has no wildcards, which subsumes all patterns that
+//     start with "dir/"
+//   - "**/name", where name is a single path segment, which subsumes all
+//     patterns whose last path segment is name, such as "*.go" and
+//     "src/*.go" for "**/*.go"
+//
+// Patterns are compared as written, so "./a" and "a" are distinct. The order
+// of the remaining patterns is preserved.
+func MinimizePatterns(patterns []string) []string {
+	ret := []string{}
+	for i, q := range patterns {
+		redundant := false
+		for j, p := range patterns {
+			if (p == q && j < i) || subsumes(p, q) {
+				redundant = true
+				break
+			}
+		}
+		if !redundant {
+			ret = append(ret, q)
+		}
+	}
+	return ret
+}
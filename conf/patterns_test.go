@@ -0,0 +1,263 @@
+package conf
+
+import (
+	"testing"
+
+	"github.com/cortesi/moddwatch/filter"
+	"github.com/google/go-cmp/cmp"
+)
+
+var validatePatternTests = []struct {
+	pattern string
+	err     string
+}{
+	{"**/*.go", ""},
+	{"a/[abc]/*", ""},
+	{"a/[^abc]", ""},
+	{"a/[\\]]", ""},
+	{"{a,b}/**", ""},
+	{"{a,{b,c}}", ""},
+	{"foo\\*", ""},
+	{"[", "unterminated character class"},
+	{"a/[abc", "unterminated character class"},
+	{"a/[]", "empty character class"},
+	{"a/[^]", "empty character class"},
+	{"{a,b", "unterminated {"},
+	{"a,b}", "unbalanced }"},
+	{"foo\\", "trailing backslash"},
+}
+
+func TestValidatePattern(t *testing.T) {
+	for _, tt := range validatePatternTests {
+		err := ValidatePattern(tt.pattern)
+		if tt.err == "" && err != nil {
+			t.Errorf("%q: unexpected error: %s", tt.pattern, err)
+		} else if tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("%q: expected error %q, got %v", tt.pattern, tt.err, err)
+		}
+	}
+}
+
+var patternsEqualTests = []struct {
+	aInc, aEx, bInc, bEx []string
+	equal                bool
+}{
+	{[]string{"a", "b"}, nil, []string{"b", "a"}, nil, true},
+	{[]string{"./a"}, nil, []string{"a"}, nil, true},
+	{[]string{"a", "a"}, nil, []string{"a"}, nil, true},
+	{[]string{"src//**/*.go"}, []string{"./x"}, []string{"src/**/*.go"}, []string{"x"}, true},
+	{nil, nil, []string{}, []string{}, true},
+	{[]string{"a"}, nil, []string{"a", "b"}, nil, false},
+	{[]string{"a"}, []string{"b"}, []string{"a"}, nil, false},
+	{[]string{"a"}, nil, nil, []string{"a"}, false},
+}
+
+func TestPatternsEqual(t *testing.T) {
+	for i, tt := range patternsEqualTests {
+		if ret := PatternsEqual(tt.aInc, tt.aEx, tt.bInc, tt.bEx); ret != tt.equal {
+			t.Errorf("%d: expected %v, got %v", i, tt.equal, ret)
+		}
+	}
+}
+
+var minimizePatternsTests = []struct {
+	patterns []string
+	expected []string
+}{
+	{[]string{}, []string{}},
+	{[]string{"a", "b"}, []string{"a", "b"}},
+	{[]string{"a", "b", "a"}, []string{"a", "b"}},
+	{[]string{"**/*.go", "**", "/abs/x"}, []string{"**"}},
+	{[]string{"**", "**"}, []string{"**"}},
+	{[]string{"src/*.go", "src/**", "src/a/**/*.go", "srcx/a"}, []string{"src/**", "srcx/a"}},
+	{[]string{"src/**", "src"}, []string{"src/**", "src"}},
+	{[]string{"s*c/**", "src/a"}, []string{"s*c/**", "src/a"}},
+	{[]string{"*.go", "**/*.go", "src/*.go", "a/**/*.go"}, []string{"**/*.go"}},
+	{[]string{"**/*.go", "src/*.gox", "main.go"}, []string{"**/*.go", "src/*.gox", "main.go"}},
+	{[]string{"**/*.go", "{a/b,c}/*.go", "[ab]/*.go"}, []string{"**/*.go", "{a/b,c}/*.go", "[ab]/*.go"}},
+	{[]string{"./a", "a"}, []string{"./a", "a"}},
+	{[]string{"**/a/b", "x/a/b"}, []string{"**/a/b", "x/a/b"}},
+}
+
+func TestMinimizePatterns(t *testing.T) {
+	for _, tt := range minimizePatternsTests {
+		ret := MinimizePatterns(tt.patterns)
+		if diff := cmp.Diff(tt.expected, ret); diff != "" {
+			t.Errorf("%v: %s", tt.patterns, diff)
+		}
+	}
+}
+
+var foldCaseTests = []struct {
+	pattern  string
+	expected string
+}{
+	{"*.md", "*.[mM][dD]"},
+	{"README", "[Rr][Ee][Aa][Dd][Mm][Ee]"},
+	{"docs/src/*.Go", "docs/src/*.[Gg][oO]"},
+	{"docs/**/a", "docs/**/[aA]"},
+	{"d*cs/a", "[dD]*[cC][sS]/[aA]"},
+	{"[a-c]x", "[a-cA-C][xX]"},
+	{"[^Q]", "[^Qq]"},
+	{"[0-9_]", "[0-9_]"},
+	{`\*\a`, `\*[aA]`},
+	{"{foo,Bar}", "{[fF][oO][oO],[Bb][aA][rR]}"},
+	{"é", "[éÉ]"},
+	{"İ", "[İi]"},
+	{"ı", "[ıI]"},
+	{"ß", "ß"},
+}
+
+func TestFoldCase(t *testing.T) {
+	for _, tt := range foldCaseTests {
+		if ret := FoldCase(tt.pattern); ret != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.pattern, tt.expected, ret)
+		}
+		if err := ValidatePattern(FoldCase(tt.pattern)); err != nil {
+			t.Errorf("%q: invalid folded pattern: %s", tt.pattern, err)
+		}
+	}
+}
+
+func TestCaseFlagMatching(t *testing.T) {
+	cnf, err := Parse("test", "(?i)**/*.md **/*.TXT !(?i)**/draft* {}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := cnf.Blocks[0]
+	files := []string{
+		"a.md", "b.MD", "docs/c.Md",
+		"d.TXT", "e.txt",
+		"Draft.md", "docs/DRAFT.TXT",
+	}
+	ret, err := filter.Files(files, b.Include, b.Exclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"a.md", "b.MD", "docs/c.Md", "d.TXT"}
+	if diff := cmp.Diff(expected, ret); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestFoldCaseTurkish(t *testing.T) {
+	files := []string{"i.go", "I.go", "İ.go", "ı.go"}
+	expected := map[string][]string{
+		"i.go": {"i.go", "I.go"},
+		"I.go": {"i.go", "I.go"},
+		// İ lowercases to i, but no letter uppercases to İ
+		"İ.go": {"i.go", "İ.go"},
+		// ı uppercases to I, but I lowercases to i
+		"ı.go": {"I.go", "ı.go"},
+	}
+	for pattern, want := range expected {
+		ret, err := filter.Files(files, []string{FoldCase(pattern)}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, ret); diff != "" {
+			t.Errorf("%q: %s", pattern, diff)
+		}
+	}
+}
+
+var expandAlternativesTests = []struct {
+	pattern  string
+	expected []string
+}{
+	{"{src,test}/**/*.go", []string{"src/**/*.go", "test/**/*.go"}},
+	{"a/{b,c/d}/*", []string{"a/b/*", "a/c/d/*"}},
+	{"{a,{b,c}}/x", []string{"a/x", "b/x", "c/x"}},
+	{"{a,b}/{c,d}", []string{"a/c", "a/d", "b/c", "b/d"}},
+	{"{a,a}/x", []string{"a/x"}},
+	{"**/*.{go,js}", []string{"**/*.{go,js}"}},
+	{"src/*/{a,b}", []string{"src/*/{a,b}"}},
+	{"\\{a,b}/x", []string{"\\{a,b}/x"}},
+	{"plain/path", []string{"plain/path"}},
+}
+
+func TestExpandAlternatives(t *testing.T) {
+	for _, tt := range expandAlternativesTests {
+		if diff := cmp.Diff(tt.expected, expandAlternatives(tt.pattern)); diff != "" {
+			t.Errorf("%q: %s", tt.pattern, diff)
+		}
+	}
+}
+
+func TestAlternativesMatching(t *testing.T) {
+	cnf, err := Parse("test", `"{src,test}/**/*.go" "(?i){Docs,notes}/*.md" {}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := cnf.Blocks[0]
+	expected := []string{"src/**/*.go", "test/**/*.go", "Docs/*.[mM][dD]", "notes/*.[mM][dD]"}
+	if diff := cmp.Diff(expected, b.Include); diff != "" {
+		t.Fatal(diff)
+	}
+	files := []string{"src/a.go", "test/b/c.go", "other/d.go", "Docs/e.MD", "notes/f.md", "docs/g.md"}
+	ret, err := filter.Files(files, b.Include, b.Exclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"src/a.go", "test/b/c.go", "Docs/e.MD", "notes/f.md"}
+	if diff := cmp.Diff(expected, ret); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestNoHiddenMatching(t *testing.T) {
+	// +noignore makes sure the default ignore list isn't what skips .git
+	cnf, err := Parse("test", "** +nohidden +noignore {}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := cnf.Blocks[0]
+	files := []string{
+		".git/HEAD", ".env", "src/.eslintrc", "src/.cache/x.js",
+		"a/.b/c/d.go", "main.go", "/abs/.hidden/x",
+	}
+	ret, err := filter.Files(files, b.Include, b.Exclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{".env", "src/.eslintrc", "main.go"}
+	if diff := cmp.Diff(expected, ret); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestSlashPattern(t *testing.T) {
+	defer func(v bool) { backslashSeparators = v }(backslashSeparators)
+
+	backslashSeparators = false
+	if ret := SlashPattern(`a\*b`); ret != `a\*b` {
+		t.Errorf("Expected backslashes to be kept, got %q", ret)
+	}
+
+	backslashSeparators = true
+	if ret := SlashPattern(`src\**\*.go`); ret != "src/**/*.go" {
+		t.Errorf("Expected backslashes to be converted, got %q", ret)
+	}
+	cnf, err := Parse("test", `src\**\*.go !src\vendor\** !**\[*].go +noignore {
+		prep +match=src\cmd\*.go: true
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := cnf.Blocks[0]
+	files := []string{
+		"src/main.go", "src/a/b.go", "src/vendor/x.go", "src/*.go",
+		"src/a.txt", "other/c.go",
+	}
+	ret, err := filter.Files(files, b.Include, b.Exclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"src/main.go", "src/a/b.go"}
+	if diff := cmp.Diff(expected, ret); diff != "" {
+		t.Error(diff)
+	}
+	if diff := cmp.Diff([]string{"src/cmd/*.go"}, b.Preps[0].Match); diff != "" {
+		t.Error(diff)
+	}
+}
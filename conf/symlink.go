@@ -0,0 +1,205 @@
+package conf
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/cortesi/moddwatch/filter"
+)
+
+// Characters that start the glob portion of a pattern
+const globStart = "*?[{\\"
+
+// splitPattern splits a pattern into its directory portion, which has no
+// glob characters, and the rest, which starts with a separator if it isn't
+// empty. Patterns without glob characters are all directory. The directory is
+// empty if the pattern starts with a glob in its first path element.
+func splitPattern(pattern string) (string, string) {
+	i := strings.IndexAny(pattern, globStart)
+	if i < 0 {
+		return pattern, ""
+	}
+	j := strings.LastIndex(pattern[:i], "/")
+	if j < 0 {
+		return "", pattern
+	}
+	return pattern[:j], pattern[j:]
+}
+
+// RealPattern rewrites a pattern whose directory portion passes through a
+// symlink to refer to the symlink's target instead, so that the target is
+// watched, and events reported on it match the pattern. Relative patterns are
+// taken to be relative to root, and targets inside root are made relative to
+// it. Patterns with no symlinks, or whose directories don't exist, are
+// returned as AbsPattern returns them. Patterns without glob characters are
+// resolved in full, since they name a single path.
+func RealPattern(root string, pattern string) string {
+	dir, rest := splitPattern(pattern)
+	if dir == "" {
+		return pattern
+	}
+	abs := filepath.FromSlash(dir)
+	if !filepath.IsAbs(abs) {
+		abs = filepath.Join(root, abs)
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if err != nil || real == filepath.Clean(abs) {
+		return AbsPattern(root, pattern)
+	}
+	if rel, err := filepath.Rel(root, real); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		if rel == "." && rest != "" {
+			return rest[1:]
+		}
+		real = rel
+	}
+	return path.Clean(filepath.ToSlash(real)) + rest
+}
+
+// AbsPattern makes a relative pattern whose directory lies outside root, like
+// "../shared/**", absolute, since the watcher reports paths outside root as
+// absolute paths. Other patterns are returned unchanged.
+func AbsPattern(root string, pattern string) string {
+	dir, rest := splitPattern(pattern)
+	if dir == "" || path.IsAbs(dir) || filepath.IsAbs(filepath.FromSlash(dir)) {
+		return pattern
+	}
+	if clean := path.Clean(dir); clean != ".." && !strings.HasPrefix(clean, "../") {
+		return pattern
+	}
+	return filepath.ToSlash(filepath.Join(root, filepath.FromSlash(dir))) + rest
+}
+
+// BasePath returns the directory portion of a pattern that precedes any glob
+// characters. This is the directory that has to be watched for the pattern.
+// The result is cleaned, so ".." segments are resolved as far as possible, and
+// a pattern like "../shared/**" has the base "../shared".
+func BasePath(pattern string) string {
+	i := strings.IndexAny(pattern, globStart)
+	if i < 0 {
+		return path.Dir(pattern)
+	}
+	return path.Dir(pattern[:i] + "x")
+}
+
+// BasePaths returns the distinct base paths of a list of patterns, in order
+func BasePaths(patterns []string) []string {
+	var ret []string
+	seen := map[string]bool{}
+	for _, p := range patterns {
+		base := BasePath(p)
+		if !seen[base] {
+			seen[base] = true
+			ret = append(ret, base)
+		}
+	}
+	return ret
+}
+
+// ExpandDirs expands the single-star directory levels of a pattern into the
+// directories that exist under root, so that "plugins/*/main.go" becomes
+// "plugins/a/main.go" and "plugins/b/main.go". Levels from the first "**" on,
+// and the final path element, are left as they are. The directories that were
+// listed are returned too, since a directory added to one of them changes the
+// expansion. A pattern with no glob characters in its directory levels is
+// returned unchanged.
+func ExpandDirs(root, pattern string) ([]string, []string) {
+	dir, file := path.Split(pattern)
+	parts := strings.Split(strings.TrimSuffix(dir, "/"), "/")
+	n := 0
+	for n < len(parts) && parts[n] != "**" {
+		n++
+	}
+	if dir == "" || !strings.ContainsAny(strings.Join(parts[:n], "/"), globStart) {
+		return []string{pattern}, nil
+	}
+	listed := []string{}
+	prefixes := []string{""}
+	for _, part := range parts[:n] {
+		if !strings.ContainsAny(part, globStart) {
+			for i := range prefixes {
+				prefixes[i] += part + "/"
+			}
+			continue
+		}
+		next := []string{}
+		for _, pre := range prefixes {
+			d := path.Clean(pre)
+			listed = append(listed, d)
+			full := d
+			if !path.IsAbs(d) {
+				full = filepath.Join(root, d)
+			}
+			entries, err := ioutil.ReadDir(full)
+			if err != nil {
+				continue
+			}
+			for _, e := range entries {
+				if !e.IsDir() {
+					continue
+				}
+				if ok, _ := filter.MatchAny(e.Name(), []string{part}); ok {
+					next = append(next, pre+e.Name()+"/")
+				}
+			}
+		}
+		prefixes = next
+	}
+	rest := strings.Join(append(parts[n:], file), "/")
+	ret := make([]string, len(prefixes))
+	for i, pre := range prefixes {
+		ret[i] = pre + rest
+	}
+	return ret, listed
+}
+
+// FullyExcluded checks whether every path under a base path is excluded by
+// one of the exclude patterns, so that the base path needn't be watched at
+// all. Only excludes of the form "dir/**", with no glob characters in dir,
+// are considered, and the base path must be dir or lie under it. Excludes
+// like "*.log" or "**/tmp/**" leave some paths under any base path, so they
+// never exclude one entirely.
+func FullyExcluded(base string, excludes []string) bool {
+	base = path.Clean(base)
+	for _, e := range excludes {
+		dir := strings.TrimSuffix(e, "/**")
+		if dir == e || dir == "" || strings.ContainsAny(dir, globStart) {
+			continue
+		}
+		dir = path.Clean(dir)
+		if base == dir || strings.HasPrefix(base, strings.TrimSuffix(dir, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// RealPaths returns a copy of the block with its include and exclude patterns
+// rewritten by RealPattern
+func (b Block) RealPaths(root string) Block {
+	return b.Rewrite(func(p string) string { return RealPattern(root, p) })
+}
+
+// RealExcluded checks whether a path is excluded once the symlinks it passes
+// through are resolved. The path, taken to be relative to root if it isn't
+// absolute, is resolved with filepath.EvalSymlinks, made relative to the real
+// root if it lies under it, and matched against the excludes. Paths that
+// can't be resolved, like those of deleted files, are never excluded.
+func RealExcluded(root string, p string, excludes []string) (bool, error) {
+	abs := filepath.FromSlash(p)
+	if !filepath.IsAbs(abs) {
+		abs = filepath.Join(root, abs)
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return false, nil
+	}
+	if r, err := filepath.EvalSymlinks(root); err == nil {
+		root = r
+	}
+	if rel, err := filepath.Rel(root, real); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		real = rel
+	}
+	return MatchAny(filepath.ToSlash(real), excludes)
+}
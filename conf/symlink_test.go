@@ -0,0 +1,146 @@
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/cortesi/modd/utils"
+)
+
+func TestRealPattern(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping - symlinks need special privileges on Windows")
+	}
+	outside, err := filepath.EvalSymlinks(os.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.WithTempDir(t)()
+	for _, d := range []string{"real/sub", "other"} {
+		if err := os.MkdirAll(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, l := range [][2]string{
+		{"real", "link"},
+		{"../real", "other/link"},
+		{outside, "out"},
+	} {
+		if err := os.Symlink(l[0], l[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err := filepath.EvalSymlinks(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		pattern  string
+		expected string
+	}{
+		{"link/**", "real/**"},
+		{"link/sub/*.go", "real/sub/*.go"},
+		{"link/**/*.go", "real/**/*.go"},
+		{"other/link/**", "real/**"},
+		{"link", "real"},
+		{"link/sub", "real/sub"},
+		{"out/**", filepath.ToSlash(outside) + "/**"},
+		{"real/**", "real/**"},
+		{"**/*.go", "**/*.go"},
+		{"missing/**", "missing/**"},
+		{"link/missing/**", "link/missing/**"},
+	}
+	for _, tt := range tests {
+		if ret := RealPattern(root, tt.pattern); ret != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.pattern, tt.expected, ret)
+		}
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	tests := map[string]string{
+		"**/*.go":       ".",
+		"src/**":        "src",
+		"src/foo.go":    "src",
+		"a/b*/c":        "a",
+		"/abs/dir/*.js": "/abs/dir",
+		"foo":           ".",
+		"../shared/**":  "../shared",
+		"../../x/*.go":  "../../x",
+		"./../a/./b/*":  "../a/b",
+		"a/../../b/**":  "../b",
+		"a/b/../*.go":   "a",
+	}
+	for pattern, expected := range tests {
+		if ret := BasePath(pattern); ret != expected {
+			t.Errorf("%s: expected %q, got %q", pattern, expected, ret)
+		}
+	}
+}
+
+func TestExpandDirs(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	for _, d := range []string{"plugins/a", "plugins/b/x", "plugins/b/y", "docs"} {
+		if err := os.MkdirAll(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile("plugins/file", nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		pattern  string
+		patterns []string
+		listed   []string
+	}{
+		{"plugins/*/main.go", []string{"plugins/a/main.go", "plugins/b/main.go"}, []string{"plugins"}},
+		{
+			"plugins/*/*/*.go",
+			[]string{"plugins/b/x/*.go", "plugins/b/y/*.go"},
+			[]string{"plugins", "plugins/a", "plugins/b"},
+		},
+		{"plugins/*/**/*.go", []string{"plugins/a/**/*.go", "plugins/b/**/*.go"}, []string{"plugins"}},
+		{"*/a/*.go", []string{"docs/a/*.go", "plugins/a/*.go"}, []string{"."}},
+		{"plugins/missing*/main.go", []string{}, []string{"plugins"}},
+		{"plugins/**/main.go", []string{"plugins/**/main.go"}, nil},
+		{"plugins/*.go", []string{"plugins/*.go"}, nil},
+		{"*.go", []string{"*.go"}, nil},
+	}
+	for _, tt := range tests {
+		patterns, listed := ExpandDirs(".", tt.pattern)
+		if !reflect.DeepEqual(patterns, tt.patterns) {
+			t.Errorf("%s: expected patterns %#v, got %#v", tt.pattern, tt.patterns, patterns)
+		}
+		if !reflect.DeepEqual(listed, tt.listed) {
+			t.Errorf("%s: expected listed %#v, got %#v", tt.pattern, tt.listed, listed)
+		}
+	}
+}
+
+func TestAbsPattern(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping - expectations use Unix paths")
+	}
+	tests := map[string]string{
+		"../shared/**":   "/work/shared/**",
+		"../../x/*.go":   "/x/*.go",
+		"sub/../../a/*":  "/work/a/*",
+		"../shared/a.go": "/work/shared/a.go",
+		"src/**":         "src/**",
+		"**/*.go":        "**/*.go",
+		"a/../b/*":       "a/../b/*",
+		"/abs/../dir/**": "/abs/../dir/**",
+		"..":             "/work",
+		"..foo/*.go":     "..foo/*.go",
+	}
+	for pattern, expected := range tests {
+		if ret := AbsPattern("/work/proj", pattern); ret != expected {
+			t.Errorf("%s: expected %q, got %q", pattern, expected, ret)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package modd
+
+import (
+	"sort"
+
+	"github.com/cortesi/modd/conf"
+)
+
+// CoverageGaps finds files under dir that match the scan patterns but that no
+// block watches, to catch file types that were forgotten in a config. If scan
+// is empty, all files are scanned. Files on the default ignore list are never
+// reported. Block patterns are matched against paths relative to dir, and
+// event scopes are ignored, so a file counts as watched if any event for it
+// would reach a block. Gaps are returned in sorted order, and a malformed
+// pattern is reported as an error.
+func CoverageGaps(dir string, blocks []conf.Block, scan []string) ([]string, error) {
+	if len(scan) == 0 {
+		scan = []string{"**"}
+	}
+	paths, err := listFiles(dir, scan, CommonExcludes)
+	if err != nil {
+		return nil, err
+	}
+	watched := map[string]bool{}
+	for _, b := range blocks {
+		matched, err := FilterFiles(paths, b.Include, b.Exclude)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range matched.Files {
+			watched[p] = true
+		}
+	}
+	ret := []string{}
+	for _, p := range paths {
+		if !watched[p] {
+			ret = append(ret, p)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
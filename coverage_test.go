@@ -0,0 +1,50 @@
+package modd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/utils"
+)
+
+func TestCoverageGaps(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	for _, p := range []string{
+		"main.go", "main_test.go", "a/b.go", "a/schema.sql",
+		"web/app.js", "web/style.css", "README.md", ".git/config",
+	} {
+		touch(p)
+	}
+	cnf, err := conf.Parse("test", `
+		**/*.go !**/*_test.go {}
+		web/*.js {}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret, err := CoverageGaps(".", cnf.Blocks, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"README.md", "a/schema.sql", "main_test.go", "web/style.css"}
+	if !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+
+	ret, err = CoverageGaps(".", cnf.Blocks, []string{"**/*.go", "**/*.sql"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"a/schema.sql", "main_test.go"}
+	if !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+
+	_, err = CoverageGaps(".", []conf.Block{{Include: []string{"web/[a"}}}, nil)
+	if err == nil {
+		t.Error("Expected an error for a malformed pattern")
+	}
+}
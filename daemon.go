@@ -1,9 +1,11 @@
 package modd
 
 import (
+	"fmt"
 	"os"
 	"os/exec"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/cortesi/modd/conf"
@@ -21,15 +23,28 @@ const (
 	MaxRestart = 8 * time.Second
 )
 
+// DefaultStopSequence is used to stop daemons that don't specify their own
+// sequence with the +stop option.
+var DefaultStopSequence = []conf.StopStep{
+	{Signal: syscall.SIGTERM, Wait: conf.DefaultStopWait},
+	{Signal: os.Kill, Wait: conf.DefaultStopWait},
+}
+
+// How often we check whether a daemon has exited while stopping it
+const stopPoll = 10 * time.Millisecond
+
 // A single daemon
 type daemon struct {
 	conf  conf.Daemon
 	indir string
+	// The user the daemon runs as, if not the current user
+	user string
 
 	ex    *shell.Executor
 	log   termlog.Stream
 	shell string
 	stop  bool
+	hooks *commandHooks
 	sync.Mutex
 }
 
@@ -42,10 +57,22 @@ func (d *daemon) Run() {
 		}
 		if !lastStart.IsZero() {
 			time.Sleep(delay)
+			if d.stop {
+				break
+			}
 		}
 		d.log.Notice(">> starting...")
+		d.Lock()
+		hooks := d.hooks
+		d.Unlock()
+		hooks.start()
 		lastStart = time.Now()
-		err, pstate := d.ex.Run(d.log, false)
+		err, pstate := d.ex.Run(hooks.stream(d.log), false)
+		if err != nil {
+			hooks.exit(time.Since(lastStart), -1)
+		} else {
+			hooks.exit(time.Since(lastStart), pstate.ExitCode)
+		}
 
 		if err != nil {
 			d.log.Shout("execution error: %s", err)
@@ -80,6 +107,8 @@ func (d *daemon) Restart() {
 		ex, err := shell.NewExecutor(d.shell, d.conf.Command, d.indir)
 		if err != nil {
 			d.log.Shout("Could not create executor: %s", err)
+		} else {
+			ex.User = d.user
 		}
 		d.ex = ex
 		go d.Run()
@@ -94,13 +123,56 @@ func (d *daemon) Restart() {
 	}
 }
 
+// waitExit waits up to timeout for the daemon process to exit, and returns
+// true if it did.
+func (d *daemon) waitExit(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for d.ex.Running() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(stopPoll)
+	}
+	return true
+}
+
+// stopSequence returns the steps taken to stop the daemon. If sig is not nil,
+// it is sent first, with the wait of the daemon's first step, and the rest of
+// its sequence follows.
+func (d *daemon) stopSequence(sig os.Signal) []conf.StopStep {
+	seq := d.conf.StopSequence
+	if len(seq) == 0 {
+		seq = DefaultStopSequence
+	}
+	if sig == nil || sig == seq[0].Signal {
+		return seq
+	}
+	first := conf.StopStep{Signal: sig, Wait: seq[0].Wait}
+	return append([]conf.StopStep{first}, seq...)
+}
+
+// Shutdown stops the daemon, escalating through its stop sequence until the
+// process exits. If sig is not nil, it is sent before the sequence starts.
 func (d *daemon) Shutdown(sig os.Signal) error {
 	d.log.Notice(">> stopping")
 	d.stop = true
-	if d.ex != nil {
-		return d.ex.Stop()
+	if d.ex == nil {
+		return nil
+	}
+	seq := d.stopSequence(sig)
+	for _, step := range seq {
+		if !d.ex.Running() {
+			return nil
+		}
+		d.log.Notice(">> sending signal %s", step.Signal)
+		if err := d.ex.Signal(step.Signal); err != nil && d.ex.Running() {
+			return err
+		}
+		if d.waitExit(step.Wait) {
+			return nil
+		}
 	}
-	return nil
+	return fmt.Errorf("%s did not exit", d.conf.Command)
 }
 
 // DaemonPen is a group of daemons in a single block, managed as a unit.
@@ -111,6 +183,7 @@ type DaemonPen struct {
 
 // NewDaemonPen creates a new DaemonPen
 func NewDaemonPen(block conf.Block, vars map[string]string, log termlog.TermLog) (*DaemonPen, error) {
+	log = blockLog(block, log)
 	d := make([]*daemon, len(block.Daemons))
 	for i, dmn := range block.Daemons {
 		vcmd := varcmd.VarCmd{Block: nil, Modified: nil, Vars: vars}
@@ -138,6 +211,7 @@ func NewDaemonPen(block conf.Block, vars map[string]string, log termlog.TermLog)
 			log:   log.Stream(niceHeader("daemon: ", dmn.Command)),
 			shell: sh,
 			indir: indir,
+			user:  block.User,
 		}
 	}
 	return &DaemonPen{daemons: d}, nil
@@ -154,15 +228,34 @@ func (dp *DaemonPen) Restart() {
 	}
 }
 
-// Shutdown all daemons in the pen
+// setHooks sets the hooks that receive lifecycle events for the daemons in
+// the pen
+func (dp *DaemonPen) setHooks(hooks *blockHooks) {
+	dp.Lock()
+	defer dp.Unlock()
+	for _, d := range dp.daemons {
+		d.Lock()
+		d.hooks = hooks.command("daemon", d.conf.Command)
+		d.Unlock()
+	}
+}
+
+// Shutdown all daemons in the pen concurrently, and wait for them to stop. If
+// sig is nil, each daemon is stopped with its stop sequence alone.
 func (dp *DaemonPen) Shutdown(sig os.Signal) {
 	dp.Lock()
 	defer dp.Unlock()
-	if dp.daemons != nil {
-		for _, d := range dp.daemons {
-			d.Shutdown(sig)
-		}
+	wg := sync.WaitGroup{}
+	for _, d := range dp.daemons {
+		wg.Add(1)
+		go func(d *daemon) {
+			defer wg.Done()
+			if err := d.Shutdown(sig); err != nil {
+				d.log.Shout("error stopping: %s", err)
+			}
+		}(d)
 	}
+	wg.Wait()
 }
 
 // DaemonWorld represents the entire world of daemons
@@ -184,9 +277,16 @@ func NewDaemonWorld(cnf *conf.Config, log termlog.TermLog) (*DaemonWorld, error)
 	return &DaemonWorld{daemonPens}, nil
 }
 
-// Shutdown all daemons with signal s
+// Shutdown all daemons, sending signal s before each daemon's stop sequence.
+// If s is nil, the stop sequences are used alone.
 func (dw *DaemonWorld) Shutdown(s os.Signal) {
+	wg := sync.WaitGroup{}
 	for _, dp := range dw.DaemonPens {
-		dp.Shutdown(s)
+		wg.Add(1)
+		go func(dp *DaemonPen) {
+			defer wg.Done()
+			dp.Shutdown(s)
+		}(dp)
 	}
+	wg.Wait()
 }
@@ -0,0 +1,251 @@
+// +build !windows
+
+package modd
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/utils"
+	"github.com/cortesi/moddwatch"
+	"github.com/cortesi/termlog"
+)
+
+func waitRunning(t *testing.T, d *daemon) {
+	start := time.Now()
+	for d.ex == nil || !d.ex.Running() {
+		if time.Now().Sub(start) > timeout {
+			t.Fatal("timed out waiting for daemon to start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDaemonStopSequence(t *testing.T) {
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		{
+			daemon +stop=sigterm,200ms,sigint,200ms,sigkill: "
+				trap '' TERM INT
+				echo started
+				sleep 999999
+			"
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	dp, err := NewDaemonPen(cnf.Blocks[0], cnf.GetVariables(), lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp.Restart()
+	d := dp.daemons[0]
+	waitRunning(t, d)
+
+	start := time.Now()
+	if err := d.Shutdown(nil); err != nil {
+		t.Fatal(err)
+	}
+	if d.ex.Running() {
+		t.Error("daemon still running after shutdown")
+	}
+	if elapsed := time.Now().Sub(start); elapsed < 400*time.Millisecond {
+		t.Errorf("daemon stopped before escalating: %s", elapsed)
+	}
+	for _, sig := range []string{"terminated", "interrupt", "killed"} {
+		if !strings.Contains(lt.String(), ">> sending signal "+sig) {
+			t.Errorf("expected signal %q in log:\n%s", sig, lt.String())
+		}
+	}
+}
+
+func TestDaemonStopDefault(t *testing.T) {
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		{
+			daemon: "echo started; sleep 999999"
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	dp, err := NewDaemonPen(cnf.Blocks[0], cnf.GetVariables(), lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp.Restart()
+	d := dp.daemons[0]
+	waitRunning(t, d)
+
+	if err := d.Shutdown(nil); err != nil {
+		t.Fatal(err)
+	}
+	if d.ex.Running() {
+		t.Error("daemon still running after shutdown")
+	}
+	if strings.Contains(lt.String(), "killed") {
+		t.Errorf("expected SIGTERM alone to stop the daemon:\n%s", lt.String())
+	}
+}
+
+func TestStopSequenceSignal(t *testing.T) {
+	custom := []conf.StopStep{
+		{Signal: syscall.SIGINT, Wait: time.Second},
+		{Signal: os.Kill, Wait: 2 * time.Second},
+	}
+	tests := []struct {
+		seq      []conf.StopStep
+		sig      os.Signal
+		expected []conf.StopStep
+	}{
+		{nil, nil, DefaultStopSequence},
+		{nil, syscall.SIGTERM, DefaultStopSequence},
+		{custom, nil, custom},
+		{custom, syscall.SIGINT, custom},
+		{
+			custom, syscall.SIGTERM,
+			append([]conf.StopStep{{Signal: syscall.SIGTERM, Wait: time.Second}}, custom...),
+		},
+		{nil, os.Kill, append([]conf.StopStep{{Signal: os.Kill, Wait: conf.DefaultStopWait}}, DefaultStopSequence...)},
+	}
+	for _, tt := range tests {
+		d := &daemon{conf: conf.Daemon{StopSequence: tt.seq}}
+		if ret := d.stopSequence(tt.sig); !reflect.DeepEqual(ret, tt.expected) {
+			t.Errorf("%v, %v: expected %v, got %v", tt.seq, tt.sig, tt.expected, ret)
+		}
+	}
+}
+
+func TestPrepsGateDaemonRestart(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		** {
+			prep: echo ":prep: first"; test ! -e fail
+			prep: echo ":prep: second"
+			daemon: echo ":daemon: started"; sleep 999999
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:        lt.Log,
+		Config:     cnf,
+		quietUntil: make([]time.Time, len(cnf.Blocks)),
+	}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dworld.Shutdown(os.Kill)
+
+	// A failing prep on the initial run keeps the daemon from starting, and
+	// skips the remaining preps
+	touch("fail")
+	mr.startBlocks(dworld, nil)
+	expected := []string{":prep: first"}
+	time.Sleep(200 * time.Millisecond)
+	waitEvents(t, lt, expected)
+
+	// Once every prep passes, the daemon starts
+	if err := os.Remove("fail"); err != nil {
+		t.Fatal(err)
+	}
+	mr.trigger(".", &moddwatch.Mod{Changed: []string{"a"}}, dworld)
+	expected = append(expected, ":prep: first", ":prep: second", ":daemon: started")
+	waitEvents(t, lt, expected)
+
+	// A failing prep leaves the running daemon alone
+	d := dworld.DaemonPens[0].daemons[0]
+	waitRunning(t, d)
+	touch("fail")
+	mr.trigger(".", &moddwatch.Mod{Changed: []string{"a"}}, dworld)
+	expected = append(expected, ":prep: first")
+	time.Sleep(200 * time.Millisecond)
+	waitEvents(t, lt, expected)
+	if !d.ex.Running() {
+		t.Error("daemon stopped after a failing prep")
+	}
+
+	// Passing preps restart it
+	if err := os.Remove("fail"); err != nil {
+		t.Fatal(err)
+	}
+	mr.trigger(".", &moddwatch.Mod{Changed: []string{"a"}}, dworld)
+	expected = append(expected, ":prep: first", ":prep: second", ":daemon: started")
+	waitEvents(t, lt, expected)
+}
+
+func TestReloadKeepsDaemon(t *testing.T) {
+	lt := termlog.NewLogTest()
+	// Output lines starting with prefix, once there are at least n of them
+	waitLines := func(prefix string, n int) []string {
+		t.Helper()
+		start := time.Now()
+		for {
+			ret := []string{}
+			for _, e := range events(lt.String()) {
+				if strings.HasPrefix(e, prefix) {
+					ret = append(ret, e)
+				}
+			}
+			if len(ret) >= n {
+				return ret
+			}
+			if time.Since(start) > timeout {
+				t.Fatalf("Timed out waiting for %s in:\n%s", prefix, lt.String())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	config := `
+		@shell = bash
+		@port = PORT
+		a/** {
+			daemon: echo ":kept: $$"; exec sleep 999999
+		}
+		b/** {
+			daemon: echo ":changed: @port"; exec sleep 999999
+		}
+	`
+	cnf := mustParse(t, strings.Replace(config, "PORT", "8000", 1))
+	mr := ModRunner{Log: lt.Log, Config: cnf, quietUntil: make([]time.Time, 2)}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.startBlocks(dworld, nil)
+	pid := waitLines(":kept:", 1)[0]
+	waitLines(":changed: 8000", 1)
+	kept := dworld.DaemonPens[0].daemons[0]
+	waitRunning(t, kept)
+
+	newcnf := mustParse(t, strings.Replace(config, "PORT", "9000", 1))
+	newworld, keptBlocks, err := mr.reload(newcnf, dworld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newworld.Shutdown(os.Kill)
+	mr.startBlocks(newworld, keptBlocks)
+	waitLines(":changed: 9000", 1)
+
+	// The daemon whose block doesn't use the changed variable is the same
+	// process, and wasn't restarted
+	if newworld.DaemonPens[0].daemons[0] != kept || !kept.ex.Running() {
+		t.Error("Unchanged daemon not kept running")
+	}
+	if ret := waitLines(":kept:", 1); len(ret) != 1 || ret[0] != pid {
+		t.Errorf("Expected only %q, got %#v", pid, ret)
+	}
+}
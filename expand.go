@@ -0,0 +1,98 @@
+package modd
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/rjeczalik/notify"
+)
+
+// expandedPatterns returns the patterns watched for a config. The includes of
+// blocks with the +expand option have their single-star directory levels
+// expanded by conf.ExpandDirs, and the directories listed to do so are
+// returned as well.
+func expandedPatterns(root string, cnf *conf.Config) ([]string, []string) {
+	pmap := map[string]bool{}
+	dmap := map[string]bool{}
+	for _, b := range cnf.Blocks {
+		for _, p := range b.WatchedIncludes() {
+			if !b.ExpandDirs {
+				pmap[p] = true
+				continue
+			}
+			patterns, listed := conf.ExpandDirs(root, p)
+			for _, ep := range patterns {
+				pmap[ep] = true
+			}
+			for _, d := range listed {
+				dmap[d] = true
+			}
+		}
+	}
+	return sortedKeys(pmap), sortedKeys(dmap)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// An expansion is the set of patterns watched for a config, together with a
+// watch on the directories that their expansion was listed from. Directories
+// are only ever added to or removed from those, so a non-recursive watch on
+// each is enough to notice when the expansion changes.
+type expansion struct {
+	root     string
+	patterns []string
+	events   chan notify.EventInfo
+}
+
+// newExpansion expands the watched patterns of a config and starts watching
+// the directories that were listed. The events channel is nil if no
+// directories were listed. A listed directory that doesn't exist can't be
+// watched, so directories created inside it later are only picked up when the
+// watcher is next restarted.
+func newExpansion(root string, cnf *conf.Config) *expansion {
+	patterns, dirs := expandedPatterns(root, cnf)
+	e := &expansion{root: root, patterns: patterns}
+	if len(dirs) == 0 {
+		return e
+	}
+	e.events = make(chan notify.EventInfo, 1024)
+	for _, d := range dirs {
+		if !filepath.IsAbs(d) {
+			d = filepath.Join(root, d)
+		}
+		_ = notify.Watch(d, e.events, notify.Create, notify.Remove, notify.Rename)
+	}
+	return e
+}
+
+// changes returns the channel of events in the listed directories, which is
+// nil for a nil expansion
+func (e *expansion) changes() <-chan notify.EventInfo {
+	if e == nil {
+		return nil
+	}
+	return e.events
+}
+
+// changed checks whether the expansion for the config differs from the one
+// being watched
+func (e *expansion) changed(cnf *conf.Config) bool {
+	patterns, _ := expandedPatterns(e.root, cnf)
+	return !reflect.DeepEqual(patterns, e.patterns)
+}
+
+// stop stops watching the listed directories
+func (e *expansion) stop() {
+	if e.events != nil {
+		notify.Stop(e.events)
+	}
+}
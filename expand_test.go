@@ -0,0 +1,86 @@
+package modd
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cortesi/modd/utils"
+	"github.com/cortesi/moddwatch"
+	"github.com/cortesi/termlog"
+)
+
+func TestExpandedPatterns(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	for _, d := range []string{"plugins/a", "plugins/b"} {
+		if err := os.MkdirAll(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cnf := mustParse(t, `
+		plugins/*/main.go +expand {}
+		plugins/*/README {}
+	`)
+	patterns, dirs := expandedPatterns(".", cnf)
+	expected := []string{"plugins/*/README", "plugins/a/main.go", "plugins/b/main.go"}
+	if !reflect.DeepEqual(patterns, expected) {
+		t.Errorf("Expected patterns %#v, got %#v", expected, patterns)
+	}
+	if expected := []string{"plugins"}; !reflect.DeepEqual(dirs, expected) {
+		t.Errorf("Expected directories %#v, got %#v", expected, dirs)
+	}
+}
+
+func TestWatchExpandDirs(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	for _, d := range []string{"plugins/a", "plugins/b"} {
+		if err := os.MkdirAll(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:    lt.Log,
+		Config: mustParse(t, "plugins/*/main.go +expand { prep: echo a\n}"),
+	}
+	dworld, err := NewDaemonWorld(mr.Config, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := newExpansion(".", mr.Config)
+	defer exp.stop()
+	if exp.changed(mr.Config) {
+		t.Error("Expansion changed before any directory was added")
+	}
+
+	// A new plugin directory restarts the watcher with the current config
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		modchan := make(chan *moddwatch.Mod, 1)
+		if newcnf := mr.watch(".", modchan, dworld, time.Time{}, exp); newcnf != mr.Config {
+			t.Errorf("Expected the current config, got %v", newcnf)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := os.Mkdir("plugins/c", 0777); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("Watch didn't return after a plugin directory was added")
+	}
+	if !strings.Contains(lt.String(), "restarting watcher") {
+		t.Errorf("Restart not logged: %s", lt.String())
+	}
+	patterns, _ := expandedPatterns(".", mr.Config)
+	expected := []string{"plugins/a/main.go", "plugins/b/main.go", "plugins/c/main.go"}
+	if !reflect.DeepEqual(patterns, expected) {
+		t.Errorf("Expected patterns %#v, got %#v", expected, patterns)
+	}
+}
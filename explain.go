@@ -0,0 +1,146 @@
+package modd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/cortesi/modd/conf"
+)
+
+// Explanation describes how a single block matches a path
+type Explanation struct {
+	// The block number, starting at 1
+	Block int
+	// The first include pattern that matches the path, if any
+	Include string
+	// The first exclude pattern that matches the path, if any
+	Exclude string
+	// Set if Exclude is from the default ignore list
+	CommonExclude bool
+	// The directories watched for the block's include patterns
+	BasePaths []string
+	// Set if the path lies under one of the base paths
+	InBase bool
+}
+
+// Matches checks whether changes to the path trigger the block
+func (e Explanation) Matches() bool {
+	return e.Include != "" && e.Exclude == "" && e.InBase
+}
+
+func (e Explanation) String() string {
+	switch {
+	case e.Include == "":
+		return fmt.Sprintf("block %d: no match - no include pattern matches", e.Block)
+	case e.Exclude != "":
+		kind := "exclude"
+		if e.CommonExclude {
+			kind = "default ignore"
+		}
+		return fmt.Sprintf(
+			"block %d: no match - included by %s, but removed by %s %s",
+			e.Block, e.Include, kind, e.Exclude,
+		)
+	case !e.InBase:
+		return fmt.Sprintf(
+			"block %d: no match - included by %s, but outside the watched paths: %s",
+			e.Block, e.Include, strings.Join(e.BasePaths, " "),
+		)
+	}
+	return fmt.Sprintf("block %d: match - included by %s", e.Block, e.Include)
+}
+
+// underBase checks whether a normalized path lies under a base directory
+func underBase(base string, p string) bool {
+	if base == "." {
+		return !path.IsAbs(p) && p != ".." && !strings.HasPrefix(p, "../")
+	}
+	return p == base || strings.HasPrefix(p, strings.TrimSuffix(base, "/")+"/")
+}
+
+// normPath converts a path to the form the watcher reports: slash-delimited,
+// and relative to the current directory if it lies within it. A trailing
+// separator, which marks a directory, is kept.
+func normPath(p string) (string, error) {
+	if trimmed := strings.TrimRight(filepath.ToSlash(p), "/"); trimmed != "" && trimmed != filepath.ToSlash(p) {
+		ret, err := normPath(trimmed)
+		if err != nil || ret == "/" || ret == "." {
+			return ret, err
+		}
+		return ret + "/", nil
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(cwd, abs); err == nil {
+		rel = filepath.ToSlash(rel)
+		if rel != ".." && !strings.HasPrefix(rel, "../") {
+			return rel, nil
+		}
+	}
+	return filepath.ToSlash(abs), nil
+}
+
+// firstMatch returns the first pattern that matches a path
+func firstMatch(p string, patterns []string) (int, error) {
+	for i, pattern := range patterns {
+		match, err := conf.MatchAny(p, []string{conf.TrimSeparators(pattern)})
+		if err != nil {
+			return -1, err
+		} else if match {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+// Explain describes how each block of a config matches a path, for diagnosing
+// why changes to a file do or don't trigger a block. The config should have
+// had the default ignore list applied, as it is when read by a ModRunner.
+func Explain(cnf *conf.Config, p string) ([]Explanation, error) {
+	p, err := normPath(p)
+	if err != nil {
+		return nil, err
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	ret := []Explanation{}
+	for i, b := range cnf.Blocks {
+		// Patterns are matched in the form the watcher uses, but reported as
+		// they were written
+		abs := b.Rewrite(func(p string) string { return conf.AbsPattern(cwd, p) })
+		e := Explanation{Block: i + 1, BasePaths: conf.BasePaths(abs.WatchedIncludes())}
+		for _, base := range e.BasePaths {
+			if underBase(base, p) {
+				e.InBase = true
+			}
+		}
+		inc, err := firstMatch(p, abs.Include)
+		if err != nil {
+			return nil, err
+		}
+		if inc >= 0 {
+			e.Include = b.Include[inc]
+			exc, err := firstMatch(p, abs.Exclude)
+			if err != nil {
+				return nil, err
+			}
+			if exc >= 0 {
+				e.Exclude = b.Exclude[exc]
+				e.CommonExclude = exc >= len(b.UserExcludes(CommonExcludes))
+			}
+		}
+		ret = append(ret, e)
+	}
+	return ret, nil
+}
@@ -0,0 +1,147 @@
+package modd
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/utils"
+)
+
+var explainTests = []struct {
+	path     string
+	expected []string
+}{
+	{
+		"a.go",
+		[]string{
+			"block 1: match - included by **/*.go",
+			"block 2: no match - no include pattern matches",
+		},
+	},
+	{
+		"a_test.go",
+		[]string{
+			"block 1: no match - included by **/*.go, but removed by exclude **/*_test.go",
+			"block 2: no match - no include pattern matches",
+		},
+	},
+	{
+		".git/hook.go",
+		[]string{
+			"block 1: no match - included by **/*.go, but removed by default ignore **/.git/**",
+			"block 2: no match - no include pattern matches",
+		},
+	},
+	{
+		"./src/b.txt",
+		[]string{
+			"block 1: no match - no include pattern matches",
+			"block 2: match - included by src/**",
+		},
+	},
+	{
+		"src/",
+		[]string{
+			"block 1: no match - no include pattern matches",
+			"block 2: match - included by src/**",
+		},
+	},
+	{
+		"/outside/c.go",
+		[]string{
+			"block 1: no match - included by **/*.go, but outside the watched paths: .",
+			"block 2: no match - no include pattern matches",
+		},
+	},
+}
+
+func TestExplain(t *testing.T) {
+	cnf, err := conf.Parse("test", `
+		**/*.go !**/*_test.go {}
+		src/** {}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cnf.CommonExcludes(CommonExcludes)
+	for _, tt := range explainTests {
+		ret, err := Explain(cnf, tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ret) != len(tt.expected) {
+			t.Fatalf("%s: expected %d blocks, got %d", tt.path, len(tt.expected), len(ret))
+		}
+		for i, e := range ret {
+			if e.String() != tt.expected[i] {
+				t.Errorf("%s: expected\n%s\ngot\n%s", tt.path, tt.expected[i], e)
+			}
+			if e.Matches() != strings.Contains(tt.expected[i], ": match") {
+				t.Errorf("%s: unexpected Matches result for %s", tt.path, e)
+			}
+		}
+	}
+}
+
+func TestExplainOutsideRoot(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	touch("shared/lib/a.go")
+	touch("sub/b.go")
+	if err := os.Chdir("sub"); err != nil {
+		t.Fatal(err)
+	}
+
+	cnf, err := conf.Parse("test", `
+		../shared/** {}
+		**/*.go {}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string][]string{
+		"../shared/lib/a.go": {
+			"block 1: match - included by ../shared/**",
+			"block 2: no match - included by **/*.go, but outside the watched paths: .",
+		},
+		"b.go": {
+			"block 1: no match - no include pattern matches",
+			"block 2: match - included by **/*.go",
+		},
+	}
+	for p, expected := range tests {
+		ret, err := Explain(cnf, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, e := range ret {
+			if e.String() != expected[i] {
+				t.Errorf("%s: expected\n%s\ngot\n%s", p, expected[i], e)
+			}
+		}
+	}
+}
+
+func TestExplainExcludedBasePath(t *testing.T) {
+	cnf, err := conf.Parse("test", `
+		vendor/lib/** src/** !vendor/** {}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cnf.CommonExcludes(CommonExcludes)
+	ret, err := Explain(cnf, "vendor/lib/a.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The vendor/lib base path is excluded entirely, so it isn't watched
+	if expected := []string{"src"}; !reflect.DeepEqual(ret[0].BasePaths, expected) {
+		t.Errorf("Expected base paths %#v, got %#v", expected, ret[0].BasePaths)
+	}
+	expected := "block 1: no match - included by vendor/lib/**, but removed by exclude vendor/**"
+	if ret[0].String() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, ret[0])
+	}
+}
@@ -0,0 +1,342 @@
+package modd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/varcmd"
+)
+
+// listFiles lists the files under dir that match the patterns, each only
+// once. It is varcmd.ListFiles, which @mods also uses, so that the two agree.
+func listFiles(dir string, includes []string, excludes []string) ([]string, error) {
+	return varcmd.ListFiles(dir, includes, excludes)
+}
+
+// FindGrouped finds the files under dir that match the patterns, grouped by
+// their containing directory. Paths are in the same form as moddwatch.List
+// returns them, and directory keys are derived from them with path.Dir, so
+// files directly under dir are grouped under ".". Directories that contain no
+// matching files are absent from the map.
+func FindGrouped(dir string, includes []string, excludes []string) (map[string][]string, error) {
+	paths, err := listFiles(dir, includes, excludes)
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string][]string{}
+	for _, p := range paths {
+		d := path.Dir(p)
+		ret[d] = append(ret[d], p)
+	}
+	return ret, nil
+}
+
+// FileMeta holds a path found by FindInfo, along with its metadata
+type FileMeta struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	Mode    os.FileMode
+}
+
+// FindOptions changes which files Find returns
+type FindOptions struct {
+	// If greater than zero, the most files to return. The walk stops as soon
+	// as more files than this are found, so that a pattern that is far too
+	// broad isn't walked in full.
+	MaxResults int
+	// Leave out empty files, such as the zero-byte placeholders some build
+	// steps leave behind. They don't count towards MaxResults.
+	SkipEmpty bool
+}
+
+// errTooMany stops a walk once more than FindOptions.MaxResults files are
+// found
+var errTooMany = errors.New("too many files")
+
+// Find finds the files under dir that match the patterns, along with their
+// metadata, in sorted path order, and reports whether the results were cut
+// short by opts.MaxResults. Paths are in the same form as moddwatch.List
+// returns them. The metadata comes from the walk that finds the files, so
+// they aren't stat'ed again. Truncated results are the first files the walk
+// found, which aren't necessarily the first in path order.
+func Find(dir string, includes []string, excludes []string, opts FindOptions) ([]FileMeta, bool, error) {
+	ret := []FileMeta{}
+	err := varcmd.WalkFiles(dir, includes, excludes, func(p string, fi os.FileInfo) error {
+		if opts.SkipEmpty && fi.Size() == 0 {
+			return nil
+		}
+		if opts.MaxResults > 0 && len(ret) == opts.MaxResults {
+			return errTooMany
+		}
+		ret = append(ret, FileMeta{
+			Path:    p,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+			Mode:    fi.Mode(),
+		})
+		return nil
+	})
+	truncated := err == errTooMany
+	if err != nil && !truncated {
+		return nil, false, err
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Path < ret[j].Path })
+	return ret, truncated, nil
+}
+
+// FindInfo finds the files under dir that match the patterns, like Find with
+// no options
+func FindInfo(dir string, includes []string, excludes []string) ([]FileMeta, error) {
+	ret, _, err := Find(dir, includes, excludes, FindOptions{})
+	return ret, err
+}
+
+// PatternError reports a malformed pattern
+type PatternError struct {
+	Pattern string
+	Err     error
+}
+
+func (e *PatternError) Error() string {
+	return fmt.Sprintf("invalid pattern %q: %s", e.Pattern, e.Err)
+}
+
+// ExpandToFiles returns the files under dir that currently match a single
+// include pattern, in sorted order, with the same matching the watcher uses.
+// Patterns are normalised as they are in a config file. A malformed pattern
+// is reported as a *PatternError, rather than silently matching nothing.
+func ExpandToFiles(dir string, pattern string) ([]string, error) {
+	p := conf.TrimSeparators(conf.SlashPattern(pattern))
+	if p == "" {
+		return nil, &PatternError{pattern, errors.New("empty pattern")}
+	}
+	if err := conf.ValidatePattern(p); err != nil {
+		return nil, &PatternError{pattern, err}
+	}
+	paths, err := listFiles(dir, []string{p}, nil)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// fullPath turns a path returned by moddwatch.List for dir into a filesystem
+// path
+func fullPath(dir string, p string) string {
+	fp := filepath.FromSlash(p)
+	if !filepath.IsAbs(fp) {
+		fp = filepath.Join(dir, fp)
+	}
+	return fp
+}
+
+// The number of bytes read from the start of a file to decide whether it's
+// binary
+const binarySniffLen = 512
+
+// IsBinary reports whether a file looks like a binary file, which is the case
+// if one of its first few hundred bytes is a NUL. Empty files are text.
+func IsBinary(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	buf := make([]byte, binarySniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	return bytes.IndexByte(buf[:n], 0) >= 0, nil
+}
+
+// FindText is like FindInfo, but leaves out binary files, as detected by
+// IsBinary, and anything that isn't a regular file. Only a short prefix of
+// each file is read.
+func FindText(dir string, includes []string, excludes []string) ([]FileMeta, error) {
+	files, err := FindInfo(dir, includes, excludes)
+	if err != nil {
+		return nil, err
+	}
+	ret := []FileMeta{}
+	for _, f := range files {
+		if !f.Mode.IsRegular() {
+			continue
+		}
+		binary, err := IsBinary(fullPath(dir, f.Path))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if !binary {
+			ret = append(ret, f)
+		}
+	}
+	return ret, nil
+}
+
+// SortByModTime sorts files found by FindInfo by modification time, newest
+// first if newestFirst is set, and oldest first otherwise. Files with the same
+// modification time stay in path order.
+func SortByModTime(files []FileMeta, newestFirst bool) {
+	sort.SliceStable(files, func(i, j int) bool {
+		if newestFirst {
+			return files[i].ModTime.After(files[j].ModTime)
+		}
+		return files[i].ModTime.Before(files[j].ModTime)
+	})
+}
+
+// FindNewestPerDir finds the files under dir that match the patterns, and
+// returns the most recently modified one in each directory. Directory keys are
+// derived as they are by FindGrouped. Of several files with the same
+// modification time, the one that sorts first by path is returned.
+func FindNewestPerDir(dir string, includes []string, excludes []string) (map[string]string, error) {
+	files, err := FindInfo(dir, includes, excludes)
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string]string{}
+	newest := map[string]time.Time{}
+	for _, f := range files {
+		d := path.Dir(f.Path)
+		if t, ok := newest[d]; !ok || f.ModTime.After(t) {
+			ret[d] = f.Path
+			newest[d] = f.ModTime
+		}
+	}
+	return ret, nil
+}
+
+// FindHash returns a hash of the set of files under dir that match the
+// patterns. Only file metadata is hashed, not content: for each matching file,
+// in sorted path order, the path, size and modification time are included. Two
+// hashes of the same tree are equal if no matching file was added, removed,
+// resized or touched in between.
+func FindHash(dir string, includes []string, excludes []string) (string, error) {
+	files, err := FindInfo(dir, includes, excludes)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, f := range files {
+		fmt.Fprintf(h, "%q %d %d\n", f.Path, f.Size, f.ModTime.UnixNano())
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// ListAll lists every file under dir, in sorted order, for later filtering
+// with RefilterCache. Paths are in the same form as moddwatch.List returns
+// them, and no exclude patterns are applied, so the list is a superset of the
+// files any set of patterns relative to dir would find.
+func ListAll(dir string) ([]string, error) {
+	paths, err := listFiles(dir, []string{"**"}, nil)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// RefilterCache filters a file list from ListAll against a new set of
+// patterns, giving the same files a fresh search with those patterns would,
+// without walking the tree again. This makes trying out changed patterns cheap
+// on large trees, as long as the tree itself hasn't changed. Patterns with
+// absolute paths, paths outside the listed directory, or paths through
+// symlinked directories can match files that aren't in the list and are
+// missed. Files are returned in the order of the list, and a malformed pattern
+// is reported as an error.
+func RefilterCache(cachedFiles []string, includes []string, excludes []string) ([]string, error) {
+	ret, err := FilterFiles(cachedFiles, includes, excludes)
+	if err != nil {
+		return nil, err
+	}
+	return ret.Files, nil
+}
+
+// FilterResult is the outcome of filtering a list of files with FilterFiles
+type FilterResult struct {
+	// Files that match an include pattern and no exclude pattern, in input
+	// order
+	Files []string
+	// The number of files filtered
+	Total int
+	// The number of files matching an include pattern
+	Included int
+	// The number of included files that were removed by an exclude pattern
+	Excluded int
+}
+
+// FilterFiles filters a list of files like filter.Files, and also counts how
+// many files were included and excluded, so that callers can tell "nothing
+// matched" apart from "everything was excluded". Unlike filter.Files, a
+// malformed pattern is reported as an error rather than as a non-match.
+// Trailing separators are ignored on both patterns and paths, and a path with
+// one is taken to be a directory, as described for matchAny. On Windows,
+// backslashes in patterns are separators, as described for conf.SlashPattern.
+func FilterFiles(files []string, includes []string, excludes []string) (*FilterResult, error) {
+	ret, _, err := filterFiles(files, includes, excludes)
+	return ret, err
+}
+
+// Partition splits a list of files into those FilterFiles keeps and those it
+// drops, in one pass. Both lists are in input order, and between them hold
+// every input file exactly once.
+func Partition(files []string, includes []string, excludes []string) ([]string, []string, error) {
+	ret, dropped, err := filterFiles(files, includes, excludes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ret.Files, dropped, nil
+}
+
+// filterFiles does the work of FilterFiles, and also returns the files that
+// were dropped
+func filterFiles(files []string, includes []string, excludes []string) (*FilterResult, []string, error) {
+	includes = trimSeparators(includes)
+	excludes = trimSeparators(excludes)
+	ret := &FilterResult{Files: []string{}, Total: len(files)}
+	dropped := []string{}
+	for _, f := range files {
+		included, err := conf.MatchAny(f, includes)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !included {
+			dropped = append(dropped, f)
+			continue
+		}
+		ret.Included++
+		excluded, err := conf.MatchAny(f, excludes)
+		if err != nil {
+			return nil, nil, err
+		}
+		if excluded {
+			ret.Excluded++
+			dropped = append(dropped, f)
+			continue
+		}
+		ret.Files = append(ret.Files, f)
+	}
+	return ret, dropped, nil
+}
+
+func trimSeparators(patterns []string) []string {
+	ret := make([]string, len(patterns))
+	for i, p := range patterns {
+		ret[i] = conf.TrimSeparators(conf.SlashPattern(p))
+	}
+	return ret
+}
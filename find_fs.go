@@ -0,0 +1,52 @@
+// +build go1.16
+
+package modd
+
+import (
+	"errors"
+	"io/fs"
+	"sort"
+
+	"github.com/cortesi/modd/conf"
+)
+
+// FindFS lists the files in fsys that match includes and don't match
+// excludes, for matching patterns against something other than the local
+// disk, such as the entries of an archive opened with archive/zip. Paths are
+// slash-delimited and relative to the root of fsys, and are returned sorted.
+// Only the base directories of the include patterns are walked, leaving out
+// those that are excluded entirely, as they are for Find. Base directories
+// that don't exist in fsys, or that lie outside it, are skipped. Patterns are
+// matched as they are by FilterFiles, so on Windows backslashes in patterns
+// are separators, but paths always use forward slashes, as io/fs requires.
+func FindFS(fsys fs.FS, includes []string, excludes []string) ([]string, error) {
+	b := conf.Block{Include: trimSeparators(includes), Exclude: trimSeparators(excludes)}
+	seen := map[string]bool{}
+	paths := []string{}
+	for _, base := range conf.BasePaths(b.WatchedIncludes()) {
+		if !fs.ValidPath(base) {
+			continue
+		}
+		err := fs.WalkDir(fsys, base, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && !seen[p] {
+				seen[p] = true
+				paths = append(paths, p)
+			}
+			return nil
+		})
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	ret, err := FilterFiles(paths, includes, excludes)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ret.Files)
+	return ret.Files, nil
+}
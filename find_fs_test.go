@@ -0,0 +1,115 @@
+// +build go1.16
+
+package modd
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"github.com/cortesi/modd/utils"
+)
+
+func TestFindFSZip(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for _, name := range []string{
+		"manifest.json",
+		"data/a.json",
+		"data/a.txt",
+		"data/nested/b.json",
+		"data/nested/skip.json",
+		"other/c.json",
+	} {
+		if _, err := w.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		includes []string
+		excludes []string
+		expected []string
+	}{
+		{
+			[]string{"**/*.json"},
+			[]string{"**/skip.json"},
+			[]string{"data/a.json", "data/nested/b.json", "manifest.json", "other/c.json"},
+		},
+		{
+			[]string{"data/**/*.json", "data/*.txt"},
+			nil,
+			[]string{"data/a.json", "data/a.txt", "data/nested/b.json", "data/nested/skip.json"},
+		},
+		{[]string{"missing/**", "../**"}, nil, []string{}},
+	}
+	for _, tt := range tests {
+		ret, err := FindFS(r, tt.includes, tt.excludes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ret, tt.expected) {
+			t.Errorf("%v: expected\n%#v\ngot\n%#v", tt.includes, tt.expected, ret)
+		}
+	}
+}
+
+func TestFindFSMapFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.go":      {},
+		"a_test.go": {},
+		"sub/b.go":  {},
+	}
+	ret, err := FindFS(fsys, []string{"**/*.go"}, []string{"**/*_test.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"a.go", "sub/b.go"}; !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, ret)
+	}
+}
+
+func TestFindFSMatchesFind(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	for _, p := range []string{
+		"main.go", "main_test.go", "a/b.go", "a/b/c.go", "a/schema.sql",
+		"vendor/lib/d.go", "web/app.js",
+	} {
+		touch(p)
+	}
+	patterns := []struct{ includes, excludes []string }{
+		{[]string{"**/*.go"}, []string{"**/*_test.go"}},
+		{[]string{"vendor/lib/**", "a/**"}, []string{"vendor/**", "a/b/"}},
+		{[]string{"web/**", "*.go"}, nil},
+		{[]string{"missing/**"}, nil},
+	}
+	for _, p := range patterns {
+		// Both report slash-delimited paths relative to the root, on every
+		// platform
+		ret, err := FindFS(os.DirFS("."), p.includes, p.excludes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := FindInfo(".", p.includes, p.excludes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{}
+		for _, f := range found {
+			expected = append(expected, f.Path)
+		}
+		if !reflect.DeepEqual(ret, expected) {
+			t.Errorf("%v !%v: expected\n%#v\ngot\n%#v", p.includes, p.excludes, expected, ret)
+		}
+	}
+}
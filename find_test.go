@@ -0,0 +1,596 @@
+package modd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/utils"
+	"github.com/cortesi/modd/varcmd"
+	"github.com/cortesi/moddwatch"
+)
+
+func TestFindGrouped(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	touch("top.go")
+	touch("a/one.go")
+	touch("a/two.go")
+	touch("a/b/three.go")
+	touch("a/b/skip.txt")
+	touch("c/skip.txt")
+	err := os.MkdirAll("empty", 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret, err := FindGrouped(".", []string{"**/*.go"}, []string{"a/two.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range ret {
+		sort.Strings(v)
+	}
+	expected := map[string][]string{
+		".":   {"top.go"},
+		"a":   {"a/one.go"},
+		"a/b": {"a/b/three.go"},
+	}
+	if !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestFindInfo(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	touch("b.go")
+	touch("a/one.go")
+	touch("a/skip.txt")
+	err := ioutil.WriteFile("a/two.go", []byte("package a"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	then := time.Now().Add(-time.Hour).Truncate(time.Second)
+	err = os.Chtimes("b.go", then, then)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret, err := FindInfo(".", []string{"**/*.go"}, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{}
+	for _, f := range ret {
+		paths = append(paths, f.Path)
+		fi, err := os.Stat(f.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Size != fi.Size() || !f.ModTime.Equal(fi.ModTime()) || f.Mode != fi.Mode() {
+			t.Errorf("%s: metadata mismatch: %#v", f.Path, f)
+		}
+	}
+	expected := []string{"a/one.go", "a/two.go", "b.go"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, paths)
+	}
+	if ret[1].Size != int64(len("package a")) {
+		t.Errorf("Unexpected size: %d", ret[1].Size)
+	}
+	if !ret[2].ModTime.Equal(then) {
+		t.Errorf("Unexpected modification time: %s", ret[2].ModTime)
+	}
+}
+
+func TestFindMaxResults(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	for i := 0; i < 10; i++ {
+		touch(fmt.Sprintf("d%d/f.go", i))
+	}
+	for _, tt := range []struct {
+		max       int
+		count     int
+		truncated bool
+	}{
+		{0, 10, false},
+		{3, 3, true},
+		{10, 10, false},
+		{11, 10, false},
+	} {
+		ret, truncated, err := Find(".", []string{"**"}, nil, FindOptions{MaxResults: tt.max})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ret) != tt.count || truncated != tt.truncated {
+			t.Errorf("max %d: expected %d files, truncated %v, got %d, %v", tt.max, tt.count, tt.truncated, len(ret), truncated)
+		}
+	}
+
+	// Stopping the walk early mustn't leave directories open
+	fds := func() int {
+		entries, err := ioutil.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skip("can't count open files")
+		}
+		return len(entries)
+	}
+	before := fds()
+	for i := 0; i < 100; i++ {
+		if _, _, err := Find(".", []string{"**"}, nil, FindOptions{MaxResults: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if after := fds(); after > before {
+		t.Errorf("Open files grew from %d to %d", before, after)
+	}
+}
+
+func TestExpandToFiles(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	touch("a/one.go")
+	touch("a/b/two.go")
+	touch("a/skip.txt")
+	touch("c.go")
+
+	for pattern, expected := range map[string][]string{
+		"a/**/*.go": {"a/b/two.go", "a/one.go"},
+		"*.go":      {"c.go"},
+		"a/":        {},
+		"missing/*": {},
+	} {
+		ret, err := ExpandToFiles(".", pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ret, expected) {
+			t.Errorf("%s: expected\n%#v\ngot\n%#v", pattern, expected, ret)
+		}
+	}
+
+	for _, pattern := range []string{"a/[b", "{a,b", ""} {
+		_, err := ExpandToFiles(".", pattern)
+		if perr, ok := err.(*PatternError); !ok || perr.Pattern != pattern {
+			t.Errorf("%q: expected a PatternError, got %v", pattern, err)
+		}
+	}
+	_, err := ExpandToFiles(".", "a/[b")
+	if expected := `invalid pattern "a/[b": unterminated character class`; err == nil || err.Error() != expected {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestFindText(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	touch("empty.go")
+	touch("a/text.go")
+	files := map[string][]byte{
+		"a/text.go":  []byte("package a\n"),
+		"a/binary":   {0x7f, 'E', 'L', 'F', 2, 1, 1, 0, 0, 0},
+		"a/late.bin": append(bytes.Repeat([]byte("x"), 1000), 0),
+	}
+	for p, data := range files {
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ret, err := FindText(".", []string{"**"}, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{}
+	for _, f := range ret {
+		paths = append(paths, f.Path)
+	}
+	// A NUL byte beyond the sniffed prefix isn't detected
+	expected := []string{"a/late.bin", "a/text.go", "empty.go"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, paths)
+	}
+}
+
+func TestFindSkipEmpty(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	touch("a/main.o")
+	if err := ioutil.WriteFile("a/placeholder.o", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ret, _, err := Find(".", []string{"**"}, []string{}, FindOptions{SkipEmpty: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{}
+	for _, f := range ret {
+		paths = append(paths, f.Path)
+	}
+	expected := []string{"a/main.o"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, paths)
+	}
+
+	all, err := FindInfo(".", []string{"**"}, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 {
+		t.Errorf("Expected FindInfo to list both files, got %#v", all)
+	}
+
+	// Empty files don't count towards the cap
+	opts := FindOptions{SkipEmpty: true, MaxResults: 1}
+	if ret, truncated, err := Find(".", []string{"**"}, nil, opts); err != nil || len(ret) != 1 || truncated {
+		t.Errorf("Expected one file and no truncation, got %#v, %v, %v", ret, truncated, err)
+	}
+}
+
+func TestSortByModTime(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	now := time.Now()
+	mtimes := map[string]time.Duration{
+		"a.go": 2 * time.Hour,
+		"b.go": 0,
+		"c.go": time.Hour,
+		"d.go": time.Hour,
+	}
+	for p, age := range mtimes {
+		touch(p)
+		then := now.Add(-age)
+		if err := os.Chtimes(p, then, then); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	order := func(newestFirst bool) []string {
+		files, err := FindInfo(".", []string{"*.go"}, []string{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		SortByModTime(files, newestFirst)
+		paths := []string{}
+		for _, f := range files {
+			paths = append(paths, f.Path)
+		}
+		return paths
+	}
+	tests := []struct {
+		newestFirst bool
+		expected    []string
+	}{
+		{true, []string{"b.go", "c.go", "d.go", "a.go"}},
+		{false, []string{"a.go", "c.go", "d.go", "b.go"}},
+	}
+	for _, tt := range tests {
+		if ret := order(tt.newestFirst); !reflect.DeepEqual(ret, tt.expected) {
+			t.Errorf("newestFirst=%v: expected %v, got %v", tt.newestFirst, tt.expected, ret)
+		}
+	}
+}
+
+func TestFindNewestPerDir(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	now := time.Now()
+	mtimes := map[string]time.Duration{
+		"top.go":      0,
+		"a/old.go":    2 * time.Hour,
+		"a/new.go":    time.Hour,
+		"a/b/x.go":    time.Hour,
+		"a/b/y.go":    time.Hour,
+		"a/b/skip.go": 0,
+		"c/one.go":    3 * time.Hour,
+		"c/newer.txt": 0,
+	}
+	for p, age := range mtimes {
+		touch(p)
+		then := now.Add(-age)
+		if err := os.Chtimes(p, then, then); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ret, err := FindNewestPerDir(".", []string{"**/*.go"}, []string{"**/skip.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		".":   "top.go",
+		"a":   "a/new.go",
+		"a/b": "a/b/x.go",
+		"c":   "c/one.go",
+	}
+	if !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestFindHash(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	touch("a/one.go")
+	touch("a/two.go")
+	touch("a/other.txt")
+
+	hash := func() string {
+		h, err := FindHash(".", []string{"a/*.go"}, []string{"a/two.go"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	orig := hash()
+	if hash() != orig {
+		t.Error("Hash is not stable")
+	}
+
+	// Changes to files that don't match leave the hash unchanged
+	touch("a/other.txt")
+	touch("a/two.go")
+	if hash() != orig {
+		t.Error("Hash changed with a non-matching file")
+	}
+
+	err := ioutil.WriteFile("a/one.go", []byte("package a"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resized := hash()
+	if resized == orig {
+		t.Error("Hash unchanged after resize")
+	}
+
+	later := time.Now().Add(time.Minute)
+	err = os.Chtimes("a/one.go", later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	touched := hash()
+	if touched == resized {
+		t.Error("Hash unchanged after modification time changed")
+	}
+
+	touch("a/three.go")
+	if hash() == touched {
+		t.Error("Hash unchanged after a file was added")
+	}
+}
+
+func TestRefilterCache(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	for _, p := range []string{
+		"main.go", "main_test.go", "a/b.go", "a/b/c.go", "a/schema.sql",
+		"web/app.js", "web/vendor/lib.js", ".hidden/x.go",
+	} {
+		touch(p)
+	}
+	cache, err := ListAll(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cache) != 8 {
+		t.Fatalf("Expected all files to be listed, got %#v", cache)
+	}
+
+	patterns := []struct{ includes, excludes []string }{
+		{[]string{"**/*.go"}, nil},
+		{[]string{"**/*.go"}, []string{"**/*_test.go", "a/b/**"}},
+		{[]string{"web/**", "*.go"}, []string{"**/vendor/**"}},
+		{[]string{"a/*"}, nil},
+		{[]string{"nothing/**"}, nil},
+	}
+	for _, p := range patterns {
+		ret, err := RefilterCache(cache, p.includes, p.excludes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Refiltering gives the same files as a fresh search
+		found, err := FindInfo(".", p.includes, p.excludes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{}
+		for _, f := range found {
+			expected = append(expected, f.Path)
+		}
+		if !reflect.DeepEqual(ret, expected) {
+			t.Errorf("%v !%v: expected\n%#v\nGot\n%#v", p.includes, p.excludes, expected, ret)
+		}
+	}
+
+	if _, err := RefilterCache(cache, []string{"[a-"}, nil); err == nil {
+		t.Error("Expected an error for a malformed pattern")
+	}
+}
+
+func TestFilterFiles(t *testing.T) {
+	files := []string{"a.go", "a_test.go", "b.go", "README.md", "sub/c.go"}
+	ret, err := FilterFiles(files, []string{"*.go"}, []string{"*_test.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &FilterResult{
+		Files:    []string{"a.go", "b.go"},
+		Total:    5,
+		Included: 3,
+		Excluded: 1,
+	}
+	if !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+
+	ret, err = FilterFiles(files, []string{"**/*.go"}, []string{"**"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ret.Files) != 0 || ret.Included != 4 || ret.Excluded != 4 {
+		t.Errorf("Expected everything to be excluded, got %#v", ret)
+	}
+
+	_, err = FilterFiles(files, []string{"[a"}, nil)
+	if err == nil {
+		t.Error("Expected an error for a malformed pattern")
+	}
+}
+
+func TestPartition(t *testing.T) {
+	files := []string{
+		"main.go", "main_test.go", "a/b.go", "a/b/c.go", "a/schema.sql",
+		"web/app.js", "web/vendor/lib.js", ".hidden/x.go",
+	}
+	patterns := []struct{ includes, excludes []string }{
+		{[]string{"**/*.go"}, nil},
+		{[]string{"**/*.go"}, []string{"**/*_test.go", "a/b/**"}},
+		{[]string{"web/**", "*.go"}, []string{"**/vendor/**"}},
+		{[]string{"a/*"}, nil},
+		{[]string{"nothing/**"}, nil},
+	}
+	for _, p := range patterns {
+		kept, dropped, err := Partition(files, p.includes, p.excludes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filtered, err := FilterFiles(files, p.includes, p.excludes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(kept, filtered.Files) {
+			t.Errorf("%v !%v: expected kept files\n%#v\nGot\n%#v", p.includes, p.excludes, filtered.Files, kept)
+		}
+		seen := map[string]bool{}
+		for _, f := range append(append([]string{}, kept...), dropped...) {
+			if seen[f] {
+				t.Errorf("%v !%v: %s is both kept and dropped", p.includes, p.excludes, f)
+			}
+			seen[f] = true
+		}
+		if len(seen) != len(files) {
+			t.Errorf("%v !%v: expected %d files in all, got %d", p.includes, p.excludes, len(files), len(seen))
+		}
+	}
+
+	if _, _, err := Partition(files, []string{"[a"}, nil); err == nil {
+		t.Error("Expected an error for a malformed pattern")
+	}
+}
+
+func TestFilterFilesTrailingSeparators(t *testing.T) {
+	tests := []struct {
+		path     string
+		patterns []string
+		match    bool
+	}{
+		{"a/b/", []string{"a/b"}, true},
+		{"a/b/", []string{"a/b/**"}, true},
+		{"a/b/", []string{"a/**"}, true},
+		{"a/b/", []string{"**/b"}, true},
+		{"a/b//", []string{"a/b"}, true},
+		{"a/b", []string{"a/b/"}, true},
+		{"a/b/", []string{"a/b/"}, true},
+		{"a/b/c", []string{"a/b/"}, false},
+		{"a/bc/", []string{"a/b"}, false},
+		{"a/b", []string{"a/b/**"}, false},
+	}
+	for _, tt := range tests {
+		ret, err := FilterFiles([]string{tt.path}, tt.patterns, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match := len(ret.Files) == 1; match != tt.match {
+			t.Errorf("%q against %v: expected match %v", tt.path, tt.patterns, tt.match)
+		}
+		// Excludes treat paths the same way
+		ret, err = FilterFiles([]string{tt.path}, []string{"**"}, tt.patterns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if excluded := ret.Excluded == 1; excluded != tt.match {
+			t.Errorf("%q excluded by %v: expected %v", tt.path, tt.patterns, tt.match)
+		}
+	}
+}
+
+// TestListMatchesWatcher checks that the files listed for @mods are the files
+// whose changes the watcher would pass to each block
+func TestListMatchesWatcher(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	for _, p := range []string{
+		"main.go", "gen/api.pb.go", "docs/a.md", ".cache/x.go", "src/.env",
+		"src/app.js", "dist/app.min.js", "node_modules/dep/index.js", "web/.hidden/b.js",
+	} {
+		touch(p)
+	}
+	err := ioutil.WriteFile(".gitattributes", []byte("gen/** linguist-generated\n*.md linguist-generated=false\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(".npmignore", []byte("dist/\nnode_modules\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cnf, err := conf.Parse("test", `
+		**/*.go +nohidden {}
+		** +gitattributes=linguist-generated {}
+		**/*.js +npmignore +nohidden {}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every file the watcher reports, as the watch loop sets it up
+	root, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing, err := moddwatch.List(root, realPatterns(root, cnf.WatchedPatterns()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The listing has a file once for each pattern it lies under, but a
+	// change is only reported once
+	seen := map[string]bool{}
+	all := []string{}
+	for _, p := range listing {
+		if !seen[p] {
+			seen[p] = true
+			all = append(all, p)
+		}
+	}
+	// Spot checks that the options took effect
+	excluded := map[int]string{1: ".cache/x.go", 2: "gen/api.pb.go", 3: "dist/app.min.js"}
+	for i, b := range cnf.Blocks {
+		listed, err := varcmd.ListFiles(".", b.Include, b.Exclude)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mod, err := filterBlock(root, &moddwatch.Mod{Added: all}, b.RealPaths(root))
+		if err != nil {
+			t.Fatal(err)
+		}
+		watched := mod.Added
+		for _, p := range listed {
+			if p == excluded[i+1] {
+				t.Errorf("block %d: expected %s to be excluded", i+1, p)
+			}
+		}
+		sort.Strings(listed)
+		sort.Strings(watched)
+		if !reflect.DeepEqual(listed, watched) {
+			t.Errorf("block %d: listed\n%#v\nbut the watcher matches\n%#v", i+1, listed, watched)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package modd
+
+import (
+	"os"
+	"path/filepath"
+	"unicode"
+)
+
+// swapCase swaps the case of every letter in s
+func swapCase(s string) string {
+	runes := []rune(s)
+	for i, r := range runes {
+		if u := unicode.ToUpper(r); u != r {
+			runes[i] = u
+		} else {
+			runes[i] = unicode.ToLower(r)
+		}
+	}
+	return string(runes)
+}
+
+// caseInsensitive checks whether the volume dir is on looks up names without
+// regard to case, as is usual on macOS and Windows. This is tested on the
+// nearest directory, from dir upwards, whose name contains a letter, by
+// checking whether its name with the case of its letters swapped refers to
+// the same directory. Nothing is written to disk. If no such directory is
+// found, the volume is assumed to be case sensitive.
+func caseInsensitive(dir string) bool {
+	d, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	for {
+		name := filepath.Base(d)
+		if swapped := swapCase(name); swapped != name {
+			fi, err := os.Stat(d)
+			if err != nil {
+				return false
+			}
+			sfi, err := os.Stat(filepath.Join(filepath.Dir(d), swapped))
+			if err != nil {
+				return false
+			}
+			return os.SameFile(fi, sfi)
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			return false
+		}
+		d = parent
+	}
+}
@@ -0,0 +1,59 @@
+package modd
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/utils"
+	"github.com/cortesi/moddwatch"
+	"github.com/cortesi/termlog"
+)
+
+func TestSwapCase(t *testing.T) {
+	if ret := swapCase("Foo-bar.Go1"); ret != "fOO-BAR.gO1" {
+		t.Errorf("Unexpected result: %q", ret)
+	}
+}
+
+func TestCaseInsensitiveRouting(t *testing.T) {
+	if runtime.GOOS != "darwin" && runtime.GOOS != "windows" {
+		t.Skip("skipping - only macOS and Windows have case insensitive volumes by default")
+	}
+	defer utils.WithTempDir(t)()
+	if !caseInsensitive(".") {
+		t.Skip("skipping - the temporary directory is on a case sensitive volume")
+	}
+
+	cnf, err := conf.Parse("test", `
+		@shell = modd
+		foo.go src/**/*.go !src/**/skip.go {
+			prep +onchange: echo ":changed:" @mods
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	modchan := make(chan *moddwatch.Mod, 1024)
+	cback := func() {
+		touch("Foo.go")
+		expected := []string{":changed: ./Foo.go"}
+		waitEvents(t, lt, expected)
+
+		touch("src/SKIP.go")
+		touch("src/Bar.GO")
+		expected = append(expected, ":changed: ./src/Bar.GO")
+		waitEvents(t, lt, expected)
+		modchan <- nil
+	}
+
+	mr := ModRunner{
+		Log:    lt.Log,
+		Config: cnf,
+	}
+	err = mr.runOnChan(modchan, cback)
+	if err != nil {
+		t.Fatalf("runOnChan: %s", err)
+	}
+}
@@ -0,0 +1,158 @@
+package modd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cortesi/moddwatch"
+)
+
+// The @tracked variable restricts the files that trigger blocks. With "git",
+// only files in the git index trigger blocks.
+const (
+	trackedVarName = "@tracked"
+	trackedGit     = "git"
+)
+
+// gitFiles caches the set of files tracked by git in a repository. The set is
+// re-read whenever the index file changes.
+type gitFiles struct {
+	// The top level of the repository, with symlinks resolved
+	top string
+	// The path of the index file
+	index string
+	// Modification time of the index when the set was last read
+	mtime time.Time
+	// Tracked files, relative to top and slash-delimited
+	files map[string]bool
+}
+
+// git runs a git command in dir, and returns its output
+func git(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s", msg)
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// newGitFiles finds the git repository containing dir. An error is returned if
+// dir is not in a repository, or git can't be run.
+func newGitFiles(dir string) (*gitFiles, error) {
+	out, err := git(dir, "rev-parse", "--show-toplevel", "--git-path", "index")
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 2 {
+		return nil, fmt.Errorf("unexpected output from git rev-parse: %q", out)
+	}
+	top, err := filepath.EvalSymlinks(lines[0])
+	if err != nil {
+		return nil, err
+	}
+	index := lines[1]
+	if !filepath.IsAbs(index) {
+		index = filepath.Join(dir, index)
+	}
+	return &gitFiles{top: top, index: index}, nil
+}
+
+// refresh re-reads the tracked files if the index has changed
+func (g *gitFiles) refresh() error {
+	var mtime time.Time
+	if fi, err := os.Stat(g.index); err == nil {
+		mtime = fi.ModTime()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if g.files != nil && mtime.Equal(g.mtime) {
+		return nil
+	}
+	out, err := git(g.top, "ls-files", "-z")
+	if err != nil {
+		return err
+	}
+	files := map[string]bool{}
+	for _, p := range strings.Split(string(out), "\x00") {
+		if p != "" {
+			files[p] = true
+		}
+	}
+	g.files = files
+	g.mtime = mtime
+	return nil
+}
+
+// filter returns only the tracked files in a mod. Relative paths in the mod
+// are taken to be relative to root.
+func (g *gitFiles) filter(root string, mod *moddwatch.Mod) (*moddwatch.Mod, error) {
+	if err := g.refresh(); err != nil {
+		return nil, err
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if real, err := filepath.EvalSymlinks(root); err == nil {
+		root = real
+	}
+	keep := func(paths []string) []string {
+		ret := []string{}
+		for _, p := range paths {
+			abs := filepath.FromSlash(p)
+			if !filepath.IsAbs(abs) {
+				abs = filepath.Join(root, abs)
+			}
+			rel, err := filepath.Rel(g.top, abs)
+			if err != nil {
+				continue
+			}
+			if g.files[filepath.ToSlash(rel)] {
+				ret = append(ret, p)
+			}
+		}
+		return ret
+	}
+	return &moddwatch.Mod{
+		Changed: keep(mod.Changed),
+		Deleted: keep(mod.Deleted),
+		Added:   keep(mod.Added),
+	}, nil
+}
+
+// trackedOnly filters a mod down to the files tracked by git, if the @tracked
+// variable asks for it. Outside a git repository, a warning is shown once and
+// all files are passed through.
+func (mr *ModRunner) trackedOnly(root string, mod *moddwatch.Mod) *moddwatch.Mod {
+	if mr.Config.GetVariables()[trackedVarName] != trackedGit || mr.noGit {
+		return mod
+	}
+	if mr.gitFiles == nil {
+		g, err := newGitFiles(root)
+		if err != nil {
+			mr.Log.Warn("Not filtering by git tracked files: %s", err)
+			mr.noGit = true
+			return mod
+		}
+		mr.gitFiles = g
+	}
+	ret, err := mr.gitFiles.filter(root, mod)
+	if err != nil {
+		mr.Log.Warn("Error reading git tracked files: %s", err)
+		return mod
+	}
+	return ret
+}
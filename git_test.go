@@ -0,0 +1,91 @@
+package modd
+
+import (
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/utils"
+	"github.com/cortesi/moddwatch"
+	"github.com/cortesi/termlog"
+)
+
+func trackedRunner(t *testing.T) (*ModRunner, *DaemonWorld, *termlog.LogTest) {
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		@tracked = git
+		** {
+			prep +onchange: echo ":tracked:" @mods
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := &ModRunner{
+		Log:        lt.Log,
+		Config:     cnf,
+		quietUntil: make([]time.Time, len(cnf.Blocks)),
+	}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mr, dworld, lt
+}
+
+func TestTracked(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	defer utils.WithTempDir(t)()
+
+	touch("a.go")
+	touch("sub/b.go")
+	touch("untracked.go")
+	for _, args := range [][]string{{"init", "-q"}, {"add", "a.go", "sub/b.go"}} {
+		if _, err := git(".", args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mr, dworld, lt := trackedRunner(t)
+	mr.trigger(".", &moddwatch.Mod{Changed: []string{"a.go", "untracked.go"}}, dworld)
+	mr.trigger(".", &moddwatch.Mod{Added: []string{"untracked.go"}}, dworld)
+	mr.trigger(".", &moddwatch.Mod{Changed: []string{"sub/b.go"}}, dworld)
+
+	// Adding a file to the index refreshes the tracked set
+	if _, err := git(".", "add", "untracked.go"); err != nil {
+		t.Fatal(err)
+	}
+	mr.trigger(".", &moddwatch.Mod{Changed: []string{"untracked.go"}}, dworld)
+
+	expected := []string{
+		":tracked: ./a.go", ":tracked: ./sub/b.go", ":tracked: ./untracked.go",
+	}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestTrackedNoRepo(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	defer utils.WithTempDir(t)()
+
+	mr, dworld, lt := trackedRunner(t)
+	mr.trigger(".", &moddwatch.Mod{Changed: []string{"a.go"}}, dworld)
+	mr.trigger(".", &moddwatch.Mod{Changed: []string{"b.go"}}, dworld)
+
+	expected := []string{":tracked: ./a.go", ":tracked: ./b.go"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+	if n := strings.Count(lt.String(), "Not filtering by git tracked files"); n != 1 {
+		t.Errorf("Expected a single warning, got %d:\n%s", n, lt.String())
+	}
+}
@@ -0,0 +1,126 @@
+package modd
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cortesi/termlog"
+)
+
+// Hooks receives lifecycle events for the commands modd runs, for programs that
+// embed modd and present command progress themselves. Calls are serialized, so
+// implementations need no locking of their own, and a call blocks the command
+// that triggered it until it returns. Start and exit events for prep commands
+// are delivered from the runner goroutine. Daemon events are delivered from
+// the goroutine supervising the daemon, and output lines from the goroutines
+// reading command output. A panic in a hook is recovered and logged.
+type Hooks interface {
+	// CommandStart is called before a command starts
+	CommandStart(c CommandInfo)
+	// CommandOutput is called for each line of output from a command
+	CommandOutput(c CommandInfo, line string, stderr bool)
+	// CommandExit is called when a command exits. The exit code is -1 if the
+	// command could not be started or was terminated by a signal.
+	CommandExit(c CommandInfo, duration time.Duration, exitCode int)
+}
+
+// CommandInfo identifies a command in lifecycle hooks
+type CommandInfo struct {
+	// The block number, starting at 1, in order of declaration
+	Block int
+	// One of "prep", "onsuccess", "onfailure", "daemon" or "shutdown"
+	Kind string
+	// The command, with variables expanded
+	Command string
+}
+
+// blockHooks delivers events for the commands of a block. A nil *blockHooks
+// delivers nothing.
+type blockHooks struct {
+	hooks Hooks
+	block int
+	log   termlog.Logger
+	// Shared by all blocks, so that calls are serialized
+	lock *sync.Mutex
+}
+
+// blockHooks returns the hooks for the block with the given index, or nil if
+// no hooks are set
+func (mr *ModRunner) blockHooks(i int) *blockHooks {
+	if mr.Hooks == nil {
+		return nil
+	}
+	return &blockHooks{hooks: mr.Hooks, block: i + 1, log: mr.Log, lock: &mr.hookLock}
+}
+
+// command returns the hooks for a single command in the block
+func (b *blockHooks) command(kind string, command string) *commandHooks {
+	if b == nil {
+		return nil
+	}
+	return &commandHooks{b, CommandInfo{Block: b.block, Kind: kind, Command: command}}
+}
+
+// commandHooks delivers events for a single command. A nil *commandHooks
+// delivers nothing.
+type commandHooks struct {
+	*blockHooks
+	info CommandInfo
+}
+
+// call runs a hook, recovering from and logging any panic
+func (c *commandHooks) call(name string, f func()) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	defer func() {
+		if r := recover(); r != nil {
+			c.log.Shout("Panic in %s hook: %v", name, r)
+		}
+	}()
+	f()
+}
+
+func (c *commandHooks) start() {
+	if c != nil {
+		c.call("CommandStart", func() { c.hooks.CommandStart(c.info) })
+	}
+}
+
+func (c *commandHooks) output(line string, stderr bool) {
+	if c != nil {
+		c.call("CommandOutput", func() { c.hooks.CommandOutput(c.info, line, stderr) })
+	}
+}
+
+func (c *commandHooks) exit(duration time.Duration, exitCode int) {
+	if c != nil {
+		c.call("CommandExit", func() { c.hooks.CommandExit(c.info, duration, exitCode) })
+	}
+}
+
+// stream wraps a stream so that command output is also passed to the
+// CommandOutput hook
+func (c *commandHooks) stream(s termlog.Stream) termlog.Stream {
+	if c == nil {
+		return s
+	}
+	return &hookStream{Stream: s, hooks: c}
+}
+
+// hookStream is a termlog.Stream that passes command output - anything logged
+// with Say or Warn - to the CommandOutput hook
+type hookStream struct {
+	termlog.Stream
+	hooks *commandHooks
+}
+
+func (h *hookStream) Say(format string, args ...interface{}) {
+	h.hooks.output(fmt.Sprintf(format, args...), false)
+	h.Stream.Say(format, args...)
+}
+
+func (h *hookStream) Warn(format string, args ...interface{}) {
+	h.hooks.output(fmt.Sprintf(format, args...), true)
+	h.Stream.Warn(format, args...)
+}
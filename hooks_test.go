@@ -0,0 +1,102 @@
+package modd
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/utils"
+	"github.com/cortesi/termlog"
+)
+
+// recordHooks records lifecycle events as strings
+type recordHooks struct {
+	events []string
+	panic  bool
+}
+
+func (r *recordHooks) CommandStart(c CommandInfo) {
+	r.events = append(r.events, fmt.Sprintf("start %d %s %s", c.Block, c.Kind, c.Command))
+	if r.panic {
+		panic("oops")
+	}
+}
+
+func (r *recordHooks) CommandOutput(c CommandInfo, line string, stderr bool) {
+	r.events = append(r.events, fmt.Sprintf("output %d %s %v", c.Block, line, stderr))
+}
+
+func (r *recordHooks) CommandExit(c CommandInfo, duration time.Duration, exitCode int) {
+	if duration <= 0 {
+		r.events = append(r.events, "invalid duration")
+	}
+	r.events = append(r.events, fmt.Sprintf("exit %d %s %d", c.Block, c.Kind, exitCode))
+}
+
+func hooksRunner(t *testing.T, hooks Hooks) (*ModRunner, *DaemonWorld, *termlog.LogTest) {
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		** {
+			prep: echo out; echo err >&2
+		}
+		** {
+			prep: exit 3
+			onfailure: echo failed
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := &ModRunner{
+		Log:        lt.Log,
+		Config:     cnf,
+		Hooks:      hooks,
+		quietUntil: make([]time.Time, len(cnf.Blocks)),
+	}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mr, dworld, lt
+}
+
+func TestHooks(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	hooks := &recordHooks{}
+	mr, dworld, _ := hooksRunner(t, hooks)
+	mr.trigger(".", nil, dworld)
+
+	// Output lines from stdout and stderr can arrive in either order
+	cmd := "echo out; echo err >&2"
+	expected := []string{
+		"start 1 prep " + cmd, "output 1 err true", "output 1 out false", "exit 1 prep 0",
+		"start 2 prep exit 3", "exit 2 prep 3",
+		"start 2 onfailure echo failed", "output 2 failed false", "exit 2 onfailure 0",
+	}
+	if hooks.events[1] > hooks.events[2] {
+		hooks.events[1], hooks.events[2] = hooks.events[2], hooks.events[1]
+	}
+	if !reflect.DeepEqual(hooks.events, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, hooks.events)
+	}
+}
+
+func TestHooksPanic(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	hooks := &recordHooks{panic: true}
+	mr, dworld, lt := hooksRunner(t, hooks)
+	mr.trigger(".", nil, dworld)
+
+	if n := strings.Count(lt.String(), "Panic in CommandStart hook: oops"); n != 3 {
+		t.Errorf("Expected 3 panics to be logged, got %d:\n%s", n, lt.String())
+	}
+	if !strings.Contains(lt.String(), "failed") {
+		t.Errorf("Expected commands to run despite panics, got:\n%s", lt.String())
+	}
+}
@@ -0,0 +1,121 @@
+package modd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const triggerPrefix = "/trigger/"
+
+var errNoBlock = errors.New("no such block")
+
+// A request to run a block, sent from the HTTP server to the main loop. Block
+// numbers start at 1, in order of declaration.
+type triggerRequest struct {
+	block  int
+	result chan error
+}
+
+// TriggerResponse is the JSON body returned for a trigger request
+type TriggerResponse struct {
+	Block   int    `json:"block"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	// The exit code of the prep command that failed, 0 if all succeeded, or -1
+	// if the block failed without a command exiting
+	ExitCode int `json:"exit_code"`
+}
+
+// triggerBlock runs a single block as if a change had occurred.
+func (mr *ModRunner) triggerBlock(block int, dworld *DaemonWorld) error {
+	if block < 1 || block > len(mr.Config.Blocks) {
+		return fmt.Errorf("%w: %d", errNoBlock, block)
+	}
+	mr.Log.Notice("Triggering block %d via HTTP", block)
+	var err error
+	mr.exclusive(block-1, func() {
+		err = mr.runBlock(block-1, nil, dworld.DaemonPens[block-1], false)
+	})
+	return err
+}
+
+// ServeHTTP handles POST requests to /trigger/<block>
+func (mr *ModRunner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, triggerPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	block, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, triggerPrefix))
+	if err != nil {
+		http.Error(w, "invalid block number", http.StatusBadRequest)
+		return
+	}
+	req := triggerRequest{block: block, result: make(chan error, 1)}
+	select {
+	case mr.triggers <- req:
+	case <-r.Context().Done():
+		return
+	}
+
+	resp := TriggerResponse{Block: block, Success: true}
+	status := http.StatusOK
+	if err := <-req.result; err != nil {
+		resp.Success = false
+		resp.Error = err.Error()
+		resp.ExitCode = -1
+		var perr ProcError
+		if errors.As(err, &perr) {
+			resp.ExitCode = perr.ExitCode
+		}
+		status = http.StatusInternalServerError
+		if errors.Is(err, errNoBlock) {
+			status = http.StatusNotFound
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// listenAddr binds addresses without an explicit host to localhost, so that
+// the trigger server is not exposed to the network by accident.
+func listenAddr(addr string) (string, error) {
+	if !strings.Contains(addr, ":") {
+		addr = ":" + addr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// listen starts the HTTP trigger server in the background
+func (mr *ModRunner) listen(addr string) (*http.Server, error) {
+	addr, err := listenAddr(addr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid listen address: %s", err)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Error listening: %s", err)
+	}
+	mr.triggers = make(chan triggerRequest)
+	srv := &http.Server{Handler: mr}
+	go srv.Serve(l)
+	mr.Log.Notice("Listening for triggers on http://%s%s", l.Addr(), triggerPrefix)
+	return srv, nil
+}
@@ -0,0 +1,63 @@
+package modd
+
+import (
+	"sync"
+
+	"github.com/cortesi/termlog"
+)
+
+// limitStream is a termlog.Stream that passes through at most limit lines of
+// command output. Output is anything logged with Say or Warn - notices and
+// errors from modd itself are always passed through.
+type limitStream struct {
+	termlog.Stream
+	limit   int
+	lines   int
+	dropped int
+	sync.Mutex
+}
+
+// allow counts a line of output, and checks whether it should be displayed
+func (l *limitStream) allow() bool {
+	l.Lock()
+	defer l.Unlock()
+	l.lines++
+	if l.lines > l.limit {
+		l.dropped++
+		return false
+	}
+	return true
+}
+
+func (l *limitStream) Say(format string, args ...interface{}) {
+	if l.allow() {
+		l.Stream.Say(format, args...)
+	}
+}
+
+func (l *limitStream) Warn(format string, args ...interface{}) {
+	if l.allow() {
+		l.Stream.Warn(format, args...)
+	}
+}
+
+func (l *limitStream) SayAs(name string, format string, args ...interface{}) {
+	if l.allow() {
+		l.Stream.SayAs(name, format, args...)
+	}
+}
+
+func (l *limitStream) WarnAs(name string, format string, args ...interface{}) {
+	if l.allow() {
+		l.Stream.WarnAs(name, format, args...)
+	}
+}
+
+// finish reports the number of lines that were dropped, if any
+func (l *limitStream) finish() {
+	l.Lock()
+	defer l.Unlock()
+	if l.dropped > 0 {
+		l.Stream.Notice("… (%d more lines)", l.dropped)
+	}
+}
@@ -0,0 +1,36 @@
+package modd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cortesi/termlog"
+)
+
+func TestOutputLimit(t *testing.T) {
+	lt := termlog.NewLogTest()
+	err := RunProcWith(
+		"for i in 1 2 3 4 5; do echo :out$i:; echo :err$i: >&2; done",
+		"bash", "", lt.Log.Stream("test"), ProcOptions{OutputLimit: 3},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := lt.String()
+	lines := strings.Count(out, ":out") + strings.Count(out, ":err")
+	if lines != 3 {
+		t.Errorf("Expected 3 lines of output, got %d:\n%s", lines, out)
+	}
+	if !strings.Contains(out, "… (7 more lines)") {
+		t.Errorf("Truncation not reported:\n%s", out)
+	}
+
+	lt = termlog.NewLogTest()
+	err = RunProcWith("echo :one:", "bash", "", lt.Log.Stream("test"), ProcOptions{OutputLimit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(lt.String(), "more lines") {
+		t.Errorf("Unexpected truncation:\n%s", lt.String())
+	}
+}
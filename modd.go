@@ -1,11 +1,16 @@
 package modd
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/cortesi/modd/conf"
@@ -22,6 +27,15 @@ const lullTime = time.Millisecond * 100
 
 const shellVarName = "@shell"
 
+// The @match variable selects how changed files are routed to blocks. By
+// default, a file triggers every block that matches it. With "first", a file
+// only triggers the first matching block.
+const (
+	matchVarName = "@match"
+	matchAll     = "all"
+	matchFirst   = "first"
+)
+
 // CommonExcludes is a list of commonly excluded files suitable for passing in
 // the excludes parameter to Watch - includes repo directories, temporary
 // files, and so forth.
@@ -59,15 +73,113 @@ type ModRunner struct {
 	ConfPath   string
 	ConfReload bool
 	Notifiers  []notify.Notifier
+
+	// Env names the environment section of the config file whose blocks are
+	// used along with the shared ones, including when the config is reloaded.
+	Env string
+
+	// If Collapse is not nil, consecutive identical failures of a command are
+	// collapsed into a single line of output.
+	Collapse *Collapser
+
+	// ListenAddr is the address of an optional HTTP server that lets blocks
+	// be triggered remotely. The server is disabled if this is empty.
+	ListenAddr string
+
+	// If OutputLimit is greater than zero, at most this many lines of output
+	// are displayed for each prep command.
+	OutputLimit int
+
+	// Changes are ignored for this long after watching starts, to let the
+	// filesystem settle
+	Grace time.Duration
+
+	// Each shutdown command is killed if it runs for longer than this. If it
+	// is zero, DefaultShutdownTimeout is used.
+	ShutdownTimeout time.Duration
+
+	// If Rebuild is set, it is called to build a new config whenever one of
+	// the files in RebuildPaths changes, and the new config is applied like a
+	// reloaded config file. This lets configs that aren't read from a config
+	// file, like those built from command-line flags, be refreshed.
+	Rebuild      func() (*conf.Config, error)
+	RebuildPaths []string
+
+	// If Parallel is set, each block runs in a goroutine of its own when its
+	// files change, so that a slow block doesn't delay the others. Runs of a
+	// single block never overlap.
+	Parallel bool
+	workers  []*blockWorker
+
+	// If MaxConcurrent is greater than zero, at most this many blocks run at
+	// once when blocks run in parallel, and the rest wait their turn in the
+	// order they were triggered. Zero means no limit.
+	MaxConcurrent int
+	limit         *runLimit
+
+	// If TriggerFile is set, the file is created if it doesn't exist and
+	// watched, and any change to it runs all blocks. The file never triggers
+	// blocks through their patterns.
+	TriggerFile string
+
+	// If Hooks is not nil, it receives lifecycle events for all commands
+	Hooks    Hooks
+	hookLock sync.Mutex
+
+	triggers chan triggerRequest
+
+	// Set if the watched volume is case insensitive, in which case patterns
+	// match changes without regard to case, as the filesystem does
+	foldCase bool
+
+	// If MaxRuntime is greater than zero, modd shuts down once it has been
+	// watching for this long, exactly as it does on SIGTERM. The exit status
+	// is 1 if the most recent run of any block failed.
+	MaxRuntime time.Duration
+
+	// Per-block times until which changes are ignored, set after successful
+	// runs of blocks with a cooldown, and whether the most recent run of each
+	// block failed. Both are guarded by quietLock.
+	quietUntil []time.Time
+	failed     []bool
+	quietLock  sync.Mutex
+
+	// Per-block times until which changes are ignored, set when blocks with a
+	// grace period are started
+	graceUntil []time.Time
+
+	// Per-block changes held until blocks with a settle, stable or quiesce
+	// period have settled, the times at which they are due to run, and for
+	// blocks with a stable period, the sizes of the changed files when last
+	// checked. For blocks with a quiesce period, snapshots holds a hash of the
+	// block's file set when last checked, and holdLimit the time by which
+	// held changes run regardless.
+	pending   []*moddwatch.Mod
+	settleAt  []time.Time
+	sizes     []map[string]int64
+	snapshots []string
+	holdLimit []time.Time
+
+	// Cache of files tracked by git, for @tracked. noGit is set if we're not
+	// in a git repository.
+	gitFiles *gitFiles
+	noGit    bool
 }
 
 // NewModRunner constructs a new ModRunner
 func NewModRunner(confPath string, log termlog.TermLog, notifiers []notify.Notifier, confreload bool) (*ModRunner, error) {
+	return NewModRunnerEnv(confPath, "", log, notifiers, confreload)
+}
+
+// NewModRunnerEnv constructs a new ModRunner that uses the section of the
+// config file for the environment env, along with the shared blocks
+func NewModRunnerEnv(confPath string, env string, log termlog.TermLog, notifiers []notify.Notifier, confreload bool) (*ModRunner, error) {
 	mr := &ModRunner{
 		Log:        log,
 		ConfPath:   confPath,
 		ConfReload: confreload,
 		Notifiers:  notifiers,
+		Env:        env,
 	}
 	err := mr.ReadConfig()
 	if err != nil {
@@ -76,30 +188,174 @@ func NewModRunner(confPath string, log termlog.TermLog, notifiers []notify.Notif
 	return mr, nil
 }
 
+// NewModRunnerFromConfig constructs a new ModRunner from a config that has
+// already been built, rather than from a config file.
+func NewModRunnerFromConfig(cnf *conf.Config, log termlog.TermLog, notifiers []notify.Notifier) (*ModRunner, error) {
+	mr := &ModRunner{
+		Log:       log,
+		Notifiers: notifiers,
+	}
+	err := mr.setConfig(cnf)
+	if err != nil {
+		return nil, err
+	}
+	return mr, nil
+}
+
 // ReadConfig parses the configuration file in ConfPath
 func (mr *ModRunner) ReadConfig() error {
+	newcnf, err := mr.loadConfig()
+	if err != nil {
+		return err
+	}
+	mr.Config = newcnf
+	return nil
+}
+
+// loadConfig parses and prepares the configuration file in ConfPath, without
+// making it the current config.
+func (mr *ModRunner) loadConfig() (*conf.Config, error) {
 	ret, err := ioutil.ReadFile(mr.ConfPath)
 	if err != nil {
-		return fmt.Errorf("Error reading config file %s: %s", mr.ConfPath, err)
+		return nil, fmt.Errorf("Error reading config file %s: %s", mr.ConfPath, err)
 	}
-	newcnf, err := conf.Parse(mr.ConfPath, string(ret))
+	newcnf, err := conf.ParseEnv(mr.ConfPath, string(ret), mr.Env)
 	if err != nil {
-		return fmt.Errorf("Error reading config file %s: %s", mr.ConfPath, err)
+		return nil, fmt.Errorf("Error reading config file %s: %s", mr.ConfPath, err)
 	}
+	err = mr.prepareConfig(newcnf)
+	if err != nil {
+		return nil, err
+	}
+	return newcnf, nil
+}
 
-	if _, err := shell.GetShellName(newcnf.GetVariables()[shellVarName]); err != nil {
+func (mr *ModRunner) setConfig(newcnf *conf.Config) error {
+	err := mr.prepareConfig(newcnf)
+	if err != nil {
 		return err
 	}
+	mr.Config = newcnf
+	return nil
+}
 
+func (mr *ModRunner) prepareConfig(newcnf *conf.Config) error {
+	vars := newcnf.GetVariables()
+	if _, err := shell.GetShellName(vars[shellVarName]); err != nil {
+		return err
+	}
+	switch vars[matchVarName] {
+	case "", matchAll, matchFirst:
+	default:
+		return fmt.Errorf("Unsupported %s value: %q", matchVarName, vars[matchVarName])
+	}
+	switch vars[trackedVarName] {
+	case "", trackedGit:
+	default:
+		return fmt.Errorf("Unsupported %s value: %q", trackedVarName, vars[trackedVarName])
+	}
+	for i, b := range newcnf.Blocks {
+		if b.User == "" {
+			continue
+		}
+		if !shell.UserSupported {
+			mr.Log.Warn(
+				"Block %d: running commands as another user is not supported on %s, ignoring user %s",
+				i+1, runtime.GOOS, b.User,
+			)
+		} else if err := shell.CheckUser(b.User); err != nil {
+			return fmt.Errorf("Invalid user for block %d: %s", i+1, err)
+		}
+	}
 	newcnf.CommonExcludes(CommonExcludes)
-	mr.Config = newcnf
 	return nil
 }
 
+// rebuildNeeded checks whether a change affects any of the RebuildPaths
+func (mr *ModRunner) rebuildNeeded(mod *moddwatch.Mod) bool {
+	for _, p := range mr.RebuildPaths {
+		if mod.Has(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// rebuildConfig builds and prepares a new config with Rebuild
+func (mr *ModRunner) rebuildConfig() (*conf.Config, error) {
+	newcnf, err := mr.Rebuild()
+	if err != nil {
+		return nil, err
+	}
+	if err := mr.prepareConfig(newcnf); err != nil {
+		return nil, err
+	}
+	return newcnf, nil
+}
+
+// CheckConfig checks a parsed config for problems that would prevent it from
+// running, beyond the syntax errors reported by the parser. All problems found
+// are returned.
+func CheckConfig(cnf *conf.Config) []error {
+	errs := []error{}
+	sh, err := shell.GetShellName(cnf.GetVariables()[shellVarName])
+	if err != nil {
+		errs = append(errs, err)
+	} else if _, err := shell.CheckShell(sh); err != nil {
+		errs = append(errs, fmt.Errorf("shell %s: %s", sh, err))
+	}
+	errs = append(errs, CheckCommands(cnf)...)
+	for i, b := range cnf.Blocks {
+		if b.InDir == "" {
+			continue
+		}
+		if fi, err := os.Stat(b.InDir); err != nil {
+			errs = append(errs, fmt.Errorf("block %d: indir: %s", i+1, err))
+		} else if !fi.IsDir() {
+			errs = append(errs, fmt.Errorf("block %d: indir: %s is not a directory", i+1, b.InDir))
+		}
+	}
+	return errs
+}
+
+// CheckCommands checks that all commands can be run by the configured shell.
+// Only the exec shell, which runs commands without a shell, can reject
+// commands in advance.
+func CheckCommands(cnf *conf.Config) []error {
+	errs := []error{}
+	sh, err := shell.GetShellName(cnf.GetVariables()[shellVarName])
+	if err != nil || sh != "exec" {
+		return errs
+	}
+	for i, b := range cnf.Blocks {
+		cmds := []string{}
+		for _, p := range b.Preps {
+			cmds = append(cmds, p.Command)
+			for _, f := range []*conf.FollowUp{p.OnSuccess, p.OnFailure} {
+				if f != nil {
+					cmds = append(cmds, f.Command)
+				}
+			}
+		}
+		for _, d := range b.Daemons {
+			cmds = append(cmds, d.Command)
+		}
+		for _, c := range cmds {
+			if _, err := shell.SplitArgv(c); err != nil {
+				errs = append(errs, fmt.Errorf("block %d: %s", i+1, err))
+			}
+		}
+	}
+	return errs
+}
+
 // PrepOnly runs all prep functions and exits
 func (mr *ModRunner) PrepOnly(initial bool) error {
-	for _, b := range mr.Config.Blocks {
-		err := RunPreps(b, mr.Config.GetVariables(), nil, mr.Log, mr.Notifiers, initial)
+	for i, b := range mr.Config.Blocks {
+		err := RunPrepsWith(
+			b, mr.Config.GetVariables(), nil, blockLog(b, mr.Log), mr.Notifiers, initial,
+			PrepOptions{OutputLimit: mr.OutputLimit, hooks: mr.blockHooks(i)},
+		)
 		if err != nil {
 			return err
 		}
@@ -107,126 +363,472 @@ func (mr *ModRunner) PrepOnly(initial bool) error {
 	return nil
 }
 
-func (mr *ModRunner) runBlock(b conf.Block, mod *moddwatch.Mod, dpen *DaemonPen) {
-	if b.InDir != "" {
-		currentDir, err := os.Getwd()
-		if err != nil {
-			mr.Log.Shout("Error getting current working directory: %s", err)
-			return
-		}
-		err = os.Chdir(b.InDir)
+// PrepAll runs the prep commands of every block, like PrepOnly, but carries
+// on with the remaining blocks when a block fails. Each block still stops at
+// its first failing command. An error is returned if any block failed.
+func (mr *ModRunner) PrepAll(initial bool) error {
+	failed := 0
+	for i, b := range mr.Config.Blocks {
+		err := RunPrepsWith(
+			b, mr.Config.GetVariables(), nil, blockLog(b, mr.Log), mr.Notifiers, initial,
+			PrepOptions{OutputLimit: mr.OutputLimit, hooks: mr.blockHooks(i)},
+		)
 		if err != nil {
-			mr.Log.Shout(
-				"Error changing to indir directory \"%s\": %s",
-				b.InDir,
-				err,
-			)
-			return
-		}
-		defer func() {
-			err := os.Chdir(currentDir)
-			if err != nil {
-				mr.Log.Shout("Error returning to original directory: %s", err)
+			if _, ok := err.(ProcError); !ok {
+				mr.Log.Shout("Error running prep: %s", err)
 			}
-		}()
+			failed++
+		}
 	}
-	err := RunPreps(
+	if failed > 0 {
+		return fmt.Errorf("%d of %d blocks failed", failed, len(mr.Config.Blocks))
+	}
+	return nil
+}
+
+// runBlock runs a block's prep commands, and restarts its daemons if they
+// succeed. Commands are run in the block's indir directory without changing
+// modd's own working directory, so that blocks can run concurrently.
+func (mr *ModRunner) runBlock(i int, mod *moddwatch.Mod, dpen *DaemonPen, initial bool) error {
+	mr.limit.acquire()
+	defer mr.limit.release()
+	b := mr.Config.Blocks[i]
+	err := RunPrepsWith(
 		b,
 		mr.Config.GetVariables(),
-		mod, mr.Log,
+		mod, blockLog(b, mr.Log),
 		mr.Notifiers,
-		mod == nil,
+		initial,
+		PrepOptions{
+			Collapse:    mr.Collapse,
+			OutputLimit: mr.OutputLimit,
+			hooks:       mr.blockHooks(i),
+		},
 	)
+	mr.setFailed(i, err != nil)
 	if err != nil {
 		if _, ok := err.(ProcError); !ok {
 			mr.Log.Shout("Error running prep: %s", err)
 		}
-		return
+		return err
 	}
 	dpen.Restart()
+	return nil
+}
+
+// setFailed records the outcome of the most recent run of a block
+func (mr *ModRunner) setFailed(i int, failed bool) {
+	mr.quietLock.Lock()
+	defer mr.quietLock.Unlock()
+	if i < len(mr.failed) {
+		mr.failed[i] = failed
+	}
+}
+
+// anyFailed checks whether the most recent run of any block failed
+func (mr *ModRunner) anyFailed() bool {
+	mr.quietLock.Lock()
+	defer mr.quietLock.Unlock()
+	for _, f := range mr.failed {
+		if f {
+			return true
+		}
+	}
+	return false
+}
+
+// filterBlock returns the changes in a mod that match a block's patterns.
+// Patterns that are scoped to event types only match events of those types.
+// Paths are matched by FilterFiles, with the same matcher that lists the
+// files for @mods, so that the two agree. If the block has RealPathExcludes
+// set, paths whose real paths are excluded are dropped too.
+func filterBlock(root string, mod *moddwatch.Mod, b conf.Block) (*moddwatch.Mod, error) {
+	ret := &moddwatch.Mod{}
+	for _, e := range []struct {
+		event string
+		paths []string
+		dst   *[]string
+	}{
+		{conf.EventAdded, mod.Added, &ret.Added},
+		{conf.EventChanged, mod.Changed, &ret.Changed},
+		{conf.EventDeleted, mod.Deleted, &ret.Deleted},
+	} {
+		inc, exc := b.EventPatterns(e.event)
+		matched, err := FilterFiles(e.paths, inc, exc)
+		if err != nil {
+			return nil, err
+		}
+		*e.dst = matched.Files
+		if b.RealPathExcludes {
+			kept := []string{}
+			for _, p := range matched.Files {
+				excluded, err := conf.RealExcluded(root, p, exc)
+				if err != nil {
+					return nil, err
+				}
+				if !excluded {
+					kept = append(kept, p)
+				}
+			}
+			*e.dst = kept
+		}
+	}
+	return ret, nil
+}
+
+// filterEvents returns a mod containing only the specified event types. All
+// events are retained if the list is empty.
+func filterEvents(mod *moddwatch.Mod, events []string) *moddwatch.Mod {
+	if len(events) == 0 {
+		return mod
+	}
+	ret := &moddwatch.Mod{}
+	for _, e := range events {
+		switch e {
+		case conf.EventAdded:
+			ret.Added = mod.Added
+		case conf.EventChanged:
+			ret.Changed = mod.Changed
+		case conf.EventDeleted:
+			ret.Deleted = mod.Deleted
+		}
+	}
+	return ret
+}
+
+// claim removes files that have already been claimed by an earlier block from
+// a mod, and claims the files that remain.
+func claim(mod *moddwatch.Mod, claimed map[string]bool) *moddwatch.Mod {
+	unclaimed := func(paths []string) []string {
+		ret := []string{}
+		for _, p := range paths {
+			if !claimed[p] {
+				ret = append(ret, p)
+			}
+		}
+		return ret
+	}
+	ret := &moddwatch.Mod{
+		Changed: unclaimed(mod.Changed),
+		Deleted: unclaimed(mod.Deleted),
+		Added:   unclaimed(mod.Added),
+	}
+	for _, paths := range [][]string{ret.Changed, ret.Deleted, ret.Added} {
+		for _, p := range paths {
+			claimed[p] = true
+		}
+	}
+	return ret
 }
 
 func (mr *ModRunner) trigger(root string, mod *moddwatch.Mod, dworld *DaemonWorld) {
+	if mod != nil {
+		mod = mr.trackedOnly(root, mod)
+		if mod.Empty() {
+			return
+		}
+	}
+	firstMatch := mr.Config.GetVariables()[matchVarName] == matchFirst
+	claimed := map[string]bool{}
 	for i, b := range mr.Config.Blocks {
+		b = b.RealPaths(root)
+		if mr.foldCase {
+			b = b.CaseFolded()
+		}
 		lmod := mod
 		if lmod != nil {
 			var err error
-			lmod, err = mod.Filter(root, b.Include, b.Exclude)
+			lmod, err = filterBlock(root, mod, b)
 			if err != nil {
 				mr.Log.Shout("Error filtering events: %s", err)
 				continue
 			}
+			lmod = filterEvents(lmod, b.Events)
+			if firstMatch {
+				lmod = claim(lmod, claimed)
+			}
 			if lmod.Empty() {
 				continue
 			}
+			mr.quietLock.Lock()
+			quiet := time.Now().Before(mr.quietUntil[i])
+			mr.quietLock.Unlock()
+			if quiet {
+				mr.Log.SayAs("debug", "Ignoring changes for block %d during cooldown", i+1)
+				continue
+			}
+			if i < len(mr.graceUntil) && time.Now().Before(mr.graceUntil[i]) {
+				mr.Log.SayAs("debug", "Ignoring changes for block %d during its grace period", i+1)
+				continue
+			}
+			if b.Settle > 0 || b.Stable > 0 || b.Quiesce > 0 {
+				mr.hold(i, lmod)
+				continue
+			}
+		}
+		mr.dispatch(i, lmod, dworld)
+	}
+}
+
+// runBlockAt runs the block with the given index, and starts its cooldown if
+// it succeeds. A nil mod means this is the initial run.
+func (mr *ModRunner) runBlockAt(i int, mod *moddwatch.Mod, dworld *DaemonWorld) {
+	b := mr.Config.Blocks[i]
+	err := mr.runBlock(i, mod, dworld.DaemonPens[i], mod == nil)
+	if err == nil && b.Cooldown > 0 {
+		mr.quietLock.Lock()
+		mr.quietUntil[i] = time.Now().Add(b.Cooldown)
+		mr.quietLock.Unlock()
+	}
+}
+
+// startBlocks performs the initial run of all blocks, except those marked as
+// kept, which are already running.
+func (mr *ModRunner) startBlocks(dworld *DaemonWorld, kept []bool) {
+	now := time.Now()
+	for i, b := range mr.Config.Blocks {
+		if kept != nil && kept[i] {
+			continue
 		}
-		mr.runBlock(b, lmod, dworld.DaemonPens[i])
+		if b.Grace > 0 && i < len(mr.graceUntil) {
+			mr.graceUntil[i] = now.Add(b.Grace)
+		}
+		mr.runBlockAt(i, nil, dworld)
 	}
 }
 
-// Gives control of chan to caller
+// watchError describes an error setting up the watcher. Running out of file
+// descriptors is common with large trees on systems where the watcher needs
+// one per watched file, like macOS, so we suggest raising the limit.
+func watchError(err error) error {
+	if errors.Is(err, syscall.EMFILE) || strings.Contains(err.Error(), "too many open files") {
+		return fmt.Errorf(
+			"Error watching: %s\nThe watched tree needs more open files than allowed. "+
+				"Raise the limit with \"ulimit -n\", or exclude large directories from the patterns.",
+			err,
+		)
+	}
+	return fmt.Errorf("Error watching: %s", err)
+}
+
+// Gives control of chan to caller. If the config file is reloaded, a new
+// channel is created for the new watcher.
 func (mr *ModRunner) runOnChan(modchan chan *moddwatch.Mod, readyCallback func()) error {
 	dworld, err := NewDaemonWorld(mr.Config, mr.Log)
 	if err != nil {
 		return err
 	}
-	defer dworld.Shutdown(os.Kill)
+	for i, dp := range dworld.DaemonPens {
+		dp.setHooks(mr.blockHooks(i))
+	}
+	mr.quietUntil = make([]time.Time, len(mr.Config.Blocks))
+	mr.failed = make([]bool, len(mr.Config.Blocks))
+	mr.graceUntil = make([]time.Time, len(mr.Config.Blocks))
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
-	defer signal.Reset(os.Interrupt, os.Kill)
-	go func() {
-		dworld.Shutdown(<-c)
-		os.Exit(0)
+	// The daemon world is replaced when the config is reloaded. On exit,
+	// daemons are stopped before shutdown commands run, so that the commands
+	// can clean up after them.
+	var worldLock sync.Mutex
+	defer func() {
+		worldLock.Lock()
+		defer worldLock.Unlock()
+		dworld.Shutdown(nil)
+		mr.runShutdown()
 	}()
 
-	ipatts := mr.Config.IncludePatterns()
-	if mr.ConfReload {
-		ipatts = append(ipatts, filepath.Dir(mr.ConfPath))
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGTERM)
+	defer signal.Reset(os.Interrupt, os.Kill, syscall.SIGTERM)
+	var deadline <-chan time.Time
+	if mr.MaxRuntime > 0 {
+		deadline = time.After(mr.MaxRuntime)
 	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// Reaching the maximum run time shuts down the same way as SIGTERM
+		var sig os.Signal
+		code := 0
+		select {
+		case sig = <-c:
+		case <-deadline:
+			mr.Log.Notice("Maximum run time of %s reached, exiting", mr.MaxRuntime)
+			sig = syscall.SIGTERM
+			if mr.anyFailed() {
+				code = 1
+			}
+		case <-done:
+			return
+		}
+		worldLock.Lock()
+		dworld.Shutdown(sig)
+		mr.runShutdown()
+		os.Exit(code)
+	}()
 
 	currentDir, err := os.Getwd()
 	if err != nil {
 		return err
 	}
-	// FIXME: This takes a long time. We could start it in parallel with the
-	// first process run in a goroutine
-	watcher, err := moddwatch.Watch(currentDir, ipatts, []string{}, lullTime, modchan)
+	currentDir = realRoot(currentDir)
+	mr.foldCase = caseInsensitive(currentDir)
+	if mr.TriggerFile != "" {
+		if err := ensureTriggerFile(mr.TriggerFile); err != nil {
+			return fmt.Errorf("Error creating trigger file: %s", err)
+		}
+	}
 
-	if err != nil {
-		return fmt.Errorf("Error watching: %s", err)
+	var kept []bool
+	for {
+		exp := newExpansion(currentDir, mr.Config)
+		ipatts := realPatterns(currentDir, exp.patterns)
+		if mr.foldCase {
+			for i, p := range ipatts {
+				ipatts[i] = conf.FoldCase(p)
+			}
+		}
+		if mr.ConfReload {
+			ipatts = append(ipatts, filepath.Dir(mr.ConfPath))
+		}
+		if mr.Rebuild != nil {
+			ipatts = append(ipatts, mr.RebuildPaths...)
+		}
+		if mr.TriggerFile != "" {
+			ipatts = append(ipatts, mr.TriggerFile)
+		}
+		// FIXME: This takes a long time. We could start it in parallel with the
+		// first process run in a goroutine
+		watcher, err := moddwatch.Watch(currentDir, ipatts, []string{}, lullTime, modchan)
+		if err != nil {
+			return watchError(err)
+		}
+		graceUntil := time.Now().Add(mr.Grace)
+
+		mr.startBlocks(dworld, kept)
+		if kept == nil {
+			go readyCallback()
+		}
+		mr.startWorkers(dworld)
+		newcnf := mr.watch(currentDir, modchan, dworld, graceUntil, exp)
+		mr.stopWorkers()
+		watcher.Stop()
+		exp.stop()
+		if newcnf == nil {
+			return nil
+		}
+		if newcnf == mr.Config {
+			// Only the expanded patterns changed, so every block keeps running
+			kept = make([]bool, len(mr.Config.Blocks))
+			for i := range kept {
+				kept[i] = true
+			}
+			modchan = make(chan *moddwatch.Mod, 1024)
+			continue
+		}
+
+		worldLock.Lock()
+		newworld, newkept, err := mr.reload(newcnf, dworld)
+		if err != nil {
+			mr.Log.Warn("Error reloading config: %s", err)
+			// The old config remains, and is already running
+			newworld, newkept = dworld, make([]bool, len(mr.Config.Blocks))
+			for i := range newkept {
+				newkept[i] = true
+			}
+		}
+		dworld, kept = newworld, newkept
+		worldLock.Unlock()
+		modchan = make(chan *moddwatch.Mod, 1024)
 	}
-	defer watcher.Stop()
+}
 
-	mr.trigger(currentDir, nil, dworld)
-	go readyCallback()
-	for mod := range modchan {
+// watch dispatches changes and trigger requests until the mod channel is
+// closed, or the config file changes. If the config file changes and is valid,
+// the new config is returned. Otherwise, the old config keeps running. Changes
+// received before graceUntil are ignored, apart from changes to the config. If
+// the expanded patterns change, the current config is returned, so that the
+// watcher is restarted with them. The expansion may be nil.
+func (mr *ModRunner) watch(
+	currentDir string,
+	modchan chan *moddwatch.Mod,
+	dworld *DaemonWorld,
+	graceUntil time.Time,
+	exp *expansion,
+) *conf.Config {
+	for {
+		var settled <-chan time.Time
+		if next, ok := mr.nextSettle(); ok {
+			settled = time.After(time.Until(next))
+		}
+		var mod *moddwatch.Mod
+		select {
+		case <-settled:
+			mr.runSettled(dworld)
+			continue
+		case req := <-mr.triggers:
+			req.result <- mr.triggerBlock(req.block, dworld)
+			continue
+		case <-exp.changes():
+			if exp.changed(mr.Config) {
+				mr.Log.Notice("Watched directories changed, restarting watcher")
+				return mr.Config
+			}
+			continue
+		case mod = <-modchan:
+		}
 		if mod == nil {
-			break
+			return nil
 		}
 		if mr.ConfReload && mod.Has(mr.ConfPath) {
 			mr.Log.Notice("Reloading config %s", mr.ConfPath)
-			err := mr.ReadConfig()
+			newcnf, err := mr.loadConfig()
+			if err != nil {
+				mr.Log.Warn("%s", err)
+				continue
+			}
+			return newcnf
+		}
+		if mr.Rebuild != nil && mr.rebuildNeeded(mod) {
+			mr.Log.Notice("Rebuilding config")
+			newcnf, err := mr.rebuildConfig()
 			if err != nil {
 				mr.Log.Warn("%s", err)
 				continue
-			} else {
-				return nil
+			}
+			return newcnf
+		}
+		// Config changes are picked up during the grace period, but nothing
+		// else is
+		if time.Now().Before(graceUntil) {
+			mr.Log.SayAs("debug", "Ignoring changes during startup grace period")
+			continue
+		}
+		if mr.TriggerFile != "" {
+			// Every block runs on a trigger, which covers any other changes
+			// in the same batch
+			if mod.Has(mr.TriggerFile) {
+				mr.triggerAll(dworld)
+				continue
+			}
+			mod = without(mod, mr.TriggerFile)
+			if mod.Empty() {
+				continue
 			}
 		}
 		mr.Log.SayAs("debug", "Delta: \n%s", mod.String())
 		mr.trigger(currentDir, mod, dworld)
 	}
-	return nil
 }
 
 // Run is the top-level runner for modd
 func (mr *ModRunner) Run() error {
-	for {
-		modchan := make(chan *moddwatch.Mod, 1024)
-		err := mr.runOnChan(modchan, func() {})
+	if mr.ListenAddr != "" {
+		srv, err := mr.listen(mr.ListenAddr)
 		if err != nil {
 			return err
 		}
+		defer srv.Close()
 	}
+	modchan := make(chan *moddwatch.Mod, 1024)
+	return mr.runOnChan(modchan, func() {})
 }
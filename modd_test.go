@@ -1,15 +1,24 @@
 package modd
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/notify"
+	"github.com/cortesi/modd/shell"
 	"github.com/cortesi/modd/utils"
 	"github.com/cortesi/moddwatch"
 	"github.com/cortesi/termlog"
@@ -225,3 +234,1374 @@ func TestWatch(t *testing.T) {
 		},
 	)
 }
+
+func TestListenAddr(t *testing.T) {
+	tests := []struct {
+		addr     string
+		expected string
+	}{
+		{"8000", "localhost:8000"},
+		{":8000", "localhost:8000"},
+		{"0.0.0.0:8000", "0.0.0.0:8000"},
+	}
+	for _, tt := range tests {
+		got, err := listenAddr(tt.addr)
+		if err != nil {
+			t.Fatalf("%q: %s", tt.addr, err)
+		}
+		if got != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.addr, tt.expected, got)
+		}
+	}
+}
+
+func TestTriggerHTTP(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		{
+			prep +onchange: echo ":triggered:"
+		}
+		{
+			prep: exit 3
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:      lt.Log,
+		Config:   cnf,
+		triggers: make(chan triggerRequest),
+	}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for req := range mr.triggers {
+			req.result <- mr.triggerBlock(req.block, dworld)
+		}
+	}()
+	defer close(mr.triggers)
+
+	tests := []struct {
+		method   string
+		path     string
+		status   int
+		success  bool
+		exitCode int
+	}{
+		{"POST", "/trigger/1", http.StatusOK, true, 0},
+		{"POST", "/trigger/2", http.StatusInternalServerError, false, 3},
+		{"POST", "/trigger/3", http.StatusNotFound, false, -1},
+		{"POST", "/trigger/foo", http.StatusBadRequest, false, 0},
+		{"GET", "/trigger/1", http.StatusMethodNotAllowed, false, 0},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		mr.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s %s: expected status %d, got %d", tt.method, tt.path, tt.status, rec.Code)
+		}
+		if rec.Header().Get("Content-Type") == "application/json" {
+			resp := TriggerResponse{}
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Success != tt.success || resp.ExitCode != tt.exitCode {
+				t.Errorf("%s %s: expected success %v and exit code %d, got %#v", tt.method, tt.path, tt.success, tt.exitCode, resp)
+			}
+		}
+	}
+	if !strings.Contains(lt.String(), ":triggered:") {
+		t.Errorf("Expected +onchange prep to run, got:\n%s", lt.String())
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		** {
+			cooldown: 1h
+			prep: echo ":cooldown: ran"
+		}
+		** {
+			prep: echo ":nocooldown: ran"
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:        lt.Log,
+		Config:     cnf,
+		quietUntil: make([]time.Time, len(cnf.Blocks)),
+	}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.trigger(".", nil, dworld)
+	mr.trigger(".", &moddwatch.Mod{Changed: []string{"foo"}}, dworld)
+
+	expected := []string{":cooldown: ran", ":nocooldown: ran", ":nocooldown: ran"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestBlockGrace(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		** {
+			grace: 200ms
+			prep +onchange: echo ":grace:" @mods
+		}
+		** {
+			prep +onchange: echo ":nograce:" @mods
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:        lt.Log,
+		Config:     cnf,
+		quietUntil: make([]time.Time, len(cnf.Blocks)),
+		graceUntil: make([]time.Time, len(cnf.Blocks)),
+	}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.startBlocks(dworld, nil)
+	mr.trigger(".", &moddwatch.Mod{Changed: []string{"cache"}}, dworld)
+	time.Sleep(300 * time.Millisecond)
+	mr.trigger(".", &moddwatch.Mod{Changed: []string{"edit"}}, dworld)
+
+	expected := []string{":nograce: ./cache", ":grace: ./edit", ":nograce: ./edit"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestLastRunFailed(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		** {
+			prep: test ! -e fail
+		}
+		** {
+			prep: true
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:        lt.Log,
+		Config:     cnf,
+		quietUntil: make([]time.Time, len(cnf.Blocks)),
+		failed:     make([]bool, len(cnf.Blocks)),
+	}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.trigger(".", nil, dworld)
+	if mr.anyFailed() {
+		t.Error("Expected no failures after a successful run")
+	}
+	touch("fail")
+	mr.trigger(".", &moddwatch.Mod{Changed: []string{"fail"}}, dworld)
+	if !mr.anyFailed() {
+		t.Error("Expected a failure to be recorded")
+	}
+	if err := os.Remove("fail"); err != nil {
+		t.Fatal(err)
+	}
+	mr.trigger(".", &moddwatch.Mod{Deleted: []string{"fail"}}, dworld)
+	if mr.anyFailed() {
+		t.Error("Expected a later success to clear the failure")
+	}
+}
+
+func TestSettle(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		** {
+			prep +onchange: echo ":fast:" @mods
+		}
+		** {
+			settle: 200ms
+			prep +onchange: echo ":slow:" @mods
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:        lt.Log,
+		Config:     cnf,
+		quietUntil: make([]time.Time, len(cnf.Blocks)),
+	}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modchan := make(chan *moddwatch.Mod)
+	go func() {
+		for _, p := range []string{"a", "b", "c"} {
+			modchan <- &moddwatch.Mod{Changed: []string{p}}
+			time.Sleep(50 * time.Millisecond)
+		}
+		time.Sleep(500 * time.Millisecond)
+		modchan <- nil
+	}()
+	mr.watch(".", modchan, dworld, time.Time{}, nil)
+
+	expected := []string{":fast: ./a", ":fast: ./b", ":fast: ./c", ":slow: ./a ./b ./c"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestStable(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		** {
+			stable: 200ms
+			prep +onchange: echo ":stable:" @mods $(wc -c < big)
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:        lt.Log,
+		Config:     cnf,
+		quietUntil: make([]time.Time, len(cnf.Blocks)),
+	}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Simulate a file being written slowly, with writes spaced more closely
+	// than the stable period, after the event that announced it
+	modchan := make(chan *moddwatch.Mod)
+	go func() {
+		modchan <- &moddwatch.Mod{Added: []string{"big"}}
+		for i := 0; i < 8; i++ {
+			time.Sleep(75 * time.Millisecond)
+			if _, err := f.WriteString("0123456789"); err != nil {
+				t.Error(err)
+			}
+		}
+		time.Sleep(700 * time.Millisecond)
+		modchan <- nil
+	}()
+	mr.watch(".", modchan, dworld, time.Time{}, nil)
+
+	expected := []string{":stable: ./big 80"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestQuiesce(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		out/** {
+			quiesce: 200ms
+			prep +onchange: echo ":quiesce:" $(ls out | wc -l)
+		}
+		out/** {
+			quiesce +max=300ms: 200ms
+			prep +onchange: echo ":max:" $(ls out | wc -l)
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:        lt.Log,
+		Config:     cnf,
+		quietUntil: make([]time.Time, len(cnf.Blocks)),
+	}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	touch("out/0")
+
+	// Simulate a bulk operation that keeps adding files after the event that
+	// started it, with no further events, and then goes quiet
+	modchan := make(chan *moddwatch.Mod)
+	go func() {
+		modchan <- &moddwatch.Mod{Added: []string{"out/0"}}
+		for i := 1; i <= 8; i++ {
+			time.Sleep(75 * time.Millisecond)
+			touch(fmt.Sprintf("out/%d", i))
+		}
+		time.Sleep(700 * time.Millisecond)
+		modchan <- nil
+	}()
+	mr.watch(".", modchan, dworld, time.Time{}, nil)
+
+	ret := events(lt.String())
+	if len(ret) != 2 {
+		t.Fatalf("Expected each block to run once, got %#v", ret)
+	}
+	// The block without a short maximum waits until all files are written,
+	// while the other gives up waiting part way through
+	if ret[1] != ":quiesce: 9" {
+		t.Errorf("Unexpected run after quiescence: %s", ret[1])
+	}
+	if ret[0] == ":max: 9" || !strings.HasPrefix(ret[0], ":max: ") {
+		t.Errorf("Unexpected run after reaching maximum: %s", ret[0])
+	}
+	if !strings.Contains(lt.String(), "Files for block 2 still changing after 300ms") {
+		t.Errorf("Expected a notice about the maximum, got\n%s", lt.String())
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		** {
+			events: added
+			prep: echo ":added: ran"
+		}
+		** {
+			events: deleted
+			prep: echo ":deleted: ran"
+		}
+		** {
+			prep: echo ":all: ran"
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:        lt.Log,
+		Config:     cnf,
+		quietUntil: make([]time.Time, len(cnf.Blocks)),
+	}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.trigger(".", &moddwatch.Mod{Changed: []string{"foo"}}, dworld)
+	mr.trigger(".", &moddwatch.Mod{Added: []string{"foo"}}, dworld)
+	mr.trigger(".", &moddwatch.Mod{Deleted: []string{"foo"}}, dworld)
+
+	expected := []string{
+		":all: ran",
+		":added: ran", ":all: ran",
+		":deleted: ran", ":all: ran",
+	}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestEventScopedPatterns(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		**/*.go deleted:**/*.tmp !deleted:keep/** {
+			prep: echo ":scoped: ran"
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:        lt.Log,
+		Config:     cnf,
+		quietUntil: make([]time.Time, len(cnf.Blocks)),
+	}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A write to a delete-only pattern doesn't trigger the block
+	mr.trigger(".", &moddwatch.Mod{Changed: []string{"x.tmp"}}, dworld)
+	mr.trigger(".", &moddwatch.Mod{Added: []string{"x.tmp"}}, dworld)
+	mr.trigger(".", &moddwatch.Mod{Deleted: []string{"x.tmp"}}, dworld)
+	// A delete-only exclude doesn't stop other events from matching
+	mr.trigger(".", &moddwatch.Mod{Deleted: []string{"keep/x.tmp"}}, dworld)
+	mr.trigger(".", &moddwatch.Mod{Changed: []string{"keep/a.go"}}, dworld)
+
+	expected := []string{":scoped: ran", ":scoped: ran"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestPrepMatch(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		** {
+			prep +onchange: echo ":main:" @mods
+			prep +match=**/*.sql: echo ":migrate:" @mods
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:        lt.Log,
+		Config:     cnf,
+		quietUntil: make([]time.Time, len(cnf.Blocks)),
+	}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.trigger(".", nil, dworld)
+	mr.trigger(".", &moddwatch.Mod{Changed: []string{"main.go"}}, dworld)
+	mr.trigger(".", &moddwatch.Mod{Changed: []string{"main.go", "db/up.sql"}}, dworld)
+
+	expected := []string{
+		":main: ./main.go",
+		":migrate: ./db/up.sql", ":main: ./db/up.sql ./main.go",
+	}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestFollowUp(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		** {
+			prep: echo ":one: ran"
+			onsuccess: echo ":one: succeeded"
+			onfailure: echo ":one: failed"
+			prep: echo ":two: ran"; false
+			onsuccess: echo ":two: succeeded"
+			onfailure: echo ":two: failed"
+			prep: echo ":three: ran"
+		}
+		** {
+			prep: echo ":four: ran"
+			onsuccess +nofail: echo ":four: succeeded"; false
+			prep: echo ":five: ran"
+			onsuccess: false
+			prep: echo ":six: ran"
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:        lt.Log,
+		Config:     cnf,
+		quietUntil: make([]time.Time, len(cnf.Blocks)),
+	}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.trigger(".", nil, dworld)
+
+	expected := []string{
+		":one: ran", ":one: succeeded", ":two: ran", ":two: failed",
+		":four: ran", ":four: succeeded", ":five: ran",
+	}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestFirstMatch(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	for _, match := range []string{"all", "first"} {
+		cnf, err := conf.Parse("test", `
+			@shell = bash
+			@match = `+match+`
+			a/* {
+				prep +onchange: echo ":specific:" @mods
+			}
+			** {
+				prep +onchange: echo ":general:" @mods
+			}
+		`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lt := termlog.NewLogTest()
+		mr := ModRunner{
+			Log:        lt.Log,
+			Config:     cnf,
+			quietUntil: make([]time.Time, len(cnf.Blocks)),
+		}
+		dworld, err := NewDaemonWorld(cnf, lt.Log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mr.trigger(".", &moddwatch.Mod{Changed: []string{"a/x", "b/y"}}, dworld)
+		mr.trigger(".", &moddwatch.Mod{Changed: []string{"a/x"}}, dworld)
+
+		expected := map[string][]string{
+			"all": {
+				":specific: ./a/x", `:general: ./a/x ./b/y`,
+				":specific: ./a/x", ":general: ./a/x",
+			},
+			"first": {
+				":specific: ./a/x", ":general: ./b/y",
+				":specific: ./a/x",
+			},
+		}[match]
+		if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+			t.Errorf("%s: Expected\n%#v\nGot\n%#v", match, expected, ret)
+		}
+	}
+
+	cnf, err := conf.Parse("test", "@match = last\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewModRunnerFromConfig(cnf, termlog.NewLogTest().Log, nil)
+	if err == nil || err.Error() != `Unsupported @match value: "last"` {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestBlockUser(t *testing.T) {
+	cnf, err := conf.Parse("test", "{\nuser: modd-no-such-user\nprep: true\n}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	_, err = NewModRunnerFromConfig(cnf, lt.Log, nil)
+	if !shell.UserSupported {
+		if err != nil || !strings.Contains(lt.String(), "not supported") {
+			t.Errorf("Expected a warning, got %v: %s", err, lt.String())
+		}
+		return
+	}
+	expected := `Invalid user for block 1: unknown user "modd-no-such-user"`
+	if err == nil || err.Error() != expected {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestGrace(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		** {
+			prep +onchange: echo ":changed:" @mods
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:        lt.Log,
+		Config:     cnf,
+		quietUntil: make([]time.Time, len(cnf.Blocks)),
+	}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modchan := make(chan *moddwatch.Mod, 2)
+	modchan <- &moddwatch.Mod{Changed: []string{"early"}}
+	modchan <- nil
+	mr.watch(".", modchan, dworld, time.Now().Add(time.Hour), nil)
+
+	modchan <- &moddwatch.Mod{Changed: []string{"late"}}
+	modchan <- nil
+	mr.watch(".", modchan, dworld, time.Now(), nil)
+
+	expected := []string{":changed: ./late"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		** {
+			prep +onchange: echo ":changed:" @mods
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	rebuildErr := errors.New("rebuild failed")
+	mr := ModRunner{
+		Log:          lt.Log,
+		Config:       cnf,
+		RebuildPaths: []string{"./list.txt"},
+		Rebuild: func() (*conf.Config, error) {
+			if rebuildErr != nil {
+				return nil, rebuildErr
+			}
+			return conf.Parse("rebuilt", "@shell = bash\nfoo {\nprep: true\n}\n")
+		},
+		quietUntil: make([]time.Time, len(cnf.Blocks)),
+	}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed rebuild is reported, and the current config stays in place
+	modchan := make(chan *moddwatch.Mod, 2)
+	modchan <- &moddwatch.Mod{Changed: []string{"list.txt"}}
+	modchan <- nil
+	if newcnf := mr.watch(".", modchan, dworld, time.Time{}, nil); newcnf != nil {
+		t.Errorf("Expected no new config, got %#v", newcnf)
+	}
+	if !strings.Contains(lt.String(), "rebuild failed") {
+		t.Errorf("Expected rebuild error, got:\n%s", lt.String())
+	}
+
+	rebuildErr = nil
+	modchan <- &moddwatch.Mod{Changed: []string{"other"}}
+	modchan <- &moddwatch.Mod{Changed: []string{"list.txt"}}
+	newcnf := mr.watch(".", modchan, dworld, time.Time{}, nil)
+	if newcnf == nil || len(newcnf.Blocks) != 1 || newcnf.Blocks[0].Include[0] != "foo" {
+		t.Fatalf("Expected rebuilt config, got %#v", newcnf)
+	}
+	expected := []string{":changed: ./other"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestTriggerFile(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		** {
+			prep +onchange: echo ":all" @mods
+		}
+		src/** {
+			prep +onchange: echo ":src" @mods
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:         lt.Log,
+		Config:      cnf,
+		TriggerFile: "trigger",
+		quietUntil:  make([]time.Time, len(cnf.Blocks)),
+	}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modchan := make(chan *moddwatch.Mod, 4)
+	// The trigger file never matches block patterns
+	modchan <- &moddwatch.Mod{Deleted: []string{"trigger"}}
+	// A trigger runs every block, covering other changes in the same batch
+	modchan <- &moddwatch.Mod{Changed: []string{"./trigger", "src/a"}}
+	modchan <- &moddwatch.Mod{Changed: []string{"src/b"}, Deleted: []string{"trigger"}}
+	modchan <- nil
+	mr.watch(".", modchan, dworld, time.Time{}, nil)
+	expected := []string{":all", ":src", ":all ./src/b", ":src ./src/b"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestPrepAll(t *testing.T) {
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		a {
+			prep: echo ":a1"; false
+			prep: echo ":a2"
+		}
+		b {
+			prep +onchange: echo ":skipped"
+			prep: echo ":b"
+		}
+		c {
+			prep: exit 3
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf}
+	err = mr.PrepAll(true)
+	if err == nil || err.Error() != "2 of 3 blocks failed" {
+		t.Errorf("Expected 2 failed blocks, got %v", err)
+	}
+	// Blocks after a failing block still run
+	expected := []string{":a1", ":b"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+
+	cnf, err = conf.Parse("test", "@shell = bash\na {\nprep: true\n}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr = ModRunner{Log: lt.Log, Config: cnf}
+	if err := mr.PrepAll(true); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestBlockTimeout(t *testing.T) {
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		** {
+			timeout: 500ms
+			prep: sleep 0.3; echo ":one"
+			prep: sleep 0.3; echo ":two"
+			prep: echo ":three"
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	start := time.Now()
+	err = RunPreps(cnf.Blocks[0], cnf.GetVariables(), nil, lt.Log, nil, false)
+	if err == nil || !strings.Contains(err.Error(), "block timed out after 500ms") {
+		t.Fatalf("Expected block timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Block wasn't stopped at its deadline: took %s", elapsed)
+	}
+	expected := []string{":one"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestPrepAllFiles(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	touch("a.go")
+	touch("b.go")
+	touch("sub/c.go")
+	touch("other.txt")
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		**/*.go {
+			prep: echo ":changed:" @mods
+			prep +all: echo ":all:" @mods
+			prep +all +stdin: while read f; do echo ":stdin: $f"; done
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mod := &moddwatch.Mod{Changed: []string{"a.go"}}
+	err = RunPreps(cnf.Blocks[0], cnf.GetVariables(), mod, lt.Log, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		":changed: ./a.go",
+		":all: ./a.go ./b.go ./sub/c.go",
+		":stdin: ./a.go", ":stdin: ./b.go", ":stdin: ./sub/c.go",
+	}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestPrepRetry(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	// Each run of the command fails until it has run three times
+	const flaky = `n=$(cat count 2>/dev/null || echo 0); echo $((n+1)) > count; echo ":attempt $n"; [ $n -ge 2 ]`
+	for _, tt := range []struct {
+		retry    int
+		expected []string
+		fail     bool
+	}{
+		{1, []string{":attempt 0", ":attempt 1"}, true},
+		{3, []string{":attempt 0", ":attempt 1", ":attempt 2", ":done"}, false},
+	} {
+		os.Remove("count")
+		cnf, err := conf.Parse("test", fmt.Sprintf(`
+			@shell = bash
+			** {
+				prep +retry=%d +retrydelay=10ms: '%s'
+				prep: echo ":done"
+			}
+		`, tt.retry, flaky))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lt := termlog.NewLogTest()
+		err = RunPreps(cnf.Blocks[0], cnf.GetVariables(), nil, lt.Log, nil, false)
+		if _, ok := err.(ProcError); ok != tt.fail {
+			t.Errorf("retry=%d: unexpected result %v", tt.retry, err)
+		}
+		if ret := events(lt.String()); !reflect.DeepEqual(ret, tt.expected) {
+			t.Errorf("retry=%d: expected\n%#v\nGot\n%#v", tt.retry, tt.expected, ret)
+		}
+		if !strings.Contains(lt.String(), ">> retry 1 of") {
+			t.Errorf("retry=%d: retries weren't logged:\n%s", tt.retry, lt.String())
+		}
+	}
+}
+
+func TestPrepStdin(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		** {
+			prep +stdin: while read f; do echo ":line: $f"; done
+			prep +stdin=nul: xargs -0 -n1 echo ":nul:"
+			prep +stdin: true
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mod := &moddwatch.Mod{Changed: []string{"a", "b c"}}
+	err = RunPreps(cnf.Blocks[0], cnf.GetVariables(), mod, lt.Log, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		":line: ./a", ":line: ./b c",
+		":nul: ./a", ":nul: ./b c",
+	}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+
+	// A command that doesn't read stdin must not block on a full pipe
+	mod = &moddwatch.Mod{}
+	for i := 0; i < 100000; i++ {
+		mod.Changed = append(mod.Changed, fmt.Sprintf("file%d", i))
+	}
+	b := cnf.Blocks[0]
+	b.Preps = b.Preps[2:]
+	done := make(chan error, 1)
+	go func() {
+		done <- RunPreps(b, cnf.GetVariables(), mod, lt.Log, nil, false)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(timeout):
+		t.Error("Command blocked on stdin")
+	}
+}
+
+func TestPrepStdinRetry(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	// The command fails on its first run, and succeeds on the retry
+	const flaky = `n=$(cat count 2>/dev/null || echo 0); echo $((n+1)) > count; while read f; do echo ":attempt $n: $f"; done; [ $n -ge 1 ]`
+	cnf, err := conf.Parse("test", fmt.Sprintf(`
+		@shell = bash
+		** {
+			prep +stdin +retry=1 +retrydelay=10ms: '%s'
+		}
+	`, flaky))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mod := &moddwatch.Mod{Changed: []string{"a.go"}}
+	err = RunPreps(cnf.Blocks[0], cnf.GetVariables(), mod, lt.Log, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{":attempt 0: ./a.go", ":attempt 1: ./a.go"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestPrepChanged(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		** {
+			prep +changed: while IFS= read -r f; do echo ":newline: $f"; done <<< "$MODD_CHANGED"
+			prep +changed=quoted: eval "set -- $MODD_CHANGED"; for f in "$@"; do echo ":quoted: $f"; done
+			prep +changed=space: echo ":space: $MODD_CHANGED"
+			prep: echo ":unset: ${MODD_CHANGED-none}"
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mod := &moddwatch.Mod{Changed: []string{"a", `it's a "b c"$x`}}
+	err = RunPreps(cnf.Blocks[0], cnf.GetVariables(), mod, lt.Log, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		":newline: ./a", `:newline: ./it's a "b c"$x`,
+		":quoted: ./a", `:quoted: ./it's a "b c"$x`,
+		`:space: ./a ./it's a "b c"$x`,
+		":unset: none",
+	}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestCheckCommands(t *testing.T) {
+	cnf, err := conf.Parse("test", `
+		@shell = exec
+		** {
+			prep: go test "./..."
+			prep: go vet | tee log
+			daemon: run $PORT
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := CheckCommands(cnf)
+	expected := []string{
+		"block 1: command requires a shell: go vet | tee log",
+		"block 1: command requires a shell: run $PORT",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d problems, got %v", len(expected), errs)
+	}
+	for i := range errs {
+		if errs[i].Error() != expected[i] {
+			t.Errorf("Expected %q, got %q", expected[i], errs[i])
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	touch("file")
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		{
+			indir: .
+		}
+		{
+			indir: ./nonexistent
+		}
+		{
+			indir: ./file
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := CheckConfig(cnf)
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 problems, got %v", errs)
+	}
+	if !strings.HasPrefix(errs[0].Error(), "block 2: indir:") {
+		t.Errorf("Unexpected problem: %s", errs[0])
+	}
+	if !strings.HasPrefix(errs[1].Error(), "block 3: indir:") {
+		t.Errorf("Unexpected problem: %s", errs[1])
+	}
+
+	cnf, err = conf.Parse("test", "@shell = fish\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := CheckConfig(cnf); len(errs) != 1 {
+		t.Errorf("Expected an unsupported shell error, got %v", errs)
+	}
+}
+
+// waitEvents waits for the events emitted to the log to match expected
+func waitEvents(t *testing.T, lt *termlog.LogTest, expected []string) {
+	start := time.Now()
+	for {
+		ret := events(lt.String())
+		if reflect.DeepEqual(ret, expected) {
+			return
+		}
+		if time.Now().Sub(start) > timeout {
+			t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestWatchBasePaths(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	ext, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(ext)
+	ext, err = filepath.EvalSymlinks(ext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ext = filepath.ToSlash(ext)
+	err = os.MkdirAll("a/inner", 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(path.Join(ext, "inner"), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	cnf, err := conf.Parse("test", strings.Replace(`
+		@shell = bash
+		a/**/*.go {
+			prep +onchange: echo ":a:" @mods
+		}
+		"EXT/**/*.go" {
+			prep +onchange: echo ":ext:" @mods
+		}
+		a/**/*.go "EXT/**/*.go" {
+			prep +onchange: echo ":both:" @mods
+		}
+	`, "EXT", ext, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lt := termlog.NewLogTest()
+	modchan := make(chan *moddwatch.Mod, 1024)
+	cback := func() {
+		touch("a/inner/one.go")
+		expected := []string{
+			":a: ./a/inner/one.go",
+			":both: ./a/inner/one.go",
+		}
+		waitEvents(t, lt, expected)
+
+		touch(path.Join(ext, "inner/two.go"))
+		touch(path.Join(ext, "inner/ignored.txt"))
+		expected = append(
+			expected,
+			":ext: "+path.Join(ext, "inner/two.go"),
+			":both: "+path.Join(ext, "inner/two.go"),
+		)
+		waitEvents(t, lt, expected)
+		modchan <- nil
+	}
+
+	mr := ModRunner{
+		Log:    lt.Log,
+		Config: cnf,
+	}
+	err = mr.runOnChan(modchan, cback)
+	if err != nil {
+		t.Fatalf("runOnChan: %s", err)
+	}
+}
+
+func TestWatchAlternatives(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	for _, d := range []string{"src/inner", "test", "other"} {
+		if err := os.MkdirAll(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		"{src,test}/**/*.go" {
+			prep +onchange: echo ":alt:" @mods
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bases := []string{}
+	for _, p := range cnf.IncludePatterns() {
+		bases = append(bases, conf.BasePath(p))
+	}
+	if expected := []string{"src", "test"}; !reflect.DeepEqual(bases, expected) {
+		t.Errorf("Expected base paths %#v, got %#v", expected, bases)
+	}
+
+	lt := termlog.NewLogTest()
+	modchan := make(chan *moddwatch.Mod, 1024)
+	cback := func() {
+		touch("src/inner/one.go")
+		expected := []string{":alt: ./src/inner/one.go"}
+		waitEvents(t, lt, expected)
+
+		touch("other/ignored.go")
+		touch("test/two.go")
+		expected = append(expected, ":alt: ./test/two.go")
+		waitEvents(t, lt, expected)
+		modchan <- nil
+	}
+
+	mr := ModRunner{
+		Log:    lt.Log,
+		Config: cnf,
+	}
+	err = mr.runOnChan(modchan, cback)
+	if err != nil {
+		t.Fatalf("runOnChan: %s", err)
+	}
+}
+
+func TestWatchNestedCreation(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		a/b/c/** {
+			prep +onchange: echo ":c:" @mods
+		}
+		x/y/z/** {
+			prep +onchange: echo ":x:" @mods
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lt := termlog.NewLogTest()
+	modchan := make(chan *moddwatch.Mod, 1024)
+	cback := func() {
+		// None of the base path exists when watching starts. Create it one
+		// level at a time, with a pause after each, so each directory is
+		// created in its own batch of events.
+		for _, d := range []string{"a", "a/b", "a/b/c"} {
+			if err := os.Mkdir(d, 0777); err != nil {
+				t.Error(err)
+			}
+			time.Sleep(200 * time.Millisecond)
+		}
+		touch("a/b/c/one")
+		expected := []string{":c: ./a/b/c/one"}
+		waitEvents(t, lt, expected)
+
+		if err := os.MkdirAll("x/y/z", 0777); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(200 * time.Millisecond)
+		touch("x/y/z/two")
+		expected = append(expected, ":x: ./x/y/z/two")
+		waitEvents(t, lt, expected)
+		modchan <- nil
+	}
+
+	mr := ModRunner{
+		Log:    lt.Log,
+		Config: cnf,
+	}
+	err = mr.runOnChan(modchan, cback)
+	if err != nil {
+		t.Fatalf("runOnChan: %s", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		** {
+			daemon: trap 'echo ":daemon: stopped"; exit' TERM; echo ":daemon: up"; while true; do sleep 0.05; done
+			shutdown: echo ":shutdown: one"
+			shutdown: sleep 10
+		}
+		{
+			shutdown: echo ":shutdown: two"
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lt := termlog.NewLogTest()
+	modchan := make(chan *moddwatch.Mod, 1024)
+	cback := func() {
+		waitEvents(t, lt, []string{":daemon: up"})
+		modchan <- nil
+	}
+	mr := ModRunner{
+		Log:             lt.Log,
+		Config:          cnf,
+		ShutdownTimeout: 200 * time.Millisecond,
+	}
+	start := time.Now()
+	err = mr.runOnChan(modchan, cback)
+	if err != nil {
+		t.Fatalf("runOnChan: %s", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Shutdown commands weren't timed out, took %s", d)
+	}
+
+	// Daemons stop first, and a command that times out doesn't stop the rest
+	expected := []string{":daemon: up", ":daemon: stopped", ":shutdown: one", ":shutdown: two"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+	if !strings.Contains(lt.String(), "timed out after 200ms") {
+		t.Errorf("Expected a timeout, got:\n%s", lt.String())
+	}
+}
+
+func TestWatchError(t *testing.T) {
+	err := watchError(&os.PathError{Op: "open", Path: "foo", Err: syscall.EMFILE})
+	if !strings.Contains(err.Error(), "ulimit -n") {
+		t.Errorf("Expected a hint about the open file limit, got: %s", err)
+	}
+	err = watchError(fmt.Errorf("no such file or directory"))
+	if err.Error() != "Error watching: no such file or directory" {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+type recordNotifier struct {
+	results []string
+	err     error
+}
+
+func (r *recordNotifier) Notify(event notify.Event, status notify.Status) error {
+	r.results = append(r.results, fmt.Sprintf("%s %s: %s", event.Kind, status, event.Command))
+	return r.err
+}
+
+func TestNotifiers(t *testing.T) {
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		** {
+			prep: echo ":one"
+			prep: true
+			onsuccess: echo ":followup"
+			prep: echo oops >&2; false
+			prep: echo ":never"
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	failing := &recordNotifier{err: errors.New("unreachable")}
+	rec := &recordNotifier{}
+	err = RunPreps(
+		cnf.Blocks[0], cnf.GetVariables(), nil, lt.Log,
+		[]notify.Notifier{failing, rec}, false,
+	)
+	if _, ok := err.(ProcError); !ok {
+		t.Fatalf("Expected a ProcError, got %v", err)
+	}
+	expected := []string{
+		`prep succeeded: echo ":one"`,
+		"prep succeeded: true",
+		`onsuccess succeeded: echo ":followup"`,
+		"prep failed: echo oops >&2; false",
+	}
+	if !reflect.DeepEqual(rec.results, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, rec.results)
+	}
+	if !reflect.DeepEqual(failing.results, expected) {
+		t.Errorf("A failing notifier should still be called for every command")
+	}
+	if !strings.Contains(lt.String(), "Notifier error: unreachable") {
+		t.Errorf("Notifier error wasn't logged:\n%s", lt.String())
+	}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, []string{":one", ":followup"}) {
+		t.Errorf("Unexpected output: %#v", ret)
+	}
+}
+
+func TestNotifiersNoFail(t *testing.T) {
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		** {
+			prep: true
+			onsuccess +nofail: false
+			prep: echo ":two"
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	rec := &recordNotifier{}
+	err = RunPreps(cnf.Blocks[0], cnf.GetVariables(), nil, lt.Log, []notify.Notifier{rec}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A failed +nofail follow-up is still notified, but doesn't stop the block
+	expected := []string{
+		"prep succeeded: true",
+		"onsuccess failed: false",
+		`prep succeeded: echo ":two"`,
+	}
+	if !reflect.DeepEqual(rec.results, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, rec.results)
+	}
+}
@@ -2,6 +2,7 @@ package notify
 
 import (
 	"fmt"
+	"os"
 	"os/exec"
 )
 
@@ -15,41 +16,101 @@ func hasExecutable(name string) bool {
 	return true
 }
 
-// A Notifier notifies
+// Status is the outcome of the command a notification is about
+type Status int
+
+const (
+	// Succeeded means the command exited successfully
+	Succeeded Status = iota
+	// Failed means the command exited with an error
+	Failed
+)
+
+func (s Status) String() string {
+	if s == Failed {
+		return "failed"
+	}
+	return "succeeded"
+}
+
+// Event describes the command a notification is about
+type Event struct {
+	// "prep" for a prep command, or "onsuccess" for its follow-up
+	Kind string
+	// The command, with variables expanded
+	Command string
+	// The command's error output, if it failed
+	Output string
+}
+
+// A Notifier is told the outcome of each prep command and onsuccess follow-up
+// that modd runs. Notify is called from the goroutine running the commands, so
+// a slow notifier delays the run. An error returned by Notify is logged, and
+// doesn't affect the run.
 type Notifier interface {
-	Push(title string, content string, icon string)
+	Notify(event Event, status Status) error
 }
 
-// BeepNotifier just emits a beep on the terminal
+// BeepNotifier just emits a beep on the terminal when a command fails
 type BeepNotifier struct{}
 
-// Push implements Notifier
-func (*BeepNotifier) Push(string, string, string) {
-	fmt.Print("\a")
+// Notify implements Notifier
+func (*BeepNotifier) Notify(_ Event, status Status) error {
+	if status == Failed {
+		fmt.Print("\a")
+	}
+	return nil
+}
+
+// StderrNotifier writes the output of failed commands to stderr
+type StderrNotifier struct{}
+
+// Notify implements Notifier
+func (StderrNotifier) Notify(event Event, status Status) error {
+	if status != Failed {
+		return nil
+	}
+	_, err := fmt.Fprintf(os.Stderr, "%s: %s %s: %s\n%s", prog, event.Kind, status, event.Command, event.Output)
+	return err
 }
 
 // GrowlNotifier is a notifier for Growl
 type GrowlNotifier struct {
 }
 
-// Push implements Notifier
-func (GrowlNotifier) Push(title string, text string, iconPath string) {
+// Notify implements Notifier
+func (GrowlNotifier) Notify(event Event, status Status) error {
+	if status != Failed {
+		return nil
+	}
 	cmd := exec.Command(
-		"growlnotify", "-n", prog, "-d", prog, "-m", text, prog,
+		"growlnotify", "-n", prog, "-d", prog, "-m", event.Output, prog,
 	)
-	go cmd.Run()
+	return start(cmd)
 }
 
 // LibnotifyNotifier is a notifier for lib-notify
 type LibnotifyNotifier struct {
 }
 
-// Push implements Notifier
-func (LibnotifyNotifier) Push(title string, text string, iconPath string) {
+// Notify implements Notifier
+func (LibnotifyNotifier) Notify(event Event, status Status) error {
+	if status != Failed {
+		return nil
+	}
 	cmd := exec.Command(
-		"notify-send", prog, text,
+		"notify-send", prog, event.Output,
 	)
-	go cmd.Run()
+	return start(cmd)
+}
+
+// start starts a command without waiting for it to finish
+func start(cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
 }
 
 // PlatformNotifier finds a notifier for this platform
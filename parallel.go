@@ -0,0 +1,161 @@
+package modd
+
+import (
+	"sync"
+
+	"github.com/cortesi/moddwatch"
+)
+
+// blockWorker runs the changes for a single block in a goroutine of its own,
+// so that a slow block doesn't hold up the others. Changes that arrive while
+// the block is running are merged, and run together once it finishes.
+type blockWorker struct {
+	// Held while the block runs, so that runs started elsewhere, like remote
+	// triggers, don't overlap with the worker's
+	running sync.Mutex
+
+	lock    sync.Mutex
+	pending *moddwatch.Mod
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// add queues changes for the worker to run
+func (w *blockWorker) add(mod *moddwatch.Mod) {
+	w.lock.Lock()
+	if w.pending == nil {
+		w.pending = mod
+	} else {
+		w.pending = mergeMods(w.pending, mod)
+	}
+	w.lock.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take removes and returns the queued changes
+func (w *blockWorker) take() *moddwatch.Mod {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	mod := w.pending
+	w.pending = nil
+	return mod
+}
+
+// runLimit caps the number of blocks running at once. Runs that have to wait
+// are admitted in the order they arrived, so that a block that changes often
+// can't starve the others. A nil runLimit admits everything.
+type runLimit struct {
+	lock    sync.Mutex
+	max     int
+	running int
+	waiting []chan struct{}
+}
+
+func newRunLimit(max int) *runLimit {
+	if max < 1 {
+		return nil
+	}
+	return &runLimit{max: max}
+}
+
+// acquire waits until a run may start
+func (l *runLimit) acquire() {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	if l.running < l.max {
+		l.running++
+		l.lock.Unlock()
+		return
+	}
+	ch := make(chan struct{})
+	l.waiting = append(l.waiting, ch)
+	l.lock.Unlock()
+	<-ch
+}
+
+// release ends a run, handing its slot to the run that has waited longest
+func (l *runLimit) release() {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.waiting) > 0 {
+		close(l.waiting[0])
+		l.waiting = l.waiting[1:]
+		return
+	}
+	l.running--
+}
+
+// startWorkers starts a worker for each block if blocks run in parallel
+func (mr *ModRunner) startWorkers(dworld *DaemonWorld) {
+	if !mr.Parallel {
+		return
+	}
+	mr.limit = newRunLimit(mr.MaxConcurrent)
+	mr.workers = make([]*blockWorker, len(mr.Config.Blocks))
+	for i := range mr.workers {
+		w := &blockWorker{
+			wake: make(chan struct{}, 1),
+			stop: make(chan struct{}),
+			done: make(chan struct{}),
+		}
+		mr.workers[i] = w
+		go func(i int) {
+			defer close(w.done)
+			for {
+				select {
+				case <-w.wake:
+				case <-w.stop:
+					return
+				}
+				if mod := w.take(); mod != nil {
+					w.running.Lock()
+					mr.runBlockAt(i, mod, dworld)
+					w.running.Unlock()
+				}
+			}
+		}(i)
+	}
+}
+
+// stopWorkers stops all workers, waiting for blocks that are running to
+// finish. Changes that are still queued are dropped.
+func (mr *ModRunner) stopWorkers() {
+	for _, w := range mr.workers {
+		close(w.stop)
+	}
+	for _, w := range mr.workers {
+		<-w.done
+	}
+	mr.workers = nil
+}
+
+// dispatch runs a block for a set of changes, on the block's worker if
+// blocks run in parallel, and immediately otherwise. A nil mod means this is
+// the initial run, which is always immediate.
+func (mr *ModRunner) dispatch(i int, mod *moddwatch.Mod, dworld *DaemonWorld) {
+	if mr.workers == nil || mod == nil {
+		mr.runBlockAt(i, mod, dworld)
+		return
+	}
+	mr.workers[i].add(mod)
+}
+
+// exclusive calls f while no worker is running the block, so that runs of a
+// block never overlap
+func (mr *ModRunner) exclusive(i int, f func()) {
+	if mr.workers != nil {
+		mr.workers[i].running.Lock()
+		defer mr.workers[i].running.Unlock()
+	}
+	f()
+}
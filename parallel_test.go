@@ -0,0 +1,131 @@
+package modd
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/moddwatch"
+	"github.com/cortesi/termlog"
+)
+
+func TestParallelBlocks(t *testing.T) {
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		a/** {
+			prep +onchange: sleep 0.5; echo ":a" @mods
+		}
+		b/** {
+			prep +onchange: echo ":b" @mods
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:        lt.Log,
+		Config:     cnf,
+		Parallel:   true,
+		quietUntil: make([]time.Time, len(cnf.Blocks)),
+	}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.startWorkers(dworld)
+
+	// Block b runs while block a is still running
+	mr.trigger(".", &moddwatch.Mod{Changed: []string{"a/1"}}, dworld)
+	mr.trigger(".", &moddwatch.Mod{Changed: []string{"b/1"}}, dworld)
+	waitEvents(t, lt, []string{":b ./b/1"})
+
+	// Changes that arrive while a block is running are run together once it
+	// finishes
+	mr.trigger(".", &moddwatch.Mod{Changed: []string{"a/2"}}, dworld)
+	mr.trigger(".", &moddwatch.Mod{Changed: []string{"a/3"}}, dworld)
+	waitEvents(t, lt, []string{":b ./b/1", ":a ./a/1", ":a ./a/2 ./a/3"})
+
+	mr.stopWorkers()
+	expected := []string{":b ./b/1", ":a ./a/1", ":a ./a/2 ./a/3"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		a/** {
+			prep +onchange: sleep 0.3; echo ":a" @mods
+		}
+		b/** {
+			prep +onchange: echo ":b" @mods
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:           lt.Log,
+		Config:        cnf,
+		Parallel:      true,
+		MaxConcurrent: 1,
+		quietUntil:    make([]time.Time, len(cnf.Blocks)),
+	}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.startWorkers(dworld)
+
+	// Block b waits for block a to finish
+	mr.trigger(".", &moddwatch.Mod{Changed: []string{"a/1"}}, dworld)
+	time.Sleep(50 * time.Millisecond)
+	mr.trigger(".", &moddwatch.Mod{Changed: []string{"b/1"}}, dworld)
+	waitEvents(t, lt, []string{":a ./a/1", ":b ./b/1"})
+	mr.stopWorkers()
+}
+
+func TestRunLimitFairness(t *testing.T) {
+	l := newRunLimit(1)
+	l.acquire()
+
+	// Queue waiters one at a time, so that their arrival order is known
+	order := make(chan int, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l.acquire()
+			order <- i
+			l.release()
+		}(i)
+		for {
+			l.lock.Lock()
+			n := len(l.waiting)
+			l.lock.Unlock()
+			if n == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	l.release()
+	wg.Wait()
+	for i := 0; i < 10; i++ {
+		if n := <-order; n != i {
+			t.Fatalf("Expected waiter %d to run next, got %d", i, n)
+		}
+	}
+	if l.running != 0 || len(l.waiting) != 0 {
+		t.Errorf("Expected all slots to be released, got %d running and %d waiting", l.running, len(l.waiting))
+	}
+	if newRunLimit(0) != nil {
+		t.Error("Expected no limit for 0")
+	}
+}
@@ -1,6 +1,9 @@
 package modd
 
 import (
+	"fmt"
+	"io"
+	"strings"
 	"time"
 
 	"github.com/cortesi/modd/conf"
@@ -15,6 +18,8 @@ import (
 type ProcError struct {
 	shorttext string
 	Output    string
+	// The exit code, or -1 if the process was terminated by a signal
+	ExitCode int
 }
 
 func (p ProcError) Error() string {
@@ -23,24 +28,146 @@ func (p ProcError) Error() string {
 
 // RunProc runs a process to completion, sending output to log
 func RunProc(cmd string, shellMethod string, dir string, log termlog.Stream) error {
+	return RunProcWith(cmd, shellMethod, dir, log, ProcOptions{})
+}
+
+// ProcOptions are the optional settings for RunProcWith. The zero value runs a
+// process the way RunProc does.
+type ProcOptions struct {
+	// If not nil, connected to the process's stdin
+	Stdin io.Reader
+
+	// If greater than zero, at most this many lines of output are displayed
+	OutputLimit int
+}
+
+// RunProcWith is RunProc, with the optional settings in opts
+func RunProcWith(cmd string, shellMethod string, dir string, log termlog.Stream, opts ProcOptions) error {
+	return runProc(cmd, shellMethod, dir, "", opts.Stdin, nil, opts.OutputLimit, log, nil, 0)
+}
+
+// runProc is RunProcWith, with lifecycle events for the command delivered to
+// hooks, and env added to the command's environment. If user is not empty,
+// the command runs as that user. If timeout is greater than zero, the command
+// is killed if it runs for longer than that.
+func runProc(
+	cmd string,
+	shellMethod string,
+	dir string,
+	user string,
+	stdin io.Reader,
+	env []string,
+	limit int,
+	log termlog.Stream,
+	hooks *commandHooks,
+	timeout time.Duration,
+) error {
 	log.Header()
 	ex, err := shell.NewExecutor(shellMethod, cmd, dir)
 	if err != nil {
 		return err
 	}
+	ex.Stdin = stdin
+	ex.Env = env
+	ex.User = user
+	out := log
+	var lim *limitStream
+	if limit > 0 {
+		lim = &limitStream{Stream: log, limit: limit}
+		out = lim
+	}
+	out = hooks.stream(out)
+	hooks.start()
 	start := time.Now()
-	err, estate := ex.Run(log, true)
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			log.Shout(">> timed out after %s", timeout)
+			ex.Stop()
+		})
+		defer timer.Stop()
+	}
+	err, estate := ex.Run(out, true)
+	if lim != nil {
+		lim.finish()
+	}
 	if err != nil {
+		hooks.exit(time.Since(start), -1)
 		return err
-	} else if estate.Error != nil {
+	}
+	hooks.exit(time.Since(start), estate.ExitCode)
+	if estate.Error != nil {
 		log.Shout("%s", estate.Error)
-		return ProcError{estate.Error.Error(), estate.ErrOutput}
+		return ProcError{estate.Error.Error(), estate.ErrOutput, estate.ExitCode}
 	}
 	log.Notice(">> done (%s)", time.Since(start))
 	return nil
 }
 
-// RunPreps runs all commands in sequence. Stops if any command returns an error.
+// fileList formats a list of paths for a command's stdin, with each path
+// followed by the delimiter.
+func fileList(paths []string, delim string) string {
+	var b strings.Builder
+	for _, p := range paths {
+		b.WriteString(p)
+		b.WriteString(delim)
+	}
+	return b.String()
+}
+
+// shellQuote quotes a path for POSIX shells, so that it is read back as a
+// single word however many spaces, quotes or other special characters it
+// contains
+func shellQuote(p string) string {
+	return "'" + strings.Replace(p, "'", `'\''`, -1) + "'"
+}
+
+// changedEnv formats a list of paths as the MODD_CHANGED environment
+// variable, in one of the formats accepted by the +changed prep option
+func changedEnv(paths []string, format string) string {
+	switch format {
+	case "quoted":
+		quoted := make([]string, len(paths))
+		for i, p := range paths {
+			quoted[i] = shellQuote(p)
+		}
+		return "MODD_CHANGED=" + strings.Join(quoted, " ")
+	case "space":
+		return "MODD_CHANGED=" + strings.Join(paths, " ")
+	default:
+		return "MODD_CHANGED=" + strings.Join(paths, "\n")
+	}
+}
+
+// orderPreps returns preps with a +match option first, followed by all other
+// preps. Declaration order is otherwise preserved.
+func orderPreps(preps []conf.Prep) []conf.Prep {
+	ret := []conf.Prep{}
+	for _, p := range preps {
+		if len(p.Match) > 0 {
+			ret = append(ret, p)
+		}
+	}
+	for _, p := range preps {
+		if len(p.Match) == 0 {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// copyVars copies a variable map, so that the cached @mods for a subset of
+// changes doesn't leak into other commands.
+func copyVars(vars map[string]string) map[string]string {
+	ret := make(map[string]string, len(vars))
+	for k, v := range vars {
+		ret[k] = v
+	}
+	return ret
+}
+
+// RunPreps runs all commands in sequence. Stops if any command returns an
+// error. If the block has a timeout, the command running when it expires is
+// killed, and no further commands run.
 func RunPreps(
 	b conf.Block,
 	vars map[string]string,
@@ -48,6 +175,33 @@ func RunPreps(
 	log termlog.TermLog,
 	notifiers []notify.Notifier,
 	initial bool,
+) error {
+	return RunPrepsWith(b, vars, mod, log, notifiers, initial, PrepOptions{})
+}
+
+// PrepOptions are the optional settings for RunPrepsWith. The zero value runs
+// preps the way RunPreps does.
+type PrepOptions struct {
+	// If not nil, used to collapse repeated identical failures
+	Collapse *Collapser
+
+	// If greater than zero, the output displayed for each command is limited
+	// to this many lines
+	OutputLimit int
+
+	// Lifecycle hooks for the block's commands
+	hooks *blockHooks
+}
+
+// RunPrepsWith is RunPreps, with the optional settings in opts
+func RunPrepsWith(
+	b conf.Block,
+	vars map[string]string,
+	mod *moddwatch.Mod,
+	log termlog.TermLog,
+	notifiers []notify.Notifier,
+	initial bool,
+	opts PrepOptions,
 ) error {
 	sh, err := shell.GetShellName(vars[shellVarName])
 	if err != nil {
@@ -59,9 +213,49 @@ func RunPreps(
 		modified = mod.All()
 	}
 
+	// timeLeft returns the time remaining before the block's deadline, or
+	// zero if it has none
+	var deadline time.Time
+	if b.Timeout > 0 {
+		deadline = time.Now().Add(b.Timeout)
+	}
+	timeLeft := func() (time.Duration, error) {
+		if deadline.IsZero() {
+			return 0, nil
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return 0, fmt.Errorf("block timed out after %s", b.Timeout)
+		}
+		return left, nil
+	}
+
 	vcmd := varcmd.VarCmd{Block: &b, Modified: modified, Vars: vars}
-	for _, p := range b.Preps {
-		cmd, err := vcmd.Render(p.Command)
+	for _, p := range orderPreps(b.Preps) {
+		pv := vcmd
+		if len(p.Match) > 0 {
+			if initial {
+				log.Say(niceHeader("skipping prep: ", p.Command))
+				continue
+			}
+			matched, err := FilterFiles(modified, p.Match, nil)
+			if err != nil {
+				return err
+			}
+			if len(matched.Files) == 0 {
+				continue
+			}
+			pv = varcmd.VarCmd{Block: &b, Modified: matched.Files, Vars: copyVars(vars)}
+		} else if p.All {
+			// Without a list of modified files, VarCmd lists every file
+			// matching the block. An earlier prep may have cached @mods for
+			// the changed files.
+			pvars := copyVars(vars)
+			delete(pvars, "@mods")
+			delete(pvars, "@dirmods")
+			pv = varcmd.VarCmd{Block: &b, Vars: pvars}
+		}
+		cmd, err := pv.Render(p.Command)
 		if initial && p.Onchange {
 			log.Say(niceHeader("skipping prep: ", cmd))
 			continue
@@ -69,15 +263,138 @@ func RunPreps(
 		if err != nil {
 			return err
 		}
-		err = RunProc(cmd, sh, b.InDir, log.Stream(niceHeader("prep: ", cmd)))
+		var stdinList string
+		if p.Stdin != "" {
+			paths, err := pv.Paths()
+			if err != nil {
+				return err
+			}
+			stdinList = fileList(paths, p.Stdin)
+		}
+		var env []string
+		if p.Changed != "" {
+			paths, err := pv.Paths()
+			if err != nil {
+				return err
+			}
+			env = []string{changedEnv(paths, p.Changed)}
+		}
+		left, err := timeLeft()
 		if err != nil {
-			if pe, ok := err.(ProcError); ok {
-				for _, n := range notifiers {
-					n.Push("modd error", pe.Output, "")
-				}
+			return err
+		}
+		stream := log.Stream(niceHeader("prep: ", cmd))
+		ph := opts.hooks.command("prep", cmd)
+		run := func(s termlog.Stream) error {
+			// Each attempt gets its own reader, since the previous one was
+			// read to the end
+			var stdin io.Reader
+			if p.Stdin != "" {
+				stdin = strings.NewReader(stdinList)
+			}
+			return runProc(cmd, sh, b.InDir, b.User, stdin, env, opts.OutputLimit, prefixOutput(s, p.Prefix), ph, left)
+		}
+		for attempt := 1; ; attempt++ {
+			if opts.Collapse != nil {
+				err = opts.Collapse.run(cmd, stream, run)
+			} else {
+				err = run(stream)
+			}
+			if _, ok := err.(ProcError); !ok || attempt > p.Retry {
+				break
+			}
+			stream.Notice(">> retry %d of %d in %s", attempt, p.Retry, p.RetryDelay)
+			if left, err = timeLeft(); err != nil {
+				return err
+			}
+			// Don't wait beyond the block's deadline
+			wait := p.RetryDelay
+			if left > 0 && left < wait {
+				wait = left
+			}
+			time.Sleep(wait)
+			if left, err = timeLeft(); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			notifyResult("prep", cmd, err, notifiers, log)
+			left, terr := timeLeft()
+			if terr != nil {
+				return terr
+			}
+			if p.OnFailure != nil {
+				// The prep's error is what fails the block, whatever the
+				// outcome of the follow-up
+				runFollowUp("onfailure", p.OnFailure, &pv, sh, b.InDir, b.User, opts.OutputLimit, log, opts.hooks, left)
 			}
 			return err
 		}
+		notifyResult("prep", cmd, nil, notifiers, log)
+		if p.OnSuccess != nil {
+			left, err := timeLeft()
+			if err != nil {
+				return err
+			}
+			err = runFollowUp("onsuccess", p.OnSuccess, &pv, sh, b.InDir, b.User, opts.OutputLimit, log, opts.hooks, left)
+			fcmd, _ := pv.Render(p.OnSuccess.Command)
+			notifyResult("onsuccess", fcmd, err, notifiers, log)
+			if err != nil && !p.OnSuccess.NoFail {
+				return err
+			}
+		}
 	}
 	return nil
 }
+
+// notifyResult tells all notifiers the outcome of a command. Errors that
+// aren't a ProcError mean the command couldn't be run at all, and aren't
+// notified. Notifier errors and panics are logged, and don't affect the run.
+func notifyResult(kind string, command string, err error, notifiers []notify.Notifier, log termlog.Logger) {
+	event := notify.Event{Kind: kind, Command: command}
+	status := notify.Succeeded
+	if err != nil {
+		pe, ok := err.(ProcError)
+		if !ok {
+			return
+		}
+		event.Output = pe.Output
+		status = notify.Failed
+	}
+	for _, n := range notifiers {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Warn("Panic in notifier: %v", r)
+				}
+			}()
+			if err := n.Notify(event, status); err != nil {
+				log.Warn("Notifier error: %s", err)
+			}
+		}()
+	}
+}
+
+// runFollowUp runs an onsuccess or onfailure command for a prep, with the same
+// variables as the prep itself. If timeout is greater than zero, the command is
+// killed if it runs for longer than that.
+func runFollowUp(
+	kind string,
+	f *conf.FollowUp,
+	vcmd *varcmd.VarCmd,
+	sh string,
+	dir string,
+	user string,
+	outputLimit int,
+	log termlog.TermLog,
+	hooks *blockHooks,
+	timeout time.Duration,
+) error {
+	cmd, err := vcmd.Render(f.Command)
+	if err != nil {
+		log.Warn("%s", err)
+		return err
+	}
+	stream := log.Stream(niceHeader(kind+": ", cmd))
+	return runProc(cmd, sh, dir, user, nil, nil, outputLimit, stream, hooks.command(kind, cmd), timeout)
+}
@@ -2,6 +2,7 @@ package modd
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"strings"
 	"sync"
@@ -34,6 +35,30 @@ func niceHeader(preamble string, command string) string {
 	return pre + command
 }
 
+// prefixStream is a termlog.Stream that prefixes each line of command output
+// - anything logged with Say or Warn - with a label
+type prefixStream struct {
+	termlog.Stream
+	prefix string
+}
+
+// prefixOutput wraps a stream so that command output is prefixed with a
+// label, if there is one
+func prefixOutput(s termlog.Stream, label string) termlog.Stream {
+	if label == "" {
+		return s
+	}
+	return &prefixStream{Stream: s, prefix: "[" + label + "] "}
+}
+
+func (p *prefixStream) Say(format string, args ...interface{}) {
+	p.Stream.Say("%s%s", p.prefix, fmt.Sprintf(format, args...))
+}
+
+func (p *prefixStream) Warn(format string, args ...interface{}) {
+	p.Stream.Warn("%s%s", p.prefix, fmt.Sprintf(format, args...))
+}
+
 func logOutput(wg *sync.WaitGroup, fp io.ReadCloser, out func(string, ...interface{})) {
 	defer wg.Done()
 	r := bufio.NewReader(fp)
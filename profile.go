@@ -0,0 +1,82 @@
+package modd
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+)
+
+// FilterProfile holds measurements of the file search for a block, averaged
+// over a number of runs
+type FilterProfile struct {
+	// The block number, starting at 1, or 0 for the total over all blocks
+	Block int
+	// The mean time taken to find the block's files
+	Duration time.Duration
+	// The number of files found
+	Files int
+	// The mean number of heap allocations, and of bytes allocated
+	Allocs uint64
+	Bytes  uint64
+}
+
+func (p FilterProfile) String() string {
+	name := "total"
+	if p.Block > 0 {
+		name = fmt.Sprintf("block %d", p.Block)
+	}
+	return fmt.Sprintf(
+		"%s: %s, %d files, %d allocs, %d bytes",
+		name, p.Duration, p.Files, p.Allocs, p.Bytes,
+	)
+}
+
+// ProfileFilter runs the file search for each block of a config - the same
+// search that lists the files for a block's initial run - runs times over
+// dir, and measures it. Profiles are returned slowest first, followed by the
+// total for all blocks. Allocations are counted for the whole process, so
+// they are only accurate if nothing else is running.
+func ProfileFilter(cnf *conf.Config, dir string, runs int) ([]FilterProfile, error) {
+	if runs < 1 {
+		runs = 1
+	}
+	ret := []FilterProfile{}
+	total := FilterProfile{}
+	for i, b := range cnf.Blocks {
+		p := FilterProfile{Block: i + 1}
+		var before, after runtime.MemStats
+		var elapsed time.Duration
+		for r := 0; r < runs; r++ {
+			runtime.ReadMemStats(&before)
+			start := time.Now()
+			// Copies, so that the search can't change the block's patterns
+			includes := append([]string{}, b.Include...)
+			excludes := append([]string{}, b.Exclude...)
+			paths, err := listFiles(dir, includes, excludes)
+			elapsed += time.Since(start)
+			runtime.ReadMemStats(&after)
+			if err != nil {
+				return nil, fmt.Errorf("block %d: %s", i+1, err)
+			}
+			p.Files = len(paths)
+			p.Allocs += after.Mallocs - before.Mallocs
+			p.Bytes += after.TotalAlloc - before.TotalAlloc
+		}
+		p.Duration = elapsed / time.Duration(runs)
+		p.Allocs /= uint64(runs)
+		p.Bytes /= uint64(runs)
+
+		total.Duration += p.Duration
+		total.Files += p.Files
+		total.Allocs += p.Allocs
+		total.Bytes += p.Bytes
+		ret = append(ret, p)
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Duration > ret[j].Duration
+	})
+	return append(ret, total), nil
+}
@@ -0,0 +1,57 @@
+package modd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/utils"
+)
+
+func TestProfileFilter(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	touch("a/one.go")
+	touch("a/two.go")
+	touch("b/three.txt")
+
+	cnf, err := conf.Parse("test", `
+		a/** {}
+		**/*.txt {}
+		none/** {}
+		a/** a/*.go {}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profiles, err := ProfileFilter(cnf, ".", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 5 {
+		t.Fatalf("Expected 4 blocks and a total, got %#v", profiles)
+	}
+	files := map[int]int{}
+	for i, p := range profiles[:4] {
+		files[p.Block] = p.Files
+		if i > 0 && p.Duration > profiles[i-1].Duration {
+			t.Errorf("Profiles not sorted slowest first: %#v", profiles)
+		}
+	}
+	// Files matched by more than one pattern are counted once
+	expected := map[int]int{1: 2, 2: 1, 3: 0, 4: 2}
+	for b, n := range expected {
+		if files[b] != n {
+			t.Errorf("Block %d: expected %d files, got %d", b, n, files[b])
+		}
+	}
+	if inc := cnf.Blocks[3].Include; len(inc) != 2 || inc[0] != "a/**" || inc[1] != "a/*.go" {
+		t.Errorf("Block patterns changed: %#v", inc)
+	}
+	total := profiles[4]
+	if total.Block != 0 || total.Files != 5 {
+		t.Errorf("Unexpected total: %#v", total)
+	}
+	if !strings.HasPrefix(total.String(), "total: ") {
+		t.Errorf("Unexpected total: %s", total)
+	}
+}
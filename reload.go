@@ -0,0 +1,182 @@
+package modd
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/moddwatch"
+)
+
+// blocksEqual checks whether two blocks are equivalent. Patterns are compared
+// with conf.PatternsEqual, and all other fields must be identical.
+func blocksEqual(a, b conf.Block) bool {
+	if !conf.PatternsEqual(a.Include, a.Exclude, b.Include, b.Exclude) {
+		return false
+	}
+	a.Include, a.Exclude = nil, nil
+	b.Include, b.Exclude = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// keepHeld carries the changes held for settling over to the new config for
+// blocks that were kept, whose positions in the new config are given by from.
+// Changes held for blocks that didn't survive the reload are dropped, and
+// logged.
+func (mr *ModRunner) keepHeld(kept []bool, from []int, used []bool) {
+	if mr.pending == nil {
+		return
+	}
+	for j, mod := range mr.pending {
+		if mod != nil && !used[j] {
+			mr.Log.Notice("Dropping held changes for block %d, which changed on reload", j+1)
+		}
+	}
+	n := len(kept)
+	pending := make([]*moddwatch.Mod, n)
+	settleAt := make([]time.Time, n)
+	sizes := make([]map[string]int64, n)
+	snapshots := make([]string, n)
+	holdLimit := make([]time.Time, n)
+	for i, k := range kept {
+		if k {
+			j := from[i]
+			pending[i], settleAt[i], sizes[i] = mr.pending[j], mr.settleAt[j], mr.sizes[j]
+			snapshots[i], holdLimit[i] = mr.snapshots[j], mr.holdLimit[j]
+		}
+	}
+	mr.pending, mr.settleAt, mr.sizes = pending, settleAt, sizes
+	mr.snapshots, mr.holdLimit = snapshots, holdLimit
+}
+
+// changedVars returns the names of variables that differ between two variable
+// maps, including those only present in one of them
+func changedVars(a, b map[string]string) map[string]bool {
+	ret := map[string]bool{}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			ret[k] = true
+		}
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			ret[k] = true
+		}
+	}
+	return ret
+}
+
+// blockUsesVars checks whether any of a block's commands might refer to one of
+// a set of variables. A change to the shell affects every command. The check
+// is textual, so a variable whose name is a prefix of another's can give a
+// false positive, which only costs a restart.
+func blockUsesVars(b conf.Block, vars map[string]bool) bool {
+	if len(vars) == 0 {
+		return false
+	}
+	if vars[shellVarName] {
+		return true
+	}
+	commands := append([]string{}, b.Shutdown...)
+	for _, p := range b.Preps {
+		commands = append(commands, p.Command)
+		for _, f := range []*conf.FollowUp{p.OnSuccess, p.OnFailure} {
+			if f != nil {
+				commands = append(commands, f.Command)
+			}
+		}
+	}
+	for _, d := range b.Daemons {
+		commands = append(commands, d.Command)
+	}
+	for _, c := range commands {
+		for v := range vars {
+			if strings.Contains(c, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reload switches the runner to a new config. Blocks that are unchanged in the
+// new config, and whose commands don't use any variable that changed, keep
+// their running daemons, and the daemons of removed or changed blocks are
+// stopped. The returned slice marks the blocks of the new config
+// that were kept. If an error occurs, the old config and daemons are left
+// untouched.
+func (mr *ModRunner) reload(newcnf *conf.Config, dworld *DaemonWorld) (*DaemonWorld, []bool, error) {
+	kept := make([]bool, len(newcnf.Blocks))
+	used := make([]bool, len(mr.Config.Blocks))
+	pens := make([]*DaemonPen, len(newcnf.Blocks))
+	quietUntil := make([]time.Time, len(newcnf.Blocks))
+	failed := make([]bool, len(newcnf.Blocks))
+	graceUntil := make([]time.Time, len(newcnf.Blocks))
+	// The old block each kept block came from
+	from := make([]int, len(newcnf.Blocks))
+
+	// Blocks whose commands use a variable that changed can't be kept
+	changed := changedVars(mr.Config.GetVariables(), newcnf.GetVariables())
+	for i, nb := range newcnf.Blocks {
+		if blockUsesVars(nb, changed) {
+			continue
+		}
+		for j, ob := range mr.Config.Blocks {
+			if !used[j] && blocksEqual(ob, nb) {
+				used[j] = true
+				kept[i] = true
+				from[i] = j
+				pens[i] = dworld.DaemonPens[j]
+				quietUntil[i] = mr.quietUntil[j]
+				if j < len(mr.failed) {
+					failed[i] = mr.failed[j]
+				}
+				if j < len(mr.graceUntil) {
+					graceUntil[i] = mr.graceUntil[j]
+				}
+				break
+			}
+		}
+	}
+	for i, nb := range newcnf.Blocks {
+		if pens[i] != nil {
+			continue
+		}
+		d, err := NewDaemonPen(nb, newcnf.GetVariables(), mr.Log)
+		if err != nil {
+			return dworld, nil, err
+		}
+		pens[i] = d
+	}
+	// Block numbers can change, even for kept blocks
+	for i, dp := range pens {
+		dp.setHooks(mr.blockHooks(i))
+	}
+
+	stopped := &DaemonWorld{}
+	for j, dp := range dworld.DaemonPens {
+		if !used[j] {
+			stopped.DaemonPens = append(stopped.DaemonPens, dp)
+		}
+	}
+	stopped.Shutdown(nil)
+
+	nkept := 0
+	for _, k := range kept {
+		if k {
+			nkept++
+		}
+	}
+	mr.Log.Notice(
+		"Config reloaded: %d blocks unchanged, %d started",
+		nkept, len(kept)-nkept,
+	)
+	mr.Config = newcnf
+	mr.quietLock.Lock()
+	mr.quietUntil, mr.failed = quietUntil, failed
+	mr.quietLock.Unlock()
+	mr.graceUntil = graceUntil
+	mr.keepHeld(kept, from, used)
+	return &DaemonWorld{pens}, kept, nil
+}
@@ -0,0 +1,259 @@
+package modd
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/utils"
+	"github.com/cortesi/moddwatch"
+	"github.com/cortesi/termlog"
+)
+
+var blocksEqualTests = []struct {
+	a, b  string
+	equal bool
+}{
+	{"a b { prep: foo\n}", "b ./a { prep: foo\n}", true},
+	{"a !b { prep: foo\n}", "a !b !b { prep: foo\n}", true},
+	{"a { prep: foo\n}", "a { prep: bar\n}", false},
+	{"a { prep: foo\n}", "a !b { prep: foo\n}", false},
+	{"a { daemon: foo\n}", "a { daemon +sigterm: foo\n}", false},
+	{"a { prep: foo\n}", "a { indir: foo\nprep: foo\n}", false},
+}
+
+func TestBlocksEqual(t *testing.T) {
+	for i, tt := range blocksEqualTests {
+		a, err := conf.Parse("test", tt.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := conf.Parse("test", tt.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ret := blocksEqual(a.Blocks[0], b.Blocks[0]); ret != tt.equal {
+			t.Errorf("%d: expected %v, got %v", i, tt.equal, ret)
+		}
+	}
+}
+
+func mustParse(t *testing.T, s string) *conf.Config {
+	cnf, err := conf.Parse("test", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cnf
+}
+
+func TestReload(t *testing.T) {
+	lt := termlog.NewLogTest()
+	cnf := mustParse(t, `
+		a/** { prep: echo a
+		}
+		b/** { daemon: sleep 100
+		}
+	`)
+	mr := ModRunner{Log: lt.Log, Config: cnf}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quiet := time.Now().Add(time.Hour)
+	mr.quietUntil = []time.Time{quiet, {}}
+
+	newcnf := mustParse(t, `
+		c/** { prep: echo c
+		}
+		b/** { daemon: sleep 200
+		}
+		./a/** { prep: echo a
+		}
+	`)
+	newworld, kept, err := mr.reload(newcnf, dworld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mr.Config != newcnf {
+		t.Error("Config not replaced")
+	}
+	if !kept[2] || kept[0] || kept[1] {
+		t.Errorf("Unexpected kept blocks: %v", kept)
+	}
+	if newworld.DaemonPens[2] != dworld.DaemonPens[0] {
+		t.Error("Daemon pen of unchanged block not kept")
+	}
+	if newworld.DaemonPens[1] == dworld.DaemonPens[1] {
+		t.Error("Daemon pen of changed block kept")
+	}
+	if !mr.quietUntil[2].Equal(quiet) || !mr.quietUntil[0].IsZero() {
+		t.Errorf("Unexpected cooldowns: %v", mr.quietUntil)
+	}
+
+	// Changing a variable restarts the blocks that use it
+	newworld, kept, err = mr.reload(mustParse(t, `
+		@foo = bar
+		./a/** { prep: echo a
+		}
+		b/** { daemon: sleep 200
+		}
+	`), newworld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, kept, err = mr.reload(mustParse(t, `
+		@foo = baz
+		./a/** { prep: echo a
+		}
+		b/** { daemon: sleep 200 @foo
+		}
+	`), newworld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !kept[0] || kept[1] {
+		t.Errorf("Unexpected kept blocks: %v", kept)
+	}
+
+	// The shell affects every command
+	_, kept, err = mr.reload(mustParse(t, "@foo = baz\n@shell = bash\n./a/** { prep: echo a\n}"), newworld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept[0] {
+		t.Errorf("Unexpected kept blocks: %v", kept)
+	}
+}
+
+func TestBlockUsesVars(t *testing.T) {
+	b := mustParse(t, `
+		a {
+			prep: echo @one
+			onfailure: echo @two
+			daemon: echo @three
+			shutdown: echo @four
+		}
+	`).Blocks[0]
+	for _, v := range []string{"@one", "@two", "@three", "@four", "@shell"} {
+		if !blockUsesVars(b, map[string]bool{v: true}) {
+			t.Errorf("Expected %s to be used", v)
+		}
+	}
+	if blockUsesVars(b, map[string]bool{"@five": true}) {
+		t.Error("Unexpected use of @five")
+	}
+	if blockUsesVars(b, map[string]bool{}) {
+		t.Error("Unexpected use with no changed variables")
+	}
+}
+
+func TestWatchReload(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:        lt.Log,
+		ConfPath:   "modd.conf",
+		ConfReload: true,
+		Config:     mustParse(t, "a/** { prep: echo a\n}"),
+	}
+	dworld, err := NewDaemonWorld(mr.Config, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modchan := make(chan *moddwatch.Mod, 2)
+	changed := &moddwatch.Mod{Changed: []string{"modd.conf"}}
+
+	// An invalid config is reported, and the old config keeps running
+	err = ioutil.WriteFile("modd.conf", []byte("a/** {"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modchan <- changed
+	modchan <- nil
+	if newcnf := mr.watch(".", modchan, dworld, time.Time{}, nil); newcnf != nil {
+		t.Errorf("Expected no new config, got %v", newcnf)
+	}
+	if !strings.Contains(lt.String(), "Error reading config file modd.conf") {
+		t.Errorf("Parse error not logged: %s", lt.String())
+	}
+
+	err = ioutil.WriteFile("modd.conf", []byte("b/** { prep: echo b\n}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modchan <- changed
+	newcnf := mr.watch(".", modchan, dworld, time.Time{}, nil)
+	if newcnf == nil || newcnf.Blocks[0].Include[0] != "b/**" {
+		t.Errorf("Expected new config, got %v", newcnf)
+	}
+}
+
+func TestWatchReloadDuringGrace(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:        lt.Log,
+		ConfPath:   "modd.conf",
+		ConfReload: true,
+		Config:     mustParse(t, "a/** { prep: echo a\n}"),
+	}
+	dworld, err := NewDaemonWorld(mr.Config, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile("modd.conf", []byte("b/** { prep: echo b\n}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modchan := make(chan *moddwatch.Mod, 1)
+	modchan <- &moddwatch.Mod{Changed: []string{"modd.conf"}}
+	newcnf := mr.watch(".", modchan, dworld, time.Now().Add(time.Hour), nil)
+	if newcnf == nil || newcnf.Blocks[0].Include[0] != "b/**" {
+		t.Errorf("Expected new config during the grace period, got %v", newcnf)
+	}
+}
+
+func TestReloadHeldChanges(t *testing.T) {
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log: lt.Log,
+		Config: mustParse(t, `
+			a/** +settle=1h { prep: echo a
+			}
+			b/** +settle=1h { prep: echo b
+			}
+		`),
+	}
+	dworld, err := NewDaemonWorld(mr.Config, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.quietUntil = make([]time.Time, len(mr.Config.Blocks))
+	mr.hold(0, &moddwatch.Mod{Changed: []string{"a/one"}})
+	mr.hold(1, &moddwatch.Mod{Changed: []string{"b/one"}})
+
+	// Block a is kept, but moves to second place, and block b changes
+	newcnf := mustParse(t, `
+		b/** +settle=1h { prep: echo changed
+		}
+		a/** +settle=1h { prep: echo a
+		}
+	`)
+	_, _, err = mr.reload(newcnf, dworld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mr.pending[0] != nil {
+		t.Errorf("Expected no held changes for the changed block, got %v", mr.pending[0])
+	}
+	if mr.pending[1] == nil || !mr.pending[1].Has("a/one") {
+		t.Errorf("Expected held changes for the kept block, got %v", mr.pending[1])
+	}
+	if !strings.Contains(lt.String(), "Dropping held changes for block 2") {
+		t.Errorf("Dropped changes not logged: %s", lt.String())
+	}
+}
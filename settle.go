@@ -0,0 +1,160 @@
+package modd
+
+import (
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/moddwatch"
+)
+
+// mergeMods combines two sets of changes, removing duplicates
+func mergeMods(a *moddwatch.Mod, b *moddwatch.Mod) *moddwatch.Mod {
+	merge := func(x, y []string) []string {
+		seen := map[string]bool{}
+		ret := []string{}
+		for _, p := range append(append([]string{}, x...), y...) {
+			if !seen[p] {
+				seen[p] = true
+				ret = append(ret, p)
+			}
+		}
+		return ret
+	}
+	return &moddwatch.Mod{
+		Changed: merge(a.Changed, b.Changed),
+		Deleted: merge(a.Deleted, b.Deleted),
+		Added:   merge(a.Added, b.Added),
+	}
+}
+
+// fileSizes returns the sizes of the changed files in a mod, with -1 for files
+// that no longer exist
+func fileSizes(mod *moddwatch.Mod) map[string]int64 {
+	sizes := map[string]int64{}
+	for _, p := range mod.All() {
+		sizes[p] = -1
+		if fi, err := os.Stat(p); err == nil {
+			sizes[p] = fi.Size()
+		}
+	}
+	return sizes
+}
+
+// quiesceMax returns the longest a block with a quiesce period holds changes
+func quiesceMax(b conf.Block) time.Duration {
+	if b.QuiesceMax > 0 {
+		return b.QuiesceMax
+	}
+	return conf.DefaultQuiesceMax
+}
+
+// snapshot returns a hash of the files matching a block's patterns. Errors
+// are logged, and give an empty snapshot.
+func (mr *ModRunner) snapshot(block int) string {
+	b := mr.Config.Blocks[block]
+	hash, err := FindHash(".", b.Include, b.Exclude)
+	if err != nil {
+		mr.Log.Shout("Error checking files for block %d: %s", block+1, err)
+		return ""
+	}
+	return hash
+}
+
+// hold accumulates changes for a block with a settle, stable or quiesce
+// period. The block runs once no further changes have arrived for the settle
+// period, the sizes of the changed files have stayed the same for the stable
+// period, and the block's file set has stayed the same for the quiesce
+// period. A block with a quiesce period runs once its changes have been held
+// for QuiesceMax, even if files are still changing.
+func (mr *ModRunner) hold(block int, mod *moddwatch.Mod) {
+	if mr.pending == nil {
+		mr.pending = make([]*moddwatch.Mod, len(mr.Config.Blocks))
+		mr.settleAt = make([]time.Time, len(mr.Config.Blocks))
+		mr.sizes = make([]map[string]int64, len(mr.Config.Blocks))
+		mr.snapshots = make([]string, len(mr.Config.Blocks))
+		mr.holdLimit = make([]time.Time, len(mr.Config.Blocks))
+	}
+	b := mr.Config.Blocks[block]
+	now := time.Now()
+	if mr.pending[block] == nil {
+		mr.pending[block] = mod
+		if b.Quiesce > 0 {
+			mr.snapshots[block] = mr.snapshot(block)
+			mr.holdLimit[block] = now.Add(quiesceMax(b))
+		}
+	} else {
+		mr.pending[block] = mergeMods(mr.pending[block], mod)
+	}
+	wait := b.Settle
+	if b.Stable > wait {
+		wait = b.Stable
+	}
+	if b.Quiesce > wait {
+		wait = b.Quiesce
+	}
+	if b.Stable > 0 {
+		mr.sizes[block] = fileSizes(mr.pending[block])
+	}
+	mr.settleAt[block] = mr.limitHold(block, now.Add(wait))
+	mr.Log.SayAs("debug", "Holding changes for block %d until it settles", block+1)
+}
+
+// limitHold caps the time at which a block's held changes run at its hold
+// limit, if it has one
+func (mr *ModRunner) limitHold(block int, t time.Time) time.Time {
+	if mr.Config.Blocks[block].Quiesce > 0 && t.After(mr.holdLimit[block]) {
+		return mr.holdLimit[block]
+	}
+	return t
+}
+
+// nextSettle returns the time at which the next held block is due to run
+func (mr *ModRunner) nextSettle() (time.Time, bool) {
+	var next time.Time
+	found := false
+	for i, mod := range mr.pending {
+		if mod != nil && (!found || mr.settleAt[i].Before(next)) {
+			next = mr.settleAt[i]
+			found = true
+		}
+	}
+	return next, found
+}
+
+// runSettled runs all held blocks whose settle period has passed
+func (mr *ModRunner) runSettled(dworld *DaemonWorld) {
+	now := time.Now()
+	for i, mod := range mr.pending {
+		if mod == nil || now.Before(mr.settleAt[i]) {
+			continue
+		}
+		if stable := mr.Config.Blocks[i].Stable; stable > 0 {
+			sizes := fileSizes(mod)
+			if !reflect.DeepEqual(sizes, mr.sizes[i]) {
+				mr.Log.SayAs("debug", "Files for block %d are still changing", i+1)
+				mr.sizes[i] = sizes
+				mr.settleAt[i] = now.Add(stable)
+				continue
+			}
+		}
+		if quiesce := mr.Config.Blocks[i].Quiesce; quiesce > 0 {
+			snapshot := mr.snapshot(i)
+			if snapshot != mr.snapshots[i] {
+				if now.Before(mr.holdLimit[i]) {
+					mr.Log.SayAs("debug", "Files for block %d are still changing", i+1)
+					mr.snapshots[i] = snapshot
+					mr.settleAt[i] = mr.limitHold(i, now.Add(quiesce))
+					continue
+				}
+				mr.Log.Notice(
+					"Files for block %d still changing after %s, running anyway",
+					i+1, quiesceMax(mr.Config.Blocks[i]),
+				)
+			}
+		}
+		mr.pending[i] = nil
+		mr.dispatch(i, mod, dworld)
+	}
+}
@@ -0,0 +1,66 @@
+package shell
+
+import (
+	"fmt"
+	"strings"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// Characters that have a special meaning to a shell when they appear unquoted
+// in a word
+const unquotedSpecial = "*?[{~"
+
+// SplitArgv parses a command into a list of arguments for direct execution.
+// Quoting and backslash escapes are interpreted as they would be by a POSIX
+// shell, but any other shell syntax - pipes, redirects, command lists,
+// variables, substitutions, globs and so forth - is an error.
+func SplitArgv(command string) ([]string, error) {
+	requiresShell := fmt.Errorf("command requires a shell: %s", command)
+	f, err := syntax.NewParser().Parse(strings.NewReader(command), "")
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Stmts) != 1 {
+		return nil, requiresShell
+	}
+	st := f.Stmts[0]
+	if st.Negated || st.Background || st.Coprocess || len(st.Redirs) > 0 {
+		return nil, requiresShell
+	}
+	call, ok := st.Cmd.(*syntax.CallExpr)
+	if !ok || len(call.Assigns) > 0 {
+		return nil, requiresShell
+	}
+	for _, w := range call.Args {
+		if !literalParts(w.Parts, false) {
+			return nil, requiresShell
+		}
+	}
+	// With only literals and quotes, expansion just removes quotes
+	return expand.Fields(nil, call.Args...)
+}
+
+// literalParts checks that word parts consist only of literal text and quotes
+func literalParts(parts []syntax.WordPart, quoted bool) bool {
+	for _, p := range parts {
+		switch p := p.(type) {
+		case *syntax.Lit:
+			if !quoted && strings.ContainsAny(p.Value, unquotedSpecial) {
+				return false
+			}
+		case *syntax.SglQuoted:
+			if p.Dollar {
+				return false
+			}
+		case *syntax.DblQuoted:
+			if p.Dollar || !literalParts(p.Parts, true) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package shell
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var splitArgvTests = []struct {
+	command string
+	argv    []string
+	err     string
+}{
+	{"go test ./...", []string{"go", "test", "./..."}, ""},
+	{`echo "a b" 'c d' e\ f`, []string{"echo", "a b", "c d", "e f"}, ""},
+	{`ls "./foo \"bar\""`, []string{"ls", `./foo "bar"`}, ""},
+	{`echo "*.go"`, []string{"echo", "*.go"}, ""},
+	{`printf '' x`, []string{"printf", "", "x"}, ""},
+	{"echo a | wc", nil, "requires a shell"},
+	{"echo a > out", nil, "requires a shell"},
+	{"true && false", nil, "requires a shell"},
+	{"true; false", nil, "requires a shell"},
+	{"echo $HOME", nil, "requires a shell"},
+	{`echo "$HOME"`, nil, "requires a shell"},
+	{"echo $(date)", nil, "requires a shell"},
+	{"echo *.go", nil, "requires a shell"},
+	{"echo ~/foo", nil, "requires a shell"},
+	{"FOO=bar env", nil, "requires a shell"},
+	{"sleep 1 &", nil, "requires a shell"},
+	{"if true; then echo; fi", nil, "requires a shell"},
+	{"", nil, "requires a shell"},
+	{`echo "unterminated`, nil, "reached EOF"},
+}
+
+func TestSplitArgv(t *testing.T) {
+	for _, tt := range splitArgvTests {
+		argv, err := SplitArgv(tt.command)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: expected error containing %q, got %v", tt.command, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tt.command, err)
+		} else if !reflect.DeepEqual(argv, tt.argv) {
+			t.Errorf("%q: expected %#v, got %#v", tt.command, tt.argv, argv)
+		}
+	}
+}
@@ -14,6 +14,7 @@ import (
 
 var ValidShells = map[string]bool{
 	"bash":       true,
+	"exec":       true,
 	"modd":       true,
 	"powershell": true,
 	"sh":         true,
@@ -27,6 +28,14 @@ type Executor struct {
 	Shell   string
 	Command string
 	Dir     string
+	// If not nil, the command's stdin is read from Stdin
+	Stdin io.Reader
+	// Variables in the form key=value that are added to the command's
+	// environment
+	Env []string
+	// If not empty, the command runs as this user, given as user or
+	// user:group. This is ignored where UserSupported is false.
+	User string
 
 	cmd  *exec.Cmd
 	stdo io.ReadCloser
@@ -38,6 +47,8 @@ type ExecState struct {
 	Error     error
 	ErrOutput string
 	ProcState string
+	// The exit code, or -1 if the process was terminated by a signal
+	ExitCode int
 }
 
 func GetShellName(v string) (string, error) {
@@ -72,7 +83,16 @@ func (e *Executor) start(
 	if err != nil {
 		return nil, nil, nil, err
 	}
+	if e.User != "" {
+		if err := setUser(cmd, e.User); err != nil {
+			return nil, nil, nil, err
+		}
+	}
 	e.cmd = cmd
+	cmd.Stdin = e.Stdin
+	if len(e.Env) > 0 {
+		cmd.Env = append(os.Environ(), e.Env...)
+	}
 
 	stdo, err := cmd.StdoutPipe()
 	if err != nil {
@@ -142,6 +162,7 @@ func (e *Executor) Run(log termlog.Stream, bufferr bool) (error, *ExecState) {
 		Error:     eret,
 		ErrOutput: buff.String(),
 		ProcState: cmd.ProcessState.String(),
+		ExitCode:  cmd.ProcessState.ExitCode(),
 	}
 	e.reset()
 	return nil, estate
@@ -160,15 +181,26 @@ func (e *Executor) Stop() error {
 	return e.Signal(os.Kill)
 }
 
+// logOutput sends each line read from fp to out. Lines too long for the read
+// buffer are reassembled, so that out always receives complete lines.
 func logOutput(wg *sync.WaitGroup, fp io.ReadCloser, out func(string, ...interface{})) {
 	defer wg.Done()
 	r := bufio.NewReader(fp)
+	var partial []byte
 	for {
-		line, _, err := r.ReadLine()
+		line, isPrefix, err := r.ReadLine()
 		if err != nil {
+			if len(partial) > 0 {
+				out("%s", string(partial))
+			}
 			return
 		}
-		out("%s", string(line))
+		if isPrefix {
+			partial = append(partial, line...)
+			continue
+		}
+		out("%s", string(append(partial, line...)))
+		partial = partial[:0]
 	}
 }
 
@@ -178,6 +210,9 @@ func CheckShell(shell string) (string, error) {
 		return "", fmt.Errorf("unsupported shell: %q", shell)
 	}
 	switch shell {
+	case "exec":
+		// Commands are executed directly, without a shell
+		return "", nil
 	case "powershell":
 		if _, err := exec.LookPath("powershell"); err == nil {
 			return "powershell", nil
@@ -207,6 +242,12 @@ func makeCommand(shell string, command string, dir string) (*exec.Cmd, error) {
 	switch shell {
 	case "bash", "sh":
 		cmd = exec.Command(shcmd, "-c", command)
+	case "exec":
+		argv, err := SplitArgv(command)
+		if err != nil {
+			return nil, err
+		}
+		cmd = exec.Command(argv[0], argv[1:]...)
 	case "modd":
 		cmd = exec.Command(shcmd, "--exec", command)
 	case "powershell":
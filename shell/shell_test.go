@@ -2,9 +2,11 @@ package shell
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -196,3 +198,23 @@ func TestCaseInsensitivePath(t *testing.T) {
 		},
 	)
 }
+
+func TestLogOutputLongLines(t *testing.T) {
+	long := strings.Repeat("x", 10000)
+	input := "one\n" + long + "\ntwo"
+	var lines []string
+	var wg sync.WaitGroup
+	wg.Add(1)
+	logOutput(&wg, ioutil.NopCloser(strings.NewReader(input)), func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	})
+	expected := []string{"one", long, "two"}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines, got %d", len(expected), len(lines))
+	}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Errorf("Line %d: expected %d bytes, got %d", i, len(expected[i]), len(lines[i]))
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// +build  !windows
+
+package shell
+
+import (
+	"fmt"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// UserSupported is true if commands can be run as a different user
+const UserSupported = true
+
+func parseID(s string) (uint32, bool) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	return uint32(id), err == nil
+}
+
+// lookupUser resolves a user specification of the form user or user:group.
+// Users and groups can be names or numeric ids. Numeric ids don't have to be
+// in the user database, as is common in containers, but then a group must be
+// given. Without a group, the user's primary group is used.
+func lookupUser(spec string) (*syscall.Credential, error) {
+	name, group := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		name, group = spec[:i], spec[i+1:]
+	}
+	cred := &syscall.Credential{}
+	var u *user.User
+	if uid, ok := parseID(name); ok {
+		cred.Uid = uid
+		u, _ = user.LookupId(name)
+		if u == nil && group == "" {
+			return nil, fmt.Errorf("unknown user id %s: a group must be given", name)
+		}
+	} else {
+		var err error
+		u, err = user.Lookup(name)
+		if err != nil {
+			return nil, fmt.Errorf("unknown user %q", name)
+		}
+		cred.Uid, _ = parseID(u.Uid)
+	}
+	if group == "" {
+		cred.Gid, _ = parseID(u.Gid)
+	} else if gid, ok := parseID(group); ok {
+		cred.Gid = gid
+	} else {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return nil, fmt.Errorf("unknown group %q", group)
+		}
+		cred.Gid, _ = parseID(g.Gid)
+	}
+	return cred, nil
+}
+
+// CheckUser checks that a user specification, as accepted by the user block
+// directive, can be resolved
+func CheckUser(spec string) error {
+	_, err := lookupUser(spec)
+	return err
+}
+
+// setUser makes a command run as the user given by spec. Supplementary
+// groups are dropped.
+func setUser(cmd *exec.Cmd, spec string) error {
+	cred, err := lookupUser(spec)
+	if err != nil {
+		return err
+	}
+	cmd.SysProcAttr.Credential = cred
+	return nil
+}
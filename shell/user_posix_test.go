@@ -0,0 +1,74 @@
+// +build  !windows
+
+package shell
+
+import (
+	"os"
+	"os/user"
+	"strings"
+	"testing"
+
+	"github.com/cortesi/termlog"
+)
+
+func TestLookupUser(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skip("no current user")
+	}
+	uid, _ := parseID(u.Uid)
+	gid, _ := parseID(u.Gid)
+	for _, spec := range []string{u.Username, u.Uid, u.Username + ":" + u.Gid} {
+		cred, err := lookupUser(spec)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", spec, err)
+			continue
+		}
+		if cred.Uid != uid || cred.Gid != gid {
+			t.Errorf("%s: expected %d:%d, got %d:%d", spec, uid, gid, cred.Uid, cred.Gid)
+		}
+	}
+
+	cred, err := lookupUser("4000000:4000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.Uid != 4000000 || cred.Gid != 4000001 {
+		t.Errorf("expected 4000000:4000001, got %d:%d", cred.Uid, cred.Gid)
+	}
+
+	errs := map[string]string{
+		"modd-no-such-user":                "unknown user",
+		"4000000":                          "a group must be given",
+		u.Username + ":modd-no-such-group": "unknown group",
+	}
+	for spec, msg := range errs {
+		err := CheckUser(spec)
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%s: expected error containing %q, got %v", spec, msg, err)
+		}
+	}
+}
+
+func TestRunAsUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("running as another user needs root")
+	}
+	lt := termlog.NewLogTest()
+	ex, err := NewExecutor("sh", "id -u; id -g", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.User = "4000000:4000001"
+	err, pstate := ex.Run(lt.Log.Stream(""), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pstate.Error != nil {
+		t.Fatalf("unexpected process error: %s", pstate.Error)
+	}
+	expected := "4000000\n4000001"
+	if !strings.Contains(lt.String(), expected) {
+		t.Errorf("expected output %q, got %q", expected, lt.String())
+	}
+}
@@ -0,0 +1,22 @@
+// +build  windows
+
+package shell
+
+import (
+	"os/exec"
+)
+
+// UserSupported is true if commands can be run as a different user
+const UserSupported = false
+
+// CheckUser checks that a user specification can be resolved. Commands always
+// run as the current user on Windows, so there is nothing to check.
+func CheckUser(spec string) error {
+	return nil
+}
+
+// setUser does nothing, since commands always run as the current user on
+// Windows
+func setUser(cmd *exec.Cmd, spec string) error {
+	return nil
+}
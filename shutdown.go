@@ -0,0 +1,42 @@
+package modd
+
+import (
+	"time"
+
+	"github.com/cortesi/modd/shell"
+	"github.com/cortesi/modd/varcmd"
+)
+
+// DefaultShutdownTimeout is the time each shutdown command is given to finish
+// if ModRunner.ShutdownTimeout is not set
+const DefaultShutdownTimeout = 10 * time.Second
+
+// runShutdown runs the shutdown commands of all blocks, in the order they are
+// declared. Each command is killed if it runs for longer than the shutdown
+// timeout, and a failing command doesn't stop the rest from running.
+func (mr *ModRunner) runShutdown() {
+	timeout := mr.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	vars := mr.Config.GetVariables()
+	sh, err := shell.GetShellName(vars[shellVarName])
+	if err != nil {
+		mr.Log.Shout("%s", err)
+		return
+	}
+	for i, b := range mr.Config.Blocks {
+		log := blockLog(b, mr.Log)
+		hooks := mr.blockHooks(i)
+		vcmd := varcmd.VarCmd{Block: &b, Vars: vars}
+		for _, c := range b.Shutdown {
+			cmd, err := vcmd.Render(c)
+			if err != nil {
+				log.Warn("%s", err)
+				continue
+			}
+			stream := log.Stream(niceHeader("shutdown: ", cmd))
+			runProc(cmd, sh, b.InDir, b.User, nil, nil, mr.OutputLimit, stream, hooks.command("shutdown", cmd), timeout)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package modd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cortesi/modd/conf"
+)
+
+// BlockSummary describes a block of a config, for inspecting a config
+// without running it
+type BlockSummary struct {
+	// The block number, starting at 1
+	Block int
+	// The block's patterns, after expansion. The default ignore list is left
+	// out of Exclude.
+	Include []string
+	Exclude []string
+	// Set if the default ignore list applies to the block
+	DefaultIgnores bool
+	// The directories watched for the block's include patterns
+	BasePaths []string
+	// The block's commands, each in the form "kind: command", in the order
+	// they run. Follow-up commands are indented under their prep.
+	Commands []string
+}
+
+func (s BlockSummary) String() string {
+	lines := []string{fmt.Sprintf("block %d", s.Block)}
+	field := func(name string, values []string) {
+		if len(values) > 0 {
+			lines = append(lines, fmt.Sprintf("    %s: %s", name, strings.Join(values, " ")))
+		}
+	}
+	field("include", s.Include)
+	field("exclude", s.Exclude)
+	if !s.DefaultIgnores {
+		lines = append(lines, "    default ignores: off")
+	}
+	field("watches", s.BasePaths)
+	for _, c := range s.Commands {
+		lines = append(lines, "    "+c)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// prepKind formats the kind of a prep command, with its flags
+func prepKind(p conf.Prep) string {
+	kind := "prep"
+	if p.Onchange {
+		kind += " +onchange"
+	}
+	if p.All {
+		kind += " +all"
+	}
+	if p.Retry > 0 {
+		kind += fmt.Sprintf(" +retry=%d", p.Retry)
+	}
+	if p.RetryDelay > 0 {
+		kind += " +retrydelay=" + p.RetryDelay.String()
+	}
+	for _, m := range p.Match {
+		kind += " +match=" + m
+	}
+	return kind
+}
+
+// Summarize describes each block of a config, in order of declaration. The
+// default ignore list is left out of the excludes if it was applied, as it is
+// when a config is read by a ModRunner.
+func Summarize(cnf *conf.Config) []BlockSummary {
+	ret := []BlockSummary{}
+	for i, b := range cnf.Blocks {
+		s := BlockSummary{
+			Block:          i + 1,
+			Include:        b.Include,
+			Exclude:        b.UserExcludes(CommonExcludes),
+			DefaultIgnores: !b.NoCommonFilter,
+			BasePaths:      conf.BasePaths(b.WatchedIncludes()),
+		}
+		for _, p := range orderPreps(b.Preps) {
+			s.Commands = append(s.Commands, prepKind(p)+": "+p.Command)
+			if p.OnSuccess != nil {
+				s.Commands = append(s.Commands, "    onsuccess: "+p.OnSuccess.Command)
+			}
+			if p.OnFailure != nil {
+				s.Commands = append(s.Commands, "    onfailure: "+p.OnFailure.Command)
+			}
+		}
+		for _, d := range b.Daemons {
+			s.Commands = append(s.Commands, "daemon: "+d.Command)
+		}
+		for _, c := range b.Shutdown {
+			s.Commands = append(s.Commands, "shutdown: "+c)
+		}
+		ret = append(ret, s)
+	}
+	return ret
+}
@@ -0,0 +1,61 @@
+package modd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cortesi/modd/conf"
+)
+
+func TestSummarize(t *testing.T) {
+	cnf, err := conf.Parse("test", `
+		src/**/*.go docs/** !**/*_test.go {
+			prep +onchange: go test ./...
+			onfailure: echo failed
+			prep +match=**/*.md: mdlint @mods
+			daemon: ./server
+		}
+		+noignore {
+			shutdown: rm -f server.pid
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cnf.CommonExcludes(CommonExcludes)
+	expected := []string{
+		`block 1
+    include: src/**/*.go docs/**
+    exclude: **/*_test.go
+    watches: src docs
+    prep +match=**/*.md: mdlint @mods
+    prep +onchange: go test ./...
+        onfailure: echo failed
+    daemon: ./server`,
+		`block 2
+    default ignores: off
+    shutdown: rm -f server.pid`,
+	}
+	ret := Summarize(cnf)
+	if len(ret) != len(expected) {
+		t.Fatalf("Expected %d blocks, got %d", len(expected), len(ret))
+	}
+	for i, s := range ret {
+		if s.String() != expected[i] {
+			t.Errorf("Expected\n%s\nGot\n%s", expected[i], s)
+		}
+	}
+}
+
+func TestSummarizeUnprepared(t *testing.T) {
+	// A config that never had the default ignore list applied keeps all of
+	// its excludes
+	cnf, err := conf.Parse("test", "src/** !a !b !c !d {\nprep: true\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := Summarize(cnf)
+	if expected := []string{"a", "b", "c", "d"}; !reflect.DeepEqual(ret[0].Exclude, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, ret[0].Exclude)
+	}
+}
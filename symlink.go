@@ -0,0 +1,30 @@
+package modd
+
+import (
+	"path/filepath"
+
+	"github.com/cortesi/modd/conf"
+)
+
+// realRoot returns dir with symlinks resolved, so that watches are placed on,
+// and event paths are reported relative to, the real directory. Some platforms
+// report events by real path, which would otherwise not lie under a root that
+// was reached through a symlink.
+func realRoot(dir string) string {
+	if real, err := filepath.EvalSymlinks(dir); err == nil {
+		return real
+	}
+	return dir
+}
+
+// realPatterns rewrites each of a list of patterns with conf.RealPattern. The
+// watcher rewrites patterns with symlinked base directories in place, and
+// resolves relative links incorrectly, so patterns should always pass through
+// here first.
+func realPatterns(root string, patterns []string) []string {
+	ret := make([]string, len(patterns))
+	for i, p := range patterns {
+		ret[i] = conf.RealPattern(root, p)
+	}
+	return ret
+}
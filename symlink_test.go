@@ -0,0 +1,117 @@
+package modd
+
+import (
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/utils"
+	"github.com/cortesi/modd/varcmd"
+	"github.com/cortesi/moddwatch"
+	"github.com/cortesi/termlog"
+)
+
+func TestWatchSymlinkBase(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping - symlinks need special privileges on Windows")
+	}
+	defer utils.WithTempDir(t)()
+	if err := os.MkdirAll("real/sub", 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("real", "link"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		link/** !link/sub/** {
+			prep +onchange: echo ":link:" @mods
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	modchan := make(chan *moddwatch.Mod, 1024)
+	cback := func() {
+		// Changes are reported for the link's target, whichever path they
+		// are made through
+		touch("real/one")
+		expected := []string{":link: ./real/one"}
+		waitEvents(t, lt, expected)
+
+		touch("real/sub/excluded")
+		touch("link/two")
+		expected = append(expected, ":link: ./real/two")
+		waitEvents(t, lt, expected)
+		modchan <- nil
+	}
+	mr := ModRunner{
+		Log:    lt.Log,
+		Config: cnf,
+	}
+	err = mr.runOnChan(modchan, cback)
+	if err != nil {
+		t.Fatalf("runOnChan: %s", err)
+	}
+}
+
+func TestRealPathExcludes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping - symlinks need special privileges on Windows")
+	}
+	defer utils.WithTempDir(t)()
+	touch("vendor/dep.go")
+	touch("lib/util.go")
+	touch("src/main.go")
+	if err := os.Symlink("../vendor/dep.go", "src/dep.go"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../lib/util.go", "src/util.go"); err != nil {
+		t.Fatal(err)
+	}
+	root, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := []string{"src/dep.go", "src/main.go", "src/util.go"}
+
+	tests := []struct {
+		patterns string
+		listed   []string
+		changed  []string
+	}{
+		// Symlinks are skipped when listing, but changes to them are seen,
+		// and the exclude doesn't reach through them
+		{"src/** !vendor/**", []string{"src/main.go"}, changed},
+		{"src/** !vendor/** +realpath", []string{"src/main.go", "src/util.go"}, []string{"src/main.go", "src/util.go"}},
+	}
+	for _, tt := range tests {
+		cnf, err := conf.Parse("test", tt.patterns+" {}")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := cnf.Blocks[0]
+		listed, err := varcmd.ListBlock(".", b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(listed)
+		if !reflect.DeepEqual(listed, tt.listed) {
+			t.Errorf("%s: expected listing %#v, got %#v", tt.patterns, tt.listed, listed)
+		}
+		mod, err := filterBlock(root, &moddwatch.Mod{Changed: changed}, b.RealPaths(root))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(mod.Changed, tt.changed) {
+			t.Errorf("%s: expected changes %#v, got %#v", tt.patterns, tt.changed, mod.Changed)
+		}
+	}
+}
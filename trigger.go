@@ -0,0 +1,58 @@
+package modd
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cortesi/moddwatch"
+)
+
+// ensureTriggerFile creates the trigger file if it doesn't exist, so that it
+// can be watched
+func ensureTriggerFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// TouchTrigger updates the modification time of a trigger file, creating it
+// if needed, which runs all blocks of a modd watching the file
+func TouchTrigger(path string) error {
+	if err := ensureTriggerFile(path); err != nil {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(path, now, now)
+}
+
+// without returns a copy of a mod with a path removed
+func without(mod *moddwatch.Mod, path string) *moddwatch.Mod {
+	remove := func(paths []string) []string {
+		ret := []string{}
+		for _, p := range paths {
+			if filepath.Clean(p) != filepath.Clean(path) {
+				ret = append(ret, p)
+			}
+		}
+		return ret
+	}
+	return &moddwatch.Mod{
+		Changed: remove(mod.Changed),
+		Deleted: remove(mod.Deleted),
+		Added:   remove(mod.Added),
+	}
+}
+
+// triggerAll runs every block as if a change had occurred, in response to a
+// change to the trigger file
+func (mr *ModRunner) triggerAll(dworld *DaemonWorld) {
+	mr.Log.Notice("Triggering all blocks via %s", mr.TriggerFile)
+	for i := range mr.Config.Blocks {
+		mr.exclusive(i, func() {
+			mr.runBlock(i, nil, dworld.DaemonPens[i], false)
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package varcmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cortesi/modd/conf"
+)
+
+// walkBases returns the directories to walk for a set of include patterns
+// relative to dir: the nearest existing directory enclosing the base path of
+// each pattern. Duplicates are dropped.
+func walkBases(dir string, includes []string) []string {
+	seen := map[string]bool{}
+	ret := []string{}
+	for _, p := range conf.BasePaths(includes) {
+		base := filepath.FromSlash(p)
+		if !filepath.IsAbs(base) {
+			base = filepath.Join(dir, base)
+		}
+		for {
+			if fi, err := os.Lstat(base); err == nil && fi.IsDir() {
+				break
+			}
+			parent := filepath.Dir(base)
+			if parent == base {
+				base = dir
+				break
+			}
+			base = parent
+		}
+		if !seen[base] {
+			seen[base] = true
+			ret = append(ret, base)
+		}
+	}
+	return ret
+}
+
+// normPath makes a walked path relative to the absolute root if it lies under
+// it, and slash-delimited, as moddwatch does for the paths it lists and
+// watches
+func normPath(aroot string, p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(aroot, abs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		abs = rel
+	}
+	return filepath.ToSlash(abs), nil
+}
+
+// WalkFiles calls fn for each file under dir that matches the patterns, with
+// the file's info from the walk, so that callers needing metadata don't have
+// to stat every file again. Files are matched with conf.MatchFile, which also
+// matches the watcher's changes to blocks, so @mods lists the same files that
+// changes would trigger a block for. Paths are in the same form as
+// moddwatch.List returns them, and each file is visited only once, even if it
+// lies under the base directories of several patterns. Symlinked base
+// directories are resolved as they are for watching, and symlinks inside them
+// are skipped. If fn returns an error, the walk stops and WalkFiles returns
+// it.
+func WalkFiles(dir string, includes []string, excludes []string, fn func(string, os.FileInfo) error) error {
+	return WalkBlock(dir, conf.Block{Include: includes, Exclude: excludes}, fn)
+}
+
+// WalkBlock is WalkFiles for the patterns of a block. If the block has
+// RealPathExcludes set, symlinks to files are visited too, with the info of
+// the file they point to, unless their real paths are excluded. Symlinks to
+// directories are never followed.
+func WalkBlock(dir string, blk conf.Block, fn func(string, os.FileInfo) error) error {
+	aroot, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	root := aroot
+	if real, err := filepath.EvalSymlinks(aroot); err == nil {
+		root = real
+	}
+	b := blk.RealPaths(root)
+	seen := map[string]bool{}
+	for _, base := range walkBases(dir, b.WatchedIncludes()) {
+		err := filepath.Walk(base, func(p string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				return nil
+			}
+			if fi.Mode()&os.ModeSymlink != 0 {
+				if !b.RealPathExcludes {
+					return nil
+				}
+				if fi, err = os.Stat(p); err != nil || fi.IsDir() {
+					return nil
+				}
+			}
+			// Malformed patterns never match, as they don't for the watcher
+			if match, err := conf.MatchFile(p, b.Include, b.Exclude); err != nil || !match {
+				return nil
+			}
+			if b.RealPathExcludes {
+				abs, err := filepath.Abs(p)
+				if err != nil {
+					return err
+				}
+				if excluded, err := conf.RealExcluded(root, abs, b.Exclude); err != nil || excluded {
+					return nil
+				}
+			}
+			norm, err := normPath(aroot, p)
+			if err != nil {
+				return err
+			}
+			if seen[norm] {
+				return nil
+			}
+			seen[norm] = true
+			return fn(norm, fi)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListFiles lists the files under dir that match the patterns, as visited by
+// WalkFiles
+func ListFiles(dir string, includes []string, excludes []string) ([]string, error) {
+	return ListBlock(dir, conf.Block{Include: includes, Exclude: excludes})
+}
+
+// ListBlock lists the files under dir that match a block's patterns, as
+// visited by WalkBlock
+func ListBlock(dir string, b conf.Block) ([]string, error) {
+	ret := []string{}
+	err := WalkBlock(dir, b, func(p string, _ os.FileInfo) error {
+		ret = append(ret, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
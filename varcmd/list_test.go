@@ -0,0 +1,74 @@
+package varcmd
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/cortesi/modd/utils"
+	"github.com/cortesi/moddwatch"
+)
+
+func TestListFiles(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	for _, p := range []string{"a.go", "src/b.go", "src/c.txt", "src/vendor/d.go", "docs/e.md"} {
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte("test"), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		includes []string
+		excludes []string
+	}{
+		{[]string{"**/*.go"}, nil},
+		{[]string{"src/**/*.go", "**/*.go"}, []string{"src/vendor/**"}},
+		{[]string{"missing/**", "docs/*.md"}, nil},
+		{[]string{"src/b.go", "a.go"}, nil},
+	}
+	for _, tt := range tests {
+		ret, err := ListFiles(".", tt.includes, tt.excludes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The walk must agree with the watcher's own listing, less duplicates
+		expected, err := moddwatch.List(".", tt.includes, tt.excludes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := map[string]bool{}
+		unique := []string{}
+		for _, p := range expected {
+			if !seen[p] {
+				seen[p] = true
+				unique = append(unique, p)
+			}
+		}
+		sort.Strings(ret)
+		sort.Strings(unique)
+		if !reflect.DeepEqual(ret, unique) {
+			t.Errorf("%v: expected\n%#v\ngot\n%#v", tt.includes, unique, ret)
+		}
+	}
+
+	stop := errors.New("stop")
+	visited := 0
+	err := WalkFiles(".", []string{"**"}, nil, func(p string, fi os.FileInfo) error {
+		visited++
+		if fi.Size() != 4 {
+			t.Errorf("%s: expected size 4, got %d", p, fi.Size())
+		}
+		return stop
+	})
+	if err != stop || visited != 1 {
+		t.Errorf("Expected the walk to stop after one file, got %v after %d", err, visited)
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"strings"
 
 	"github.com/cortesi/modd/conf"
-	"github.com/cortesi/moddwatch"
 )
 
 var name = regexp.MustCompile(`(\\*)@\w+`)
@@ -71,15 +70,9 @@ func (v *VarCmd) get(name string) (string, error) {
 		return val, nil
 	}
 	if (name == "@mods" || name == "@dirmods") && v.Block != nil {
-		var modified []string
-		if v.Modified == nil {
-			var err error
-			modified, err = moddwatch.List(".", v.Block.Include, v.Block.Exclude)
-			if err != nil {
-				return "", err
-			}
-		} else {
-			modified = v.Modified
+		modified, err := v.modified()
+		if err != nil {
+			return "", err
 		}
 		v.Vars["@mods"] = mkArgs(modified)
 		v.Vars["@dirmods"] = mkArgs(getDirs(modified))
@@ -88,6 +81,34 @@ func (v *VarCmd) get(name string) (string, error) {
 	return "", fmt.Errorf("No such variable: %s", name)
 }
 
+// modified returns the list of modified files. If no modified files were
+// specified, this is all files matching the block's patterns, found from the
+// block's indir directory if it has one.
+func (v *VarCmd) modified() ([]string, error) {
+	if v.Modified == nil && v.Block != nil {
+		root := "."
+		if v.Block.InDir != "" {
+			root = v.Block.InDir
+		}
+		return ListBlock(root, *v.Block)
+	}
+	return v.Modified, nil
+}
+
+// Paths returns the list of modified files in the same form as @mods, but
+// without quoting.
+func (v *VarCmd) Paths() ([]string, error) {
+	modified, err := v.modified()
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, len(modified))
+	for i, p := range modified {
+		paths[i] = realRel(p)
+	}
+	return paths, nil
+}
+
 const esc = '\\'
 
 // Render renders the command with a map of variables
@@ -97,6 +97,31 @@ func TestVarCmd(t *testing.T) {
 	}
 }
 
+func TestVarCmdOverlappingIncludes(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	for _, p := range []string{"src/a.go", "b.go"} {
+		if err := os.MkdirAll(path.Dir(p), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte("test"), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := conf.Block{}
+	b.Include = []string{"src/**/*.go", "**/*.go"}
+	vc := VarCmd{&b, nil, map[string]string{}}
+	ret, err := vc.Render("@mods")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expect := `"./src/a.go" "./b.go"`
+	if ret != expect {
+		t.Errorf("Expected: %#v, got %#v", expect, ret)
+	}
+}
+
 func TestRenderErrors(t *testing.T) {
 	b := conf.Block{}
 	vc := VarCmd{&b, nil, map[string]string{}}
@@ -0,0 +1,128 @@
+package modd
+
+import (
+	"context"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/moddwatch"
+)
+
+// Event is a change to a single file, delivered by Watch
+type Event struct {
+	// The path of the file, relative to the current directory if it's inside
+	// it, and absolute otherwise. Paths always use forward slashes.
+	Path string
+	// One of conf.EventAdded, conf.EventChanged or conf.EventDeleted
+	Kind string
+}
+
+// modEvents flattens a mod into events, ordered by kind and then path
+func modEvents(mod *moddwatch.Mod) []Event {
+	var ret []Event
+	for _, k := range []struct {
+		kind  string
+		paths []string
+	}{
+		{conf.EventAdded, mod.Added},
+		{conf.EventChanged, mod.Changed},
+		{conf.EventDeleted, mod.Deleted},
+	} {
+		paths := append([]string{}, k.paths...)
+		sort.Strings(paths)
+		for _, p := range paths {
+			ret = append(ret, Event{Path: p, Kind: k.kind})
+		}
+	}
+	return ret
+}
+
+// Watch watches the current directory for changes to files that match
+// includes and don't match excludes, using the same watching and filtering as
+// config blocks. Watches are set up on the base directories of the include
+// patterns before Watch returns, and are torn down when ctx is done, after
+// which the returned channel is closed. Symlinks in the current directory and
+// in the base directories are resolved, so events are reported with real
+// paths.
+//
+// Events are coalesced, not delivered once per OS notification. Changes are
+// collected until there has been a short lull in activity, and each batch then
+// reports every affected file once, with its net change: a file that was
+// created and then written to is reported as added, and a file that was
+// created and removed within a batch isn't reported at all. Delivery is best
+// effort - if the OS drops notifications under load, the corresponding events
+// are lost. Events in each batch are ordered by kind, and then by path. A save
+// that spans a lull can still produce the same event in consecutive batches,
+// which Dedup can filter out.
+func Watch(ctx context.Context, includes []string, excludes []string) (<-chan Event, error) {
+	root, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	root = realRoot(root)
+	includes = realPatterns(root, includes)
+	excludes = realPatterns(root, excludes)
+	modch := make(chan *moddwatch.Mod, 1024)
+	watcher, err := moddwatch.Watch(root, includes, excludes, lullTime, modch)
+	if err != nil {
+		return nil, watchError(err)
+	}
+	go func() {
+		<-ctx.Done()
+		watcher.Stop()
+	}()
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		// Keep reading until the watcher closes modch, so that it's never
+		// blocked sending to us while being stopped
+		for mod := range modch {
+			for _, e := range modEvents(mod) {
+				if ctx.Err() != nil {
+					break
+				}
+				select {
+				case events <- e:
+				case <-ctx.Done():
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// Dedup passes events through from in, dropping any event that repeats the
+// previous event for the same path if it arrives within window of it. This
+// suppresses the duplicate notifications some tools and filesystems produce
+// for a single save, without affecting batching. The window is measured from
+// the last event that was passed on, so a path that keeps changing still
+// produces an event every window. The returned channel is closed when in is
+// closed.
+func Dedup(in <-chan Event, window time.Duration) <-chan Event {
+	type seen struct {
+		kind string
+		at   time.Time
+	}
+	out := make(chan Event)
+	go func() {
+		defer close(out)
+		last := map[string]seen{}
+		for e := range in {
+			now := time.Now()
+			for p, s := range last {
+				if now.Sub(s.at) >= window {
+					delete(last, p)
+				}
+			}
+			if s, ok := last[e.Path]; ok && s.kind == e.Kind {
+				continue
+			}
+			last[e.Path] = seen{kind: e.Kind, at: now}
+			out <- e
+		}
+	}()
+	return out
+}
@@ -0,0 +1,182 @@
+package modd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/utils"
+)
+
+func TestWatchEvents(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	touch("vendor/keep")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := Watch(ctx, []string{"**/*.go"}, []string{"vendor/**"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func(expected Event) {
+		t.Helper()
+		select {
+		case e := <-events:
+			if !reflect.DeepEqual(e, expected) {
+				t.Errorf("Expected %#v, got %#v", expected, e)
+			}
+		case <-time.After(timeout):
+			t.Fatalf("Timed out waiting for %#v", expected)
+		}
+	}
+
+	// Excluded and unmatched files are filtered out, and a file that is
+	// created and written in one batch is only reported as added
+	touch("vendor/b.go")
+	touch("c.txt")
+	touch("a.go")
+	next(Event{Path: "a.go", Kind: conf.EventAdded})
+
+	touch("a.go")
+	next(Event{Path: "a.go", Kind: conf.EventChanged})
+
+	if err := os.Remove("a.go"); err != nil {
+		t.Fatal(err)
+	}
+	next(Event{Path: "a.go", Kind: conf.EventDeleted})
+
+	cancel()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			t.Errorf("Unexpected event after cancellation: %#v", e)
+		case <-time.After(timeout):
+			t.Fatal("Channel not closed after cancellation")
+		}
+	}
+}
+
+func TestWatchAtomicSave(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	touch("config/app.yaml")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := Watch(ctx, []string{"config/app.yaml"}, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func(save int) {
+		t.Helper()
+		select {
+		case e := <-events:
+			if e.Path != "config/app.yaml" || e.Kind == conf.EventDeleted {
+				t.Errorf("Save %d: unexpected event %#v", save, e)
+			}
+		case <-time.After(timeout):
+			t.Fatalf("Save %d: timed out waiting for an event", save)
+		}
+	}
+
+	// Editors that save by writing a temporary file and renaming it over the
+	// original replace the file's inode each time. Watches are on directories,
+	// so every save is seen, as is a plain write to the final file.
+	for i := 0; i < 5; i++ {
+		if err := ioutil.WriteFile("config/.app.yaml.tmp", []byte(fmt.Sprint(i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename("config/.app.yaml.tmp", "config/app.yaml"); err != nil {
+			t.Fatal(err)
+		}
+		next(i)
+	}
+	touch("config/app.yaml")
+	next(5)
+}
+
+func TestWatchOutsideRoot(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	touch("shared/keep.go")
+	touch("sub/own.go")
+	if err := os.Chdir("sub"); err != nil {
+		t.Fatal(err)
+	}
+	shared, err := filepath.Abs("../shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err = filepath.EvalSymlinks(shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := filepath.ToSlash(filepath.Join(shared, "a.go"))
+
+	// Paths outside the current directory are reported as absolute paths,
+	// so a ../ pattern has to match them as such
+	paths, err := listFiles(".", []string{"../shared/**"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keep := filepath.ToSlash(filepath.Join(shared, "keep.go")); !reflect.DeepEqual(paths, []string{keep}) {
+		t.Errorf("Expected %#v, got %#v", []string{keep}, paths)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := Watch(ctx, []string{"../shared/**"}, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	touch("../shared/a.go")
+	select {
+	case e := <-events:
+		if e.Path != expected {
+			t.Errorf("Expected an event for %s, got %#v", expected, e)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for an event outside the current directory")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	in := make(chan Event)
+	window := 200 * time.Millisecond
+	out := Dedup(in, window)
+	write := Event{Path: "a.go", Kind: conf.EventChanged}
+	go func() {
+		// Duplicates within the window are dropped, but a different kind of
+		// event for the same path, or an event for another path, isn't
+		in <- write
+		in <- write
+		in <- Event{Path: "b.go", Kind: conf.EventChanged}
+		in <- write
+		in <- Event{Path: "a.go", Kind: conf.EventDeleted}
+		in <- Event{Path: "a.go", Kind: conf.EventDeleted}
+		// Once the window has passed, the same event comes through again
+		time.Sleep(2 * window)
+		in <- Event{Path: "a.go", Kind: conf.EventDeleted}
+		close(in)
+	}()
+	ret := []Event{}
+	for e := range out {
+		ret = append(ret, e)
+	}
+	expected := []Event{
+		write,
+		{Path: "b.go", Kind: conf.EventChanged},
+		{Path: "a.go", Kind: conf.EventDeleted},
+		{Path: "a.go", Kind: conf.EventDeleted},
+	}
+	if !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}